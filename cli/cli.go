@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 
 	"github.com/blitz-frost/op/lib"
@@ -17,47 +18,115 @@ var (
 	stderr *lib.Fmt = lib.Stderr
 )
 
-var inPipe *os.File
+var (
+	inPipe *os.File
+	inMux  sync.Mutex // guards inPipe writes
+
+	registered = make(chan registration, 1) // receives the id and cancelation token given by the server
+)
+
+// A registration holds what the server gives a client on registration.
+type registration struct {
+	id    byte
+	token string
+}
 
 // On interrupt, announce server to cancel the current request.
 // Main routine will terminate when server closes output and error pipes.
+// Cancelation does not go through the input pipe, where it could wait behind stdin the command does not consume.
 func sigint() {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	<-c
-	cmd := lib.Cmd{Sw: lib.CmdCancel}
-	sendCmd(cmd)
+	reg := <-registered
+	if resp, err := http.Get(lib.CancelUrl(reg.id, reg.token)); err == nil {
+		resp.Body.Close()
+	}
 }
 
 // sendCmd encodes and sends the given command. Must not be called before opening the input pipe.
 func sendCmd(cmd lib.Cmd) error {
+	inMux.Lock()
+	defer inMux.Unlock()
 	enc := json.NewEncoder(inPipe)
 	return enc.Encode(cmd)
 }
 
-func Run() {
+// forwardStdin sends r to the server as stdin, in chunks, until EOF.
+func forwardStdin(r io.Reader) {
+	b := make([]byte, 4096)
+	for {
+		n, err := r.Read(b)
+		if n > 0 {
+			if sendCmd(lib.Cmd{Sw: lib.CmdInput, Data: b[:n]}) != nil {
+				return
+			}
+		}
+		if err != nil {
+			sendCmd(lib.Cmd{Sw: lib.CmdInput}) // EOF
+			return
+		}
+	}
+}
+
+// Run sends the command line command to the running server, and returns its exit status.
+func Run() int {
 	go sigint()
 
-	conf, err := lib.DecodeConfig()
+	sw, route, proc := lib.ArgSwitch, lib.ArgMajor, lib.ArgMinor
+	var (
+		conf lib.Manifest
+		err  error
+	)
+	if sw == lib.CmdExec {
+		conf, route, err = lib.ExecManifest()
+		proc = "" // the ad-hoc route has a single proc
+		sw = lib.CmdRun
+	} else {
+		conf, err = lib.DecodeConfig()
+		// listing and killing do not need a manifest, e.g. for ad-hoc routes, unless selecting routes by tag
+		if err != nil && (sw == lib.CmdList || sw == lib.CmdKill || sw == lib.CmdExit) && len(lib.ArgTags) == 0 {
+			conf, err = lib.MakeManifest(), nil
+			conf.Namespace = "default"
+			if lib.ArgNamespace != "" {
+				conf.Namespace = lib.ArgNamespace
+			}
+		}
+	}
 	if err != nil {
 		stderr.Println("manifest decode error:", err)
-		return
+		return 1
+	}
+
+	var in io.Reader = os.Stdin
+	if lib.ArgFile != "" {
+		f, err := os.Open(lib.ArgFile)
+		if err != nil {
+			stderr.Println("input file open error:", err)
+			return 1
+		}
+		defer f.Close()
+		in = f
 	}
 
 	resp, err := http.Get("http://localhost" + lib.Port + "/")
 	if err != nil {
 		stderr.Println("http error:", err)
-		return
+		return 1
 	}
 	defer resp.Body.Close()
 
 	if resp.ContentLength == 0 {
 		stderr.Println("refused by server")
-		return
+		return 1
 	}
 
-	r := make([]byte, 1)
-	resp.Body.Read(r)
+	r, err := io.ReadAll(resp.Body)
+	if err != nil || len(r) == 0 {
+		stderr.Println("refused by server")
+		return 1
+	}
+	registered <- registration{r[0], string(r[1:])}
 
 	var outPipe, errPipe *os.File
 	defer func() {
@@ -70,17 +139,17 @@ func Run() {
 	inPipe, err = os.OpenFile(paths[0], os.O_WRONLY, os.ModeNamedPipe)
 	if err != nil {
 		stderr.Println("input pipe open error: %w", err)
-		return
+		return 1
 	}
 	outPipe, err = os.OpenFile(paths[1], os.O_RDONLY, os.ModeNamedPipe)
 	if err != nil {
 		stderr.Println("output pipe open error: %w", err)
-		return
+		return 1
 	}
 	errPipe, err = os.OpenFile(paths[2], os.O_RDONLY, os.ModeNamedPipe)
 	if err != nil {
 		stderr.Println("error pipe open error: %w", err)
-		return
+		return 1
 	}
 
 	wg := sync.WaitGroup{}
@@ -100,16 +169,46 @@ func Run() {
 
 	// encode and send command
 	cmd := lib.Cmd{
-		Sw:        lib.ArgSwitch,
+		Sw:        sw,
 		Namespace: conf.Namespace,
-		Route:     lib.ArgMajor,
-		Proc:      lib.ArgMinor,
+		Route:     route,
+		Instance:  lib.ArgInstance,
+		Proc:      proc,
 		Config:    conf.Routes,
+		Groups:    conf.Groups,
+		Stdin:     lib.ArgStdin,
+		Count:     lib.ArgCount,
+		From:      lib.ArgFrom,
+		Signal:    lib.ArgSignal,
+		Follow:    lib.ArgFollow,
+		Json:      lib.ArgJson,
+		Watch:     lib.ArgWatch,
+		Timeout:   lib.ArgTimeout,
+		Color:     lib.ColorOutput(),
+		Quiet:     lib.ArgQuiet,
+		Messages:  lib.ArgMessages,
 	}
 	if err := sendCmd(cmd); err != nil {
 		stderr.Println("command send error:", err)
-		return
+		return 1
+	}
+
+	if lib.ArgStdin {
+		go forwardStdin(in)
 	}
 
 	wg.Wait()
+
+	// the server leaves the exit status once the output pipes close
+	b, err := os.ReadFile(lib.StatusPath(r[0]))
+	if err != nil {
+		stderr.Println("status read error:", err)
+		return 1
+	}
+	code, err := strconv.Atoi(string(b))
+	if err != nil {
+		stderr.Println("status parse error:", err)
+		return 1
+	}
+	return code
 }
@@ -2,4 +2,4 @@ module github.com/blitz-frost/op
 
 go 1.17
 
-require gopkg.in/yaml.v2 v2.4.0 // indirect
+require gopkg.in/yaml.v2 v2.4.0
@@ -2,14 +2,22 @@
 package lib
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"text/template"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -21,12 +29,57 @@ var (
 	TemplatePath string // template file path
 	MetaPath     string // meta file path
 	Port         string // server port
+
+	MaxConcurrentRoutes int // routes a server runs at once; others are queued; 0 means unlimited
+	MaxConcurrentProcs  int // procs a server runs at once; others wait to start; 0 means unlimited
+
+	LogBufferSize Size          = 64 << 10     // output a server keeps in memory per proc stream, for CmdLogs; 0 disables it
+	LogFormat     string        = FormatPrefix // format of the proc output lines a server writes to clients
+	LogShip       string                       // endpoint a server ships proc output lines to, as an http(s) URL or "tcp://host:port"; empty disables shipping
+	RunRetention  time.Duration                // how long a server keeps the archived output of route runs; 0 disables archiving
+	StderrStyle   string        = "31"         // SGR parameters of proc stderr lines in colored output; empty disables highlighting
+	MaxClientLine Size          = 1 << 20      // length past which proc and hook output lines are split, as soon as the server reads them; 0 means unlimited
+)
+
+// Output formats of proc output lines.
+const (
+	FormatPrefix = "prefix" // "route|proc: line"
+	FormatJson   = "json"   // one JSON object per line, with time, namespace, route, proc, stream and line
 )
 
 var (
-	ArgSwitch CmdSwitch // execution switch
-	ArgMajor  string    // route to execute, or meta variant to apply
-	ArgMinor  string    // proc to execute
+	ArgSwitch    CmdSwitch         // execution switch
+	ArgMajor     string            // route to execute, or meta variant to apply
+	ArgMinor     string            // proc to execute
+	ArgCount     int               // instance count to scale to
+	ArgFrom      string            // proc to start the route from, skipping earlier ones
+	ArgStdin     bool              // forward stdin to the executed proc
+	ArgPager     bool              // page output when done
+	ArgSave      string            // file to duplicate output into
+	ArgInstance  string            // route instance to run or target
+	ArgParams    map[string]string // route parameters, given as "name=value"
+	ArgSignal    string            // signal to send instead of killing
+	ArgFollow    bool              // keep streaming route output
+	ArgWatch     bool              // keep listing routes as their states change
+	ArgNoColor   bool              // never color proc output prefixes
+	ArgRun       string            // archived route run to print the output of
+	ArgQuiet     bool              // discard op's own messages
+	ArgMessages  string            // file to append op's own messages to
+	ArgDir       string            // ad-hoc command working directory
+	ArgEnv       map[string]string // ad-hoc command env
+	ArgCommand   []string          // command to execute in the context of a route; given after "--"
+	ArgFile      string            // file to write to a running proc instead of stdin
+	ArgNamespace string            // namespace to target instead of the manifest's
+	ArgTags      []string          // tags the targeted routes must all carry
+
+	ArgVariant string // meta variant to apply when printing
+	ArgResolve bool   // print resolved manifest
+	ArgJson    bool   // print in JSON format
+
+	ArgLast time.Duration // stats report window
+	ArgFor  time.Duration // simulation window
+
+	ArgTimeout time.Duration // wait timeout; 0 means unlimited
 )
 
 func init() {
@@ -37,17 +90,75 @@ func init() {
 
 	BasePath = os.Getenv("OP_WORKDIR")
 	if BasePath == "" {
-		uid := os.Getuid()
-		BasePath = "/run/user/" + strconv.Itoa(uid) + "/op"
-		if err := os.Mkdir(BasePath, 0700); err != nil && !errors.Is(err, os.ErrExist) {
-			fmt.Println("base path make error:", err)
-			os.Exit(1)
-		}
+		BasePath = "/run/user/" + strconv.Itoa(os.Getuid()) + "/op"
 	}
 
 	LockPath = BasePath + "/lock"
 
-	parseArgs()
+	if s := os.Getenv("OP_MAX_ROUTES"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			fmt.Println("OP_MAX_ROUTES must be a non-negative integer")
+			os.Exit(1)
+		}
+		MaxConcurrentRoutes = n
+	}
+	if s := os.Getenv("OP_MAX_PROCS"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			fmt.Println("OP_MAX_PROCS must be a non-negative integer")
+			os.Exit(1)
+		}
+		MaxConcurrentProcs = n
+	}
+	if s := os.Getenv("OP_LOG_FORMAT"); s != "" {
+		if s != FormatPrefix && s != FormatJson {
+			fmt.Println("OP_LOG_FORMAT must be " + FormatPrefix + " or " + FormatJson)
+			os.Exit(1)
+		}
+		LogFormat = s
+	}
+	if s := os.Getenv("OP_LOG_SHIP"); s != "" {
+		if !strings.HasPrefix(s, "http://") && !strings.HasPrefix(s, "https://") && !strings.HasPrefix(s, "tcp://") {
+			fmt.Println("OP_LOG_SHIP must be an http(s) URL or tcp://host:port")
+			os.Exit(1)
+		}
+		LogShip = s
+	}
+	if s := os.Getenv("OP_LOG_BUFFER"); s != "" {
+		n, err := ParseSize(s)
+		if err != nil {
+			fmt.Println("OP_LOG_BUFFER error:", err)
+			os.Exit(1)
+		}
+		LogBufferSize = n
+	}
+	if s, ok := os.LookupEnv("OP_STDERR_STYLE"); ok {
+		if strings.Trim(s, "0123456789;") != "" {
+			fmt.Println("OP_STDERR_STYLE must consist of SGR parameters, such as \"1;31\"")
+			os.Exit(1)
+		}
+		StderrStyle = s
+	}
+	if s := os.Getenv("OP_MAX_LINE"); s != "" {
+		n, err := ParseSize(s)
+		if err == nil && n > 0 && n < 64 {
+			err = errors.New("must be 0 or at least 64 bytes")
+		}
+		if err != nil {
+			fmt.Println("OP_MAX_LINE error:", err)
+			os.Exit(1)
+		}
+		MaxClientLine = n
+	}
+	if s := os.Getenv("OP_RUN_ARCHIVE"); s != "" {
+		var d Duration
+		if err := d.parse(s); err != nil {
+			fmt.Println("OP_RUN_ARCHIVE error:", err)
+			os.Exit(1)
+		}
+		RunRetention = time.Duration(d)
+	}
 
 	TemplatePath = os.Getenv("OP_TEMPLATE")
 	if TemplatePath == "" {
@@ -60,59 +171,394 @@ func init() {
 	}
 }
 
-// parseArgs interprets the command line arguments.
-func parseArgs() {
-	m := make(map[CmdSwitch]struct{})
+// Init creates the default base path and interprets the command line arguments, exiting on error.
+// Must be called before the Arg variables are used; helper processes that only execute a command skip it.
+func Init() {
+	if os.Getenv("OP_WORKDIR") == "" {
+		if err := os.Mkdir(BasePath, 0700); err != nil && !errors.Is(err, os.ErrExist) {
+			fmt.Println("base path make error:", err)
+			os.Exit(1)
+		}
+	}
 
-	// read switches until the first undefined argument
-	var i int
-	for i = 1; i < len(os.Args); i++ {
-		if !isNotRun(os.Args[i]) {
+	x, err := parseArgs(os.Args[1:])
+	if err != nil {
+		usageError(err.Error())
+	}
+	x.apply()
+}
+
+// ColorOutput returns true if proc output prefixes should be colored: stdout is a terminal, output is not duplicated into a file,
+// and neither OptNoColor nor the NO_COLOR env are set.
+func ColorOutput() bool {
+	if ArgNoColor || ArgSave != "" || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	fi, err := os.Stdout.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// A cmdLine holds the values given on the command line; see the Arg variables.
+type cmdLine struct {
+	Switch    CmdSwitch
+	Major     string
+	Minor     string
+	Count     int
+	From      string
+	Stdin     bool
+	Pager     bool
+	Save      string
+	Instance  string
+	Params    map[string]string
+	Signal    string
+	Follow    bool
+	Watch     bool
+	NoColor   bool
+	Run       string
+	Quiet     bool
+	Messages  string
+	Dir       string
+	Env       map[string]string
+	Command   []string
+	File      string
+	Namespace string
+	Tags      []string
+	Variant   string
+	Resolve   bool
+	Json      bool
+	Last      time.Duration
+	For       time.Duration
+	Timeout   time.Duration
+
+	Config string // manifest path; see ConfigPath
+}
+
+// apply sets the Arg variables, and ConfigPath, to the values of x.
+func (x cmdLine) apply() {
+	ArgSwitch = x.Switch
+	ArgMajor = x.Major
+	ArgMinor = x.Minor
+	ArgCount = x.Count
+	ArgFrom = x.From
+	ArgStdin = x.Stdin
+	ArgPager = x.Pager
+	ArgSave = x.Save
+	ArgInstance = x.Instance
+	ArgParams = x.Params
+	ArgSignal = x.Signal
+	ArgFollow = x.Follow
+	ArgWatch = x.Watch
+	ArgNoColor = x.NoColor
+	ArgRun = x.Run
+	ArgQuiet = x.Quiet
+	ArgMessages = x.Messages
+	ArgDir = x.Dir
+	ArgEnv = x.Env
+	ArgCommand = x.Command
+	ArgFile = x.File
+	ArgNamespace = x.Namespace
+	ArgTags = x.Tags
+	ArgVariant = x.Variant
+	ArgResolve = x.Resolve
+	ArgJson = x.Json
+	ArgLast = x.Last
+	ArgFor = x.For
+	ArgTimeout = x.Timeout
+	ConfigPath = x.Config
+}
+
+// parseArgs interprets the command line arguments.
+// Switches and options may be placed anywhere, in any order, up to a "--" argument; the following ones are the command of CmdExec.
+// The other arguments are, in order, the target route and proc; those of the form "name=value" are route parameters.
+// Returns an error describing an invalid command line.
+func parseArgs(args []string) (cmdLine, error) {
+	var x cmdLine
+	m := make(map[CmdSwitch]int)
+	fs := newFlagSet(&x, m)
+
+	// the flag package stops at the first positional argument, so parsing resumes after each one
+	var (
+		pos  []string
+		verb string
+	)
+	for len(args) > 0 {
+		if err := fs.Parse(args); err == flag.ErrHelp {
+			m[CmdHelp]++
+		} else if err != nil {
+			return cmdLine{}, err
+		}
+		rest := fs.Args()
+		if n := len(args) - len(rest); n > 0 && args[n-1] == "--" {
+			x.Command = rest
+			break
+		}
+		if len(rest) == 0 {
 			break
 		}
-		sw := CmdSwitch(os.Args[i])
 
-		// repeating switches are invalid
-		if _, ok := m[sw]; ok {
-			fmt.Println("invalid command line")
-			os.Exit(1)
+		// a verb takes the place of its switch, as the first positional argument
+		if sw, ok := verbMap[rest[0]]; ok && len(pos) == 0 && !hasCommand(m) {
+			m[sw]++
+			verb = rest[0]
+		} else {
+			pos = append(pos, rest[0])
 		}
+		args = rest[1:]
+	}
 
-		m[CmdSwitch(os.Args[i])] = struct{}{}
+	var names []string
+	for sw, n := range m {
+		if n > 1 {
+			return cmdLine{}, errors.New("repeated switch " + string(sw))
+		}
+		if sw != CmdGlobal && sw != CmdStdin {
+			names = append(names, string(sw))
+		}
 	}
 
 	// if global switch is present, use global manifest
 	if _, ok := m[CmdGlobal]; ok {
-		ConfigPath = os.Getenv("OP_GLOBAL")
-		delete(m, CmdGlobal)
-	} else {
-		ConfigPath = os.Getenv("OP")
-		if ConfigPath == "" {
-			ConfigPath = "op.yaml"
+		if x.Config != "" {
+			return cmdLine{}, errors.New(CmdGlobal + " and " + OptConfig + " cannot be combined")
+		}
+		x.Config = os.Getenv("OP_GLOBAL")
+	} else if x.Config == "" {
+		x.Config = os.Getenv("OP")
+		if x.Config == "" {
+			x.Config = "op.yaml"
 		}
 	}
 
-	// currently, only up to one switch may be provided, apart from CmdGlobal
-	if len(m) > 1 {
-		fmt.Println("invalid command line")
-		os.Exit(1)
+	// stdin switch only modifies run commands
+	if _, ok := m[CmdStdin]; ok {
+		x.Stdin = true
+	}
+	// feeding always forwards stdin, or a file
+	if _, ok := m[CmdFeed]; ok {
+		x.Stdin = true
+	} else if x.File != "" {
+		return cmdLine{}, errors.New(OptFile + " requires " + CmdFeed)
 	}
 
-	for sw, _ := range m {
-		ArgSwitch = sw
+	// currently, only up to one switch may be provided, apart from CmdGlobal and CmdStdin
+	if len(names) > 1 {
+		sort.Strings(names)
+		return cmdLine{}, errors.New("switches " + strings.Join(names, ", ") + " cannot be combined")
+	}
+	if len(names) == 1 {
+		x.Switch = CmdSwitch(names[0])
 	}
 
-	// first undefined argument is interpreted as the target route
-	if i >= len(os.Args) {
-		return
+	// the signal verb takes the signal as last argument, and its target may be given as "route.proc"
+	if verb == VerbSignal {
+		i := len(pos) - 1
+		for i >= 0 && strings.IndexByte(pos[i], '=') > 0 {
+			i--
+		}
+		if i < 0 {
+			return cmdLine{}, errors.New("a signal is required")
+		}
+		if x.Signal != "" {
+			return cmdLine{}, errors.New("signal given both as argument and as " + OptSignal)
+		}
+		x.Signal = pos[i]
+		pos = append(pos[:i:i], pos[i+1:]...)
+
+		if x.Major == "" && len(pos) > 0 && strings.IndexByte(pos[0], '=') < 0 {
+			if j := strings.IndexByte(pos[0], '.'); j > 0 {
+				if x.Minor != "" {
+					return cmdLine{}, errors.New("proc given both as argument and as " + OptProc)
+				}
+				x.Major, x.Minor, pos = pos[0][:j], pos[0][j+1:], pos[1:]
+			}
+		}
 	}
-	ArgMajor = os.Args[i]
 
-	// second undefined argument is interpreted as the target proc
-	if i++; i >= len(os.Args) {
-		return
+	// first positional argument is interpreted as the target route, unless given as an option
+	route, proc := x.Major, x.Minor
+	if route == "" && len(pos) > 0 {
+		x.Major, pos = pos[0], pos[1:]
+	}
+
+	// following arguments of the form "name=value" are route parameters, wherever they appear
+	var rest []string
+	for _, arg := range pos {
+		j := strings.IndexByte(arg, '=')
+		if j <= 0 {
+			rest = append(rest, arg)
+			continue
+		}
+		if x.Params == nil {
+			x.Params = make(map[string]string)
+		}
+		if _, ok := x.Params[arg[:j]]; ok {
+			return cmdLine{}, errors.New("repeated parameter " + arg[:j])
+		}
+		x.Params[arg[:j]] = arg[j+1:]
+	}
+
+	// second positional argument is interpreted as the target proc, unless given as an option
+	if len(rest) > 0 {
+		if proc != "" {
+			return cmdLine{}, errors.New("proc given both as argument and as " + OptProc)
+		}
+		x.Minor, rest = rest[0], rest[1:]
+	}
+	if x.Minor != "" && x.Major == "" {
+		return cmdLine{}, errors.New(OptProc + " requires a route")
+	}
+
+	// a tag selection is targeted like a route group; see DecodeConfig
+	if len(x.Tags) > 0 {
+		if x.Major != "" {
+			return cmdLine{}, errors.New(OptTag + " cannot be combined with a route")
+		}
+		x.Major = TagTarget + strings.Join(x.Tags, ",")
+	}
+
+	// third positional argument is interpreted as the instance count, when scaling
+	if len(rest) > 0 && x.Switch == CmdScale {
+		n, err := strconv.Atoi(rest[0])
+		if err != nil {
+			return cmdLine{}, errors.New("invalid instance count " + strconv.Quote(rest[0]))
+		}
+		x.Count, rest = n, rest[1:]
+	}
+	// ad-hoc commands report extra arguments themselves; see ExecManifest
+	if len(rest) > 0 && x.Switch != CmdExec {
+		return cmdLine{}, errors.New("unexpected argument " + strconv.Quote(rest[0]))
+	}
+	if len(x.Command) > 0 && x.Switch != CmdExec {
+		return cmdLine{}, errors.New("a command after \"--\" requires " + CmdExec)
 	}
-	ArgMinor = os.Args[i]
+	return x, nil
+}
+
+// newFlagSet returns a flag set that records command switches into m, and options into x.
+func newFlagSet(x *cmdLine, m map[CmdSwitch]int) *flag.FlagSet {
+	fs := flag.NewFlagSet("op", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	for sw := range switchMap {
+		fs.Var(switchFlag{sw, m}, string(sw[1:]), "")
+	}
+
+	opt := func(name string) string {
+		return strings.TrimPrefix(name, "--")
+	}
+	nonEmpty := func(dst *string) func(string) error {
+		return func(s string) error {
+			if s == "" {
+				return errors.New("must not be empty")
+			}
+			*dst = s
+			return nil
+		}
+	}
+
+	fs.BoolVar(&x.Pager, opt(OptPager), false, "once done, display the combined output through $PAGER")
+	fs.StringVar(&x.Save, opt(OptSave), "", "duplicate all output into the given `path`")
+	fs.BoolVar(&x.NoColor, opt(OptNoColor), false, "do not color proc output")
+	fs.BoolVar(&x.Quiet, opt(OptQuiet), false, "discard op's own messages")
+	fs.Func(opt(OptMessages), "append op's own messages to the given `path`", func(s string) error {
+		abs, err := filepath.Abs(s)
+		x.Messages = abs
+		return err
+	})
+	fs.Func(opt(OptConfig), "use the manifest at the given `path`", nonEmpty(&x.Config))
+	fs.Func(opt(OptNamespace), "target the given `namespace` instead of the manifest's", func(s string) error {
+		if s == "" || strings.Contains(s, "|") {
+			return errors.New("must not be empty or contain \"|\"")
+		}
+		x.Namespace = s
+		return nil
+	})
+	fs.Func(opt(OptRoute), "target `route`, as the first argument would", nonEmpty(&x.Major))
+	fs.Func(opt(OptProc), "target `proc` of the route, as the second argument would", nonEmpty(&x.Minor))
+	fs.Func(opt(OptTag), "target the routes carrying `tag`; may be repeated, to require several", func(s string) error {
+		if s == "" || strings.Contains(s, ",") {
+			return errors.New("must not be empty or contain \",\"")
+		}
+		x.Tags = append(x.Tags, s)
+		return nil
+	})
+	fs.Func(opt(OptInstance), "target the named route `instance`", func(s string) error {
+		if s == "" || strings.ContainsAny(s, "#|") {
+			return errors.New("must not be empty or contain \"#\" or \"|\"")
+		}
+		x.Instance = s
+		return nil
+	})
+	fs.StringVar(&x.From, opt(OptFrom), "", "run the route starting with `proc`")
+	fs.StringVar(&x.Signal, opt(OptSignal), "", "send `signal` to the targeted procs instead of killing them")
+	fs.BoolVar(&x.Follow, opt(OptFollow), false, "keep streaming route output")
+	fs.BoolVar(&x.Watch, opt(OptWatch), false, "keep listing routes as their states change")
+	fs.StringVar(&x.Run, opt(OptRun), "", "print the archived output of the run with the given `id`")
+	fs.DurationVar(&x.Last, opt(OptLast), 24*time.Hour, "stats report window")
+	fs.DurationVar(&x.For, opt(OptFor), 24*time.Hour, "simulation window")
+	fs.DurationVar(&x.Timeout, opt(OptTimeout), 0, "stop waiting after the given `duration`")
+	fs.Func(opt(OptFile), "write the given file to a running proc, instead of stdin", nonEmpty(&x.File))
+	fs.StringVar(&x.Dir, opt(OptDir), "", "working `directory` of an ad-hoc command")
+	fs.Func(opt(OptEnv), "env var of an ad-hoc command, as `name=value`; may be repeated", func(s string) error {
+		j := strings.IndexByte(s, '=')
+		if j <= 0 {
+			return errors.New("must be name=value")
+		}
+		if x.Env == nil {
+			x.Env = make(map[string]string)
+		}
+		x.Env[s[:j]] = s[j+1:]
+		return nil
+	})
+	fs.StringVar(&x.Variant, opt(OptVariant), "", "print the config generated by the given meta `variant`")
+	fs.BoolVar(&x.Resolve, opt(OptResolve), false, "print the fully resolved config")
+	fs.BoolVar(&x.Json, opt(OptJson), false, "print in JSON format")
+
+	options = fs
+	return fs
+}
+
+// options holds the command line options, for help.
+var options *flag.FlagSet
+
+// PrintOptions writes the command line options and their descriptions to w.
+func PrintOptions(w io.Writer) {
+	options.VisitAll(func(f *flag.Flag) {
+		if len(f.Name) == 1 {
+			return // switch
+		}
+		arg, usage := flag.UnquoteUsage(f)
+		fmt.Fprintf(w, "  %-24s %s\n", "--"+f.Name+" "+arg, usage)
+	})
+}
+
+// A switchFlag records a command switch, and how many times it was given.
+type switchFlag struct {
+	sw CmdSwitch
+	m  map[CmdSwitch]int
+}
+
+func (x switchFlag) String() string {
+	return ""
+}
+
+func (x switchFlag) Set(s string) error {
+	if s != "true" {
+		return errors.New("switches take no value")
+	}
+	x.m[x.sw]++
+	return nil
+}
+
+func (x switchFlag) IsBoolFlag() bool {
+	return true
+}
+
+// usageError reports an invalid command line and exits.
+func usageError(s string) {
+	fmt.Fprintln(os.Stderr, "op: "+s)
+	fmt.Fprintln(os.Stderr, "run \"op help\" for usage")
+	os.Exit(2)
 }
 
 // PipePaths returns the full paths for the pipe set to be used by the client with given id.
@@ -125,6 +571,17 @@ func PipePaths(id byte) [3]string {
 	}
 }
 
+// CancelUrl returns the server URL that cancels the command of the client with given id, authorized by the token the server gave it.
+// Cancelation is requested out of band, so that it is not held up behind stdin the command does not consume.
+func CancelUrl(id byte, token string) string {
+	return "http://localhost" + Port + "/cancel?id=" + strconv.FormatUint(uint64(id), 10) + "&token=" + url.QueryEscape(token)
+}
+
+// StatusPath returns the full path of the file holding the exit status of the command of the client with given id.
+func StatusPath(id byte) string {
+	return BasePath + "/" + strconv.FormatUint(uint64(id), 10) + "_status"
+}
+
 // A Fmt wraps an io.Writer to be concurrent safe.
 // Also provides fmt package formating.
 type Fmt struct {
@@ -132,122 +589,773 @@ type Fmt struct {
 	mux sync.Mutex
 }
 
-func NewFmt(w io.Writer) *Fmt {
-	return &Fmt{dst: w}
+func NewFmt(w io.Writer) *Fmt {
+	return &Fmt{dst: w}
+}
+
+// Redirect replaces the underlying writer.
+func (x *Fmt) Redirect(w io.Writer) {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	x.dst = w
+}
+
+func (x *Fmt) Write(b []byte) (int, error) {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	return x.dst.Write(b)
+}
+
+func (x *Fmt) Print(a ...interface{}) (n int, err error) {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	return x.dst.Write([]byte(fmt.Sprint(a...)))
+}
+
+func (x *Fmt) Println(a ...interface{}) (n int, err error) {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	return x.dst.Write([]byte(fmt.Sprintln(a...)))
+}
+
+var (
+	Stdout *Fmt = NewFmt(os.Stdout)
+	Stderr *Fmt = NewFmt(os.Stderr)
+)
+
+type CmdSwitch string
+
+const (
+	CmdAdopt    CmdSwitch = "-a" // adopt detached procs left running by a previous server
+	CmdAttach             = "-j" // stream the live output of an active route, and optionally forward stdin to it
+	CmdCancel             = "-c" // cancel client command; not for end users
+	CmdDrain              = "-q" // stop accepting runs, wait for active routes, then shut down server
+	CmdExec               = "-x" // run an ad-hoc command as a single proc route, without a manifest
+	CmdExit               = "-e" // shut down dedicated server
+	CmdFeed               = "-f" // write stdin, or a file, to an interactive running proc
+	CmdGlobal             = "-g" // global switch; only valid as a command line arg
+	CmdHelp               = "-h" // print the available verbs
+	CmdInput              = "-d" // stdin data for the executed proc; not for end users
+	CmdKill               = "-k" // kill routes
+	CmdList               = "-l" // list active routes
+	CmdLogs               = "-v" // print the recent output of a route, kept by the server
+	CmdMeta               = "-m" // generate config from template and meta
+	CmdPrint              = "-p" // print config routes
+	CmdRestart            = "-r" // restart routes
+	CmdResume             = "-o" // run a route from where its last interrupted run stopped
+	CmdRun                = ""   // run routes
+	CmdScale              = "-u" // set the number of running instances of a proc
+	CmdServer             = "-s" // run as dedicated server
+	CmdSimulate           = "-n" // print what a run would do, without running anything
+	CmdStats              = "-t" // print route resource usage history
+	CmdStdin              = "-i" // forward stdin to the executed proc; only valid as a command line arg
+	CmdWait               = "-w" // wait for an active route to terminate
+)
+
+// Options; these may be placed anywhere, either as "--name value" or as "--name=value".
+const (
+	OptPager     = "--pager"     // page output through $PAGER when done
+	OptSave      = "--save"      // duplicate output into the following file path
+	OptVariant   = "--variant"   // print config as generated by the following meta variant
+	OptResolve   = "--resolve"   // print the fully resolved config
+	OptJson      = "--json"      // print in JSON format
+	OptLast      = "--last"      // stats report window
+	OptFor       = "--for"       // simulation window
+	OptInstance  = "--instance"  // route instance to run or target
+	OptFrom      = "--from"      // proc to start a route run from
+	OptSignal    = "--signal"    // signal sent by a kill instead of stopping the target
+	OptFollow    = "--follow"    // keep streaming route output
+	OptWatch     = "--watch"     // keep listing routes as their states change
+	OptNoColor   = "--no-color"  // disable colored proc output prefixes
+	OptRun       = "--run"       // archived route run to print the output of
+	OptQuiet     = "--quiet"     // discard op's own messages
+	OptMessages  = "--messages"  // append op's own messages to the following file path
+	OptDir       = "--dir"       // working directory of an ad-hoc command
+	OptEnv       = "--env"       // env var of an ad-hoc command, as "name=value"; may be repeated
+	OptConfig    = "--config"    // manifest path, instead of OP or "op.yaml"
+	OptNamespace = "--namespace" // namespace to target, instead of the manifest's
+	OptRoute     = "--route"     // target route, instead of the first argument
+	OptProc      = "--proc"      // target proc, instead of the second argument
+	OptTag       = "--tag"       // target the routes carrying a tag; may be repeated
+	OptTimeout   = "--timeout"   // how long a wait may last
+	OptFile      = "--file"      // file to write to a running proc, instead of stdin
+)
+
+// TagTarget prefixes the route target of a tag selection, e.g. "tag:web,prod".
+const TagTarget = "tag:"
+
+var switchMap = map[CmdSwitch]struct{}{
+	CmdAdopt:    struct{}{},
+	CmdAttach:   struct{}{},
+	CmdCancel:   struct{}{},
+	CmdDrain:    struct{}{},
+	CmdExec:     struct{}{},
+	CmdExit:     struct{}{},
+	CmdFeed:     struct{}{},
+	CmdGlobal:   struct{}{},
+	CmdHelp:     struct{}{},
+	CmdKill:     struct{}{},
+	CmdList:     struct{}{},
+	CmdLogs:     struct{}{},
+	CmdMeta:     struct{}{},
+	CmdPrint:    struct{}{},
+	CmdRestart:  struct{}{},
+	CmdResume:   struct{}{},
+	CmdScale:    struct{}{},
+	CmdServer:   struct{}{},
+	CmdSimulate: struct{}{},
+	CmdStats:    struct{}{},
+	CmdStdin:    struct{}{},
+	CmdWait:     struct{}{},
+}
+
+// A Verb is a command name that may be given instead of its switch, e.g. "op kill route" for "op -k route".
+type Verb struct {
+	Name string
+	Sw   CmdSwitch
+	Desc string
+}
+
+// Verbs lists the defined verbs, in help order.
+var Verbs = []Verb{
+	{"run", CmdRun, "run routes, or a proc of a route; the default command"},
+	{"exec", CmdExec, "run an ad-hoc command as a single proc route, without a manifest, or in the context of a route, after \"--\""},
+	{"resume", CmdResume, "resume a route from the first proc its last run had not completed"},
+	{"simulate", CmdSimulate, "print what a run would do, without running anything"},
+	{"list", CmdList, "list active routes and the last finished runs"},
+	{"logs", CmdLogs, "print the recent output of a route"},
+	{"attach", CmdAttach, "stream the live output of an active route, and forward stdin to it with -i"},
+	{"stdin", CmdFeed, "write stdin, or a file, to an interactive proc of an active route"},
+	{"wait", CmdWait, "wait for an active route to terminate, and exit with its result"},
+	{"stats", CmdStats, "print the resource usage history of a route"},
+	{"kill", CmdKill, "kill active routes, or signal their procs"},
+	{VerbSignal, CmdKill, "send the signal given as last argument to the procs of active routes, e.g. \"op signal route.proc HUP\""},
+	{"restart", CmdRestart, "restart routes, or a proc of an active route"},
+	{"scale", CmdScale, "set the number of running instances of a proc"},
+	{"adopt", CmdAdopt, "adopt detached procs left running by a previous server"},
+	{"print", CmdPrint, "print manifest routes"},
+	{"meta", CmdMeta, "list meta variants, or generate the manifest from one"},
+	{"server", CmdServer, "start as dedicated server"},
+	{"drain", CmdDrain, "let active routes finish, then shut down the server"},
+	{"exit", CmdExit, "shut down the dedicated server"},
+	{"help", CmdHelp, "print this list"},
+}
+
+// VerbSignal is the kill verb that takes its signal as argument, instead of through OptSignal.
+const VerbSignal = "signal"
+
+var verbMap = func() map[string]CmdSwitch {
+	m := make(map[string]CmdSwitch, len(Verbs))
+	for _, v := range Verbs {
+		m[v.Name] = v.Sw
+	}
+	return m
+}()
+
+// hasCommand returns true if m holds a command switch, other than the CmdGlobal and CmdStdin modifiers.
+func hasCommand(m map[CmdSwitch]int) bool {
+	for sw := range m {
+		if sw != CmdGlobal && sw != CmdStdin {
+			return true
+		}
+	}
+	return false
+}
+
+// A Proc holds the information necessary to execute a process.
+type Proc struct {
+	Var  map[string]string
+	Env  map[string]string
+	Name string
+	Path string
+	Dir  string
+	Args []string
+	In   string
+	Out  Output
+	Err  Output
+
+	InText string // written to stdin, if In is not set
+
+	Nice   *int // scheduling niceness, applied after start
+	IONice *int // best-effort IO priority level (0-7), applied after start
+
+	OOMScoreAdj *int // written to /proc/[pid]/oom_score_adj after start
+
+	Banner bool // write start/end banner lines into out and err files
+
+	Literal bool // skip var interpretation of proc attributes
+
+	InheritEnv *bool    // start from the server environment, overlaid by Env
+	EnvPass    []string // server env names copied into the process env, overlaid by Env
+
+	Umask string // octal file mode creation mask for the process and its output files
+
+	Append bool // append to Out and Err files instead of truncating them
+
+	Tty bool // run under a pseudo-terminal, wired into Out; Err is ignored
+
+	Interactive bool // stdin stays open, to be written by attached clients; see CmdAttach
+
+	Detached bool // run in its own session and leave running when the server exits; see CmdAdopt
+
+	Host    string   // if set, Path runs on this host, through ssh
+	SshArgs []string // additional ssh options, used with Host
+
+	// confinement; not supported with Host, nor with Image, except for Mounts, which become container volumes
+	Chroot string  // root directory of the process; Path and Dir are resolved inside it
+	Mounts []Mount // bind mounts, visible only to the process
+
+	Unshare []string // new namespaces created for the process: pid, net, mount, ipc, uts
+
+	Capabilities *Capabilities // capability restrictions
+
+	Image   string // if set, Path runs inside a container of this image
+	Runtime string // container runtime command; defaults to podman or docker, whichever is found first
+
+	Triggers []Trigger // output line actions
+
+	Continuation string // regular expression matching lines that continue the previous output record
+
+	MaxLine Size // output lines longer than this are truncated, as soon as the server reads them; 0 means unlimited
+
+	LogFilter *LogFilter // drops unwanted output lines before they reach out and err
+	RateLimit *RateLimit // drops output lines past a rate, per stream, before they reach out and err
+
+	Syslog Syslog // options of "syslog" out and err sinks
+
+	SuccessCodes []int // exit codes considered successful; defaults to [0]
+
+	PreStart []Hook // executed before the process starts
+	PostStop []Hook // executed after the process exits
+
+	Retries      int      // number of times a failed process is run again before the route aborts
+	RetryBackoff Duration // delay before the first retry; doubles with each attempt
+
+	Delay Duration // wait before starting, after the previous proc
+
+	DependsOn []string // procs of the same route that must succeed or become ready first; enables concurrent execution
+
+	Ready *Probe // if set, the route proceeds to the next proc once it passes, while this one keeps running
+
+	HealthCheck *HealthCheck // liveness check while running; repeated failures interrupt the proc as failed
+
+	Instances int // copies run at once, named "name#N" from the second; enables scaling through CmdScale
+
+	Reload string // signal sent on restart instead of a full restart, when only Env changed; not supported with Host or Image
+
+	Watch []string // files or directories whose changes restart the process
+
+	Core *Core // core dump policy
+
+	Secrets    map[string]Secret // env values resolved by the server when starting the process
+	SecretPoll Duration          // interval at which secrets are re-resolved while running; the process is restarted on change, since its env cannot be updated in place
+}
+
+// InProc prefixes proc In values that name another proc of the same route, whose stdout is used as input.
+const InProc = "proc:"
+
+// An Output is a list of sinks a process stream is written to.
+// May be decoded from either a single string or a list.
+type Output []string
+
+func (x *Output) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		if s == "" {
+			*x = nil
+		} else {
+			*x = Output{s}
+		}
+		return nil
+	}
+
+	var l []string
+	if err := unmarshal(&l); err != nil {
+		return err
+	}
+	*x = l
+	return nil
+}
+
+// A Duration is a time.Duration decoded from a human-friendly string, such as "30s" or "5m".
+// Negative durations are invalid.
+type Duration time.Duration
+
+func (x *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return x.parse(s)
+}
+
+func (x Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(x).String(), nil
+}
+
+func (x *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return x.parse(s)
+}
+
+func (x Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(x).String())
+}
+
+func (x *Duration) parse(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %w", s, err)
+	}
+	if d < 0 {
+		return fmt.Errorf("invalid duration %q: must not be negative", s)
+	}
+	*x = Duration(d)
+	return nil
+}
+
+// A Size is a byte count decoded from either a plain number or a human-friendly string, such as "64KB" or "100MB".
+// Units are powers of 1024. Negative sizes are invalid.
+type Size int64
+
+var sizeUnits = []struct {
+	suffix string
+	n      int64
+}{
+	// longer suffixes first, so they take precedence
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"KB", 1 << 10},
+	{"MB", 1 << 20},
+	{"GB", 1 << 30},
+	{"K", 1 << 10},
+	{"M", 1 << 20},
+	{"G", 1 << 30},
+	{"B", 1},
+}
+
+func (x *Size) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	n, err := ParseSize(s)
+	if err != nil {
+		return err
+	}
+	*x = n
+	return nil
+}
+
+// ParseSize parses a size in the format accepted by Size attributes.
+func ParseSize(s string) (Size, error) {
+	orig := s
+	s = strings.TrimSpace(s)
+	mul := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(strings.ToUpper(s), strings.ToUpper(u.suffix)) {
+			s = strings.TrimSpace(s[:len(s)-len(u.suffix)])
+			mul = u.n
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", orig)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("invalid size %q: must not be negative", orig)
+	}
+	return Size(n * mul), nil
+}
+
+// A Syslog configures the forwarding of process output to the local syslog daemon.
+// Stdout lines are logged with info severity, stderr lines with error severity.
+type Syslog struct {
+	Facility string // defaults to "user"
+	Tag      string // defaults to "route.proc"
+}
+
+// A RateLimit bounds the output rate of each process stream.
+// Lines past the rate are dropped, and their number is reported once the next second starts.
+type RateLimit struct {
+	Lines int  // lines per second; 0 means unlimited
+	Bytes Size // bytes per second; 0 means unlimited
+}
+
+// A LogFilter drops unwanted lines of process output.
+// Lines that continue a record, as defined by Proc.Continuation, share the fate of its first line.
+// Lines are only ever kept or dropped; they are not rewritten, so a filter cannot downgrade the level of a line.
+type LogFilter struct {
+	Drop  []string // regular expressions; matching lines are dropped
+	Level string   // minimum level of kept lines: trace, debug, info, warn, error or fatal; lines without a detectable level are kept
+
+	CollapseRepeats bool // identical consecutive lines are replaced by "last message repeated N times"
+}
+
+// A Trigger fires an action when a line of process output matches a regular expression.
+type Trigger struct {
+	Match  string   // regular expression
+	Stream string   // "out", "err", or empty for both
+	Action string   // "ready", "restart", "notify" or "exec"
+	Cmd    []string // command to execute for the "exec" action
+}
+
+// A Hook is a command executed synchronously around a process or route.
+type Hook struct {
+	Cmd   []string // command and arguments
+	Fatal bool     // failure aborts the route, instead of only being reported
+}
+
+// A Core defines the core dump policy of a process.
+type Core struct {
+	Limit *Size  // maximum core size; nil means unlimited, 0 disables dumps
+	Dir   string // directory core dumps are moved into
+}
+
+// Capabilities restrict the Linux capabilities available to a process.
+type Capabilities struct {
+	Keep []string // if set, all other capabilities are dropped
+	Drop []string
+}
+
+// A Mount is a bind mount of a host path into the filesystem view of a process.
+type Mount struct {
+	Source   string // host path
+	Target   string // mount point, relative to the process root
+	ReadOnly bool
+}
+
+// A HealthCheck periodically verifies that a running process still works, beyond being alive.
+// Exactly one of Cmd, Tcp and Http should be set.
+type HealthCheck struct {
+	Cmd  []string // command that exits successfully, run with the proc env and dir
+	Tcp  string   // address accepting connections
+	Http string   // URL responding with a non-error status
+
+	Interval Duration // time between checks; defaults to 10s
+	Timeout  Duration // maximum duration of a check; defaults to the interval
+	Failures int      // consecutive failed checks after which the proc is interrupted; defaults to 3
+}
+
+// A Probe defines a readiness check of a running process.
+// Exactly one of the check members should be set.
+type Probe struct {
+	Tcp  string // address accepting connections
+	Http string // URL responding with a non-error status
+	File string // path that exists
+	Log  string // regular expression matching an output line
+
+	Interval Duration // time between checks; defaults to 1s
+	Timeout  Duration // maximum wait before the process is considered failed; 0 means unlimited
+}
+
+// A Secret defines the source of a sensitive env value.
+// Exactly one of the members should be set.
+type Secret struct {
+	File string   // read from file
+	Cmd  []string // stdout of command
+}
+
+// resolvePaths makes Path and Dir independent of the working directory of the program that runs the proc.
+// A relative Dir is resolved against base. A relative Path is resolved against Dir, or base if Dir is not set.
+// A Path without separators is looked up in PATH, and left unchanged if not found.
+// Procs whose paths are interpreted elsewhere (remote host, container or chroot) are left untouched.
+func (x *Proc) resolvePaths(base string) {
+	if x.Host != "" || x.Image != "" || x.Chroot != "" {
+		return
+	}
+
+	if x.Dir != "" && !filepath.IsAbs(x.Dir) {
+		x.Dir = filepath.Join(base, x.Dir)
+	}
+
+	switch {
+	case x.Path == "" || filepath.IsAbs(x.Path):
+	case !strings.ContainsRune(x.Path, '/') && !strings.ContainsRune(x.Path, filepath.Separator):
+		if path, err := exec.LookPath(x.Path); err == nil {
+			x.Path, _ = filepath.Abs(path)
+		}
+	case x.Dir != "":
+		x.Path = filepath.Join(x.Dir, x.Path)
+	default:
+		x.Path = filepath.Join(base, x.Path)
+	}
+}
+
+// interpret applies x.Var to the other members.
+// Literal procs are left as they are, except for their raw section markers, which are removed from all members.
+// Inherited env values must already be interpreted.
+func (x *Proc) interpret() error {
+	strip := func(s *string) error {
+		*s = stripRaw(*s)
+		return nil
+	}
+
+	if x.Literal {
+		for k, v := range x.Env {
+			x.Env[k] = stripRaw(v)
+		}
+		if err := x.interpreted(strip); err != nil {
+			return err
+		}
+	} else {
+		if err := x.interpreted(func(s *string) error { return interpret(s, x.Var) }); err != nil {
+			return err
+		}
+	}
+
+	return x.uninterpreted(strip)
+}
+
+// interpreted calls f on each member subject to var interpretation.
+func (x *Proc) interpreted(f func(*string) error) error {
+	fields := []*string{&x.Name, &x.Path, &x.Dir, &x.InText, &x.Umask, &x.Image, &x.Host, &x.Chroot, &x.Continuation}
+	for _, s := range [][]string{x.Args, x.Out, x.Err, x.Watch, x.SshArgs} {
+		for i := range s {
+			fields = append(fields, &s[i])
+		}
+	}
+	if x.Core != nil {
+		fields = append(fields, &x.Core.Dir)
+	}
+	for i := range x.Mounts {
+		fields = append(fields, &x.Mounts[i].Source, &x.Mounts[i].Target)
+	}
+	for _, hooks := range [][]Hook{x.PreStart, x.PostStop} {
+		for _, h := range hooks {
+			for i := range h.Cmd {
+				fields = append(fields, &h.Cmd[i])
+			}
+		}
+	}
+	for i := range x.Triggers {
+		t := &x.Triggers[i]
+		fields = append(fields, &t.Match)
+		for j := range t.Cmd {
+			fields = append(fields, &t.Cmd[j])
+		}
+	}
+	if x.Ready != nil {
+		fields = append(fields, &x.Ready.Tcp, &x.Ready.Http, &x.Ready.File, &x.Ready.Log)
+	}
+	if x.HealthCheck != nil {
+		fields = append(fields, &x.HealthCheck.Tcp, &x.HealthCheck.Http)
+		for i := range x.HealthCheck.Cmd {
+			fields = append(fields, &x.HealthCheck.Cmd[i])
+		}
+	}
+	for _, s := range fields {
+		if err := f(s); err != nil {
+			return err
+		}
+	}
+
+	// map values are not addressable
+	for k, s := range x.Secrets {
+		if err := f(&s.File); err != nil {
+			return err
+		}
+		for i := range s.Cmd {
+			if err := f(&s.Cmd[i]); err != nil {
+				return err
+			}
+		}
+		x.Secrets[k] = s
+	}
+
+	return nil
+}
+
+// uninterpreted calls f on each string member that is not subject to var interpretation, except for Var and Env.
+func (x *Proc) uninterpreted(f func(*string) error) error {
+	fields := []*string{&x.In, &x.Runtime, &x.Reload, &x.Syslog.Facility, &x.Syslog.Tag}
+	for _, s := range [][]string{x.EnvPass, x.Unshare, x.DependsOn} {
+		for i := range s {
+			fields = append(fields, &s[i])
+		}
+	}
+	for i := range x.Triggers {
+		fields = append(fields, &x.Triggers[i].Stream, &x.Triggers[i].Action)
+	}
+	if x.Capabilities != nil {
+		for _, s := range [][]string{x.Capabilities.Keep, x.Capabilities.Drop} {
+			for i := range s {
+				fields = append(fields, &s[i])
+			}
+		}
+	}
+	if x.LogFilter != nil {
+		fields = append(fields, &x.LogFilter.Level)
+		for i := range x.LogFilter.Drop {
+			fields = append(fields, &x.LogFilter.Drop[i])
+		}
+	}
+	for _, s := range fields {
+		if err := f(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A Notify describes how the end of a route is announced.
+// Both the command and the URL receive the details of the last run as a JSON object.
+type Notify struct {
+	Cmd []string // command receiving the details on stdin
+	Url string   // URL receiving the details as a POST body
+	On  []string // outcomes that are announced, e.g. "failed"; all by default
 }
 
-func (x *Fmt) Write(b []byte) (int, error) {
-	x.mux.Lock()
-	defer x.mux.Unlock()
-	return x.dst.Write(b)
+// checkOutput returns an error if the special "out" value is misused.
+// Stderr can only be merged into stdout as a whole, so "out" must be the only Err value, and is meaningless for Out.
+func (x *Proc) checkOutput() error {
+	for _, s := range x.Out {
+		if s == "out" {
+			return errors.New("out may not be \"out\"")
+		}
+	}
+	if len(x.Err) > 1 {
+		for _, s := range x.Err {
+			if s == "out" {
+				return errors.New("err \"out\" may not be combined with other values")
+			}
+		}
+	}
+	return nil
 }
 
-func (x *Fmt) Print(a ...interface{}) (n int, err error) {
-	x.mux.Lock()
-	defer x.mux.Unlock()
-	return x.dst.Write([]byte(fmt.Sprint(a...)))
+// checkReload returns an error if a reload signal would not reach the process.
+// Remote and container procs only run a local ssh or container runtime client, which a signal would stop instead.
+func (x *Proc) checkReload() error {
+	if x.Reload != "" && (x.Host != "" || x.Image != "") {
+		return errors.New("not supported with host or image")
+	}
+	return nil
 }
 
-func (x *Fmt) Println(a ...interface{}) (n int, err error) {
-	x.mux.Lock()
-	defer x.mux.Unlock()
-	return x.dst.Write([]byte(fmt.Sprintln(a...)))
+// validOutcome returns true if s describes how a route run may end: tasks finish or fail, services exit, fail or are stopped.
+func validOutcome(s string) bool {
+	switch s {
+	case "finished", "failed", "exited", "stopped":
+		return true
+	}
+	return false
 }
 
-var (
-	Stdout *Fmt = NewFmt(os.Stdout)
-	Stderr *Fmt = NewFmt(os.Stderr)
-)
-
-type CmdSwitch string
-
-const (
-	CmdCancel  CmdSwitch = "-c" // cancel client command; not for end users
-	CmdExit              = "-e" // shut down dedicated server
-	CmdGlobal            = "-g" // global switch; only valid as a command line arg
-	CmdKill              = "-k" // kill routes
-	CmdList              = "-l" // list active routes
-	CmdMeta              = "-m" // generate config from template and meta
-	CmdPrint             = "-p" // print config routes
-	CmdRestart           = "-r" // restart routes
-	CmdRun               = ""   // run routes
-	CmdServer            = "-s" // run as dedicated server
-)
+// A WaitFor is an external condition that a route waits for before its first proc starts.
+// Exactly one of the check members should be set.
+type WaitFor struct {
+	Tcp  string // address accepting connections
+	Http string // URL responding with a 2xx status
+	Path string // path that exists
 
-var switchMap = map[CmdSwitch]struct{}{
-	CmdCancel:  struct{}{},
-	CmdExit:    struct{}{},
-	CmdGlobal:  struct{}{},
-	CmdKill:    struct{}{},
-	CmdList:    struct{}{},
-	CmdMeta:    struct{}{},
-	CmdPrint:   struct{}{},
-	CmdRestart: struct{}{},
-	CmdServer:  struct{}{},
+	Interval Duration // time between checks; defaults to 1s
+	Timeout  Duration // time after which the run fails; unlimited by default
 }
 
-// isNotRun returns true if the argument is one of the defined command switches.
-func isNotRun(s string) bool {
-	sw := CmdSwitch(s)
-	_, ok := switchMap[sw]
-	return ok
+// A Route holds information relevant to a single execution route.
+type Route struct {
+	Default      bool      // will run on no-argument forms
+	Namespace    string    // route-scope namespace
+	Umask        string    // route-scope umask
+	Deprecated   string    // warning printed when the route is run
+	Tags         []string  // labels that select the route on the command line, through OptTag
+	Kind         string    // "service" or "task"; services are expected to run until stopped, tasks to finish; defaults to task
+	InheritEnv   *bool     // route-scope env inheritance
+	EnvPass      []string  // route-scope env passthrough
+	PreStart     []Hook    // executed before the first proc
+	PostStop     []Hook    // executed after the route stops
+	OnFailure    []Hook    // executed after a failed run, with the failing proc and error in env
+	Notify       *Notify   // announces the end of the route
+	Cleanup      []Proc    // executed in order after the route stops, even if killed
+	Parallel     bool      // start all procs concurrently, instead of in order
+	DependsOn    []string  // routes that must be ready before this one starts; started along with it if needed
+	WaitFor      []WaitFor // external conditions that must hold before each run starts
+	Params       []string  // vars that may be set on the command line as "name=value"; those without a route var are required
+	Queue        bool      // a run of the route while it is active waits for it to terminate, instead of failing
+	MaxInstances int       // runs of the route that may be active at once, as numbered instances; defaults to 1
+	Priority     int       // routes run together start in order of decreasing priority, then name
+
+	Restart        string   // "on-failure" or "always"; runs the route again once it stops, unless killed
+	RestartMax     int      // consecutive failed runs restarted; 0 means unlimited
+	RestartBackoff Duration // delay before the first restart; doubles with each consecutive failure
+
+	Schedule string            // cron expression; a dedicated server runs the route when it matches
+	Every    Duration          // a dedicated server runs the route at this interval
+	Jitter   Duration          // random delay, up to this, added to each interval run
+	Overlap  string            // "skip" or "queue": periodic runs of a route that is still active; defaults to skip
+	Var      map[string]string // route-scope var
+	Env      map[string]string // route-scope env
+	Procs    []Proc            // process configurations
 }
 
-// A Proc holds the information necessary to execute a process.
-type Proc struct {
-	Var  map[string]string
-	Env  map[string]string
-	Name string
-	Path string
-	Dir  string
-	Args []string
-	In   string
-	Out  string
-	Err  string
+// HasTags returns true if the route carries all the given tags.
+func (x Route) HasTags(tags []string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, t := range x.Tags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
 }
 
-// interpret applies x.Var to the other members.
-func (x *Proc) interpret() error {
-	if err := interpretMap(x.Env, x.Var); err != nil {
-		return err
-	}
-	if err := interpretSlice(x.Args, x.Var); err != nil {
-		return err
-	}
-	if err := interpret(&x.Name, x.Var); err != nil {
-		return err
+// applyParams sets the given parameters as route vars, overriding any defined ones.
+// Parameters must be declared by the route. When running the route, required parameters must be given.
+func (x *Route) applyParams(params map[string]string) error {
+	declared := make(map[string]struct{}, len(x.Params))
+	for _, name := range x.Params {
+		declared[name] = struct{}{}
 	}
-	if err := interpret(&x.Path, x.Var); err != nil {
-		return err
+	for name := range params {
+		if _, ok := declared[name]; !ok {
+			return errors.New("undeclared parameter " + name)
+		}
 	}
-	if err := interpret(&x.Dir, x.Var); err != nil {
-		return err
+
+	switch ArgSwitch {
+	case CmdRun, CmdRestart, CmdSimulate:
+		for _, name := range x.Params {
+			_, given := params[name]
+			_, defined := x.Var[name]
+			if !given && !defined {
+				return errors.New("missing parameter " + name)
+			}
+		}
 	}
-	if err := interpret(&x.Out, x.Var); err != nil {
-		return err
+
+	if len(params) > 0 && x.Var == nil {
+		x.Var = make(map[string]string)
 	}
-	if err := interpret(&x.Err, x.Var); err != nil {
-		return err
+	for name, v := range params {
+		x.Var[name] = v
 	}
-
 	return nil
 }
 
-// A Route holds information relevant to a single execution route.
-type Route struct {
-	Default   bool              // will run on no-argument forms
-	Namespace string            // route-scope namespace
-	Var       map[string]string // route-scope var
-	Env       map[string]string // route-scope env
-	Procs     []Proc            // process configurations
-}
-
 // A Manifest holds routes and their individual process configs.
 type Manifest struct {
-	Namespace string
-	Var       map[string]string
-	Env       map[string]string
-	Routes    map[string]Route
+	Namespace  string
+	InheritEnv *bool
+	EnvPass    []string
+	Var        map[string]string
+	Env        map[string]string
+	Routes     map[string]Route
+	Groups     map[string][]string // route lists that may be targeted by name, like routes
+	LogDir     string              // if set, procs without out or err write to "LogDir/route/proc.out" and ".err"
 }
 
 func MakeManifest() Manifest {
@@ -260,11 +1368,25 @@ func MakeManifest() Manifest {
 
 // Cmd represents an op program command
 type Cmd struct {
-	Sw        CmdSwitch        // command switch
-	Namespace string           // target namespace
-	Route     string           // target route
-	Proc      string           // target proc
-	Config    map[string]Route // manifest to use for command; may be nil for commands that don't need it
+	Sw        CmdSwitch           // command switch
+	Namespace string              // target namespace
+	Route     string              // target route
+	Instance  string              // target route instance; empty for the main one
+	Proc      string              // target proc
+	Config    map[string]Route    // manifest to use for command; may be nil for commands that don't need it
+	Groups    map[string][]string // manifest route groups; Route may name one of them
+	Stdin     bool                // client stdin will be forwarded through CmdInput commands
+	Count     int                 // CmdScale instance count
+	From      string              // target proc to start the route from; earlier procs are skipped
+	Signal    string              // CmdKill signal sent to the target procs instead of killing them
+	Follow    bool                // CmdLogs keeps streaming the output of the target route while it runs
+	Json      bool                // CmdList writes a JSON array of RouteStatus instead of text
+	Watch     bool                // CmdList lists again on every route state change, until canceled
+	Timeout   time.Duration       // CmdWait stops waiting after this long; 0 means unlimited
+	Color     bool                // client output is a terminal; proc output prefixes are colored
+	Quiet     bool                // op's own messages are discarded, leaving only process output
+	Messages  string              // absolute path of a file op's own messages are appended to, instead of being written to the client stderr
+	Data      []byte              // CmdInput payload; empty signals EOF
 }
 
 type Meta struct {
@@ -306,43 +1428,68 @@ func UpdateMeta(m Meta) error {
 // If the OP_TEMPLATE env is set, reads the template from there instead.
 // See DecodeMeta for meta specifications.
 func ExecuteTemplate(variant string) error {
-	m, err := DecodeMeta()
+	m, b, err := renderTemplate(variant)
 	if err != nil {
 		return err
 	}
 
+	if err := os.WriteFile(ConfigPath, b, 0666); err != nil {
+		return err
+	}
+
+	m.Active = variant
+	UpdateMeta(m)
+
+	return nil
+}
+
+// DecodeVariant returns the manifest that ExecuteTemplate would generate for the given variant, without writing it.
+func DecodeVariant(variant string) (Manifest, error) {
+	_, b, err := renderTemplate(variant)
+	if err != nil {
+		return Manifest{}, err
+	}
+	return decodeConfig(b)
+}
+
+// renderTemplate applies the specified variant to the template.
+// Also returns the working meta.
+func renderTemplate(variant string) (Meta, []byte, error) {
+	m, err := DecodeMeta()
+	if err != nil {
+		return m, nil, err
+	}
+
 	// check if desired variant actually exists
 	vr, ok := m.Variants[variant]
 	if !ok {
-		return errors.New("variant not defined")
+		return m, nil, errors.New("variant not defined")
 	}
 
 	b, err := os.ReadFile(TemplatePath)
 	if err != nil {
-		return err
+		return m, nil, err
 	}
 
 	tmpl := template.New("test")
 	if _, err := tmpl.Parse(string(b)); err != nil {
-		return err
-	}
-
-	f, err := os.Create(ConfigPath)
-	if err != nil {
-		return err
+		return m, nil, err
 	}
-	defer f.Close()
 
-	if err := tmpl.Execute(f, vr); err != nil {
-		return err
+	w := &bytes.Buffer{}
+	if err := tmpl.Execute(w, vr); err != nil {
+		return m, nil, err
 	}
 
-	m.Active = variant
-	UpdateMeta(m)
-
-	return nil
+	return m, w.Bytes(), nil
 }
 
+// Raw section markers; text between them is exempt from env expansion and var interpretation.
+var (
+	rawOpen  = []byte("{{raw}}")
+	rawClose = []byte("{{/raw}}")
+)
+
 // expandEnv replaces env markers in the input text with their corresponding env values.
 //
 // env marker: ${NAME}
@@ -352,6 +1499,15 @@ func expandEnv(b []byte) []byte {
 	var last byte
 	var i int // bytes copied from b
 	for j := 0; j < len(b); j++ {
+		// skip raw sections
+		if bytes.HasPrefix(b[j:], rawOpen) {
+			if k := bytes.Index(b[j:], rawClose); k >= 0 {
+				j += k + len(rawClose) - 1
+				last = b[j]
+				continue
+			}
+		}
+
 		if b[j] == '$' {
 			// copy from what is missing
 			r = append(r, b[i:j]...)
@@ -380,8 +1536,16 @@ func expandEnv(b []byte) []byte {
 
 						// skip corresponding part of b0
 						j = jVar
+						i = j + 1
+						last = b[j]
+						continue
 					}
 				}
+
+				// not a marker; keep the $ as is
+				i = j
+				last = b[j]
+				continue
 			}
 
 			// update copy index
@@ -394,6 +1558,130 @@ func expandEnv(b []byte) []byte {
 	return r
 }
 
+// execInstances is the number of ad-hoc runs of the same program that may be active at once.
+const execInstances = 100
+
+// ExecManifest returns a manifest holding a single route that runs the ad-hoc command given as argument through "sh -c", along with the route name.
+// The route is named after the command's program, e.g. "exec:make", and takes the namespace of the manifest at config path, if there is one, so that it may be listed and killed alongside its routes.
+// The command runs in the working directory of the caller, unless a directory option is given.
+// A command given after "--" runs in the context of a manifest route instead; see contextManifest.
+func ExecManifest() (Manifest, string, error) {
+	if len(ArgCommand) > 0 {
+		return contextManifest()
+	}
+
+	fields := strings.Fields(ArgMajor)
+	if len(fields) == 0 {
+		return Manifest{}, "", errors.New("missing command")
+	}
+	if ArgMinor != "" || len(ArgParams) > 0 {
+		return Manifest{}, "", errors.New("too many arguments; the command must be quoted as a single argument")
+	}
+
+	dir, err := filepath.Abs(ArgDir)
+	if err != nil {
+		return Manifest{}, "", err
+	}
+
+	x := MakeManifest()
+	x.Namespace = "default"
+	if ArgNamespace != "" {
+		x.Namespace = ArgNamespace
+	} else if manifest, err := DecodeConfig(); err == nil && manifest.Namespace != "" {
+		x.Namespace = manifest.Namespace
+	}
+
+	prog := strings.NewReplacer("|", "_", "#", "_").Replace(filepath.Base(fields[0]))
+	name := "exec:" + prog
+	x.Routes[name] = Route{
+		Namespace:    x.Namespace,
+		MaxInstances: execInstances,
+		Procs: []Proc{{
+			Name: prog,
+			Path: "sh",
+			Dir:  dir,
+			Args: []string{"-c", ArgMajor},
+			Env:  ArgEnv,
+			Out:  Output{"std"},
+			Err:  Output{"std"},
+		}},
+	}
+	return x, name, nil
+}
+
+// contextManifest returns a manifest holding a single route that runs the command given after "--" in the context of a proc of the route given as argument,
+// along with the route name.
+// The proc is the one given as second argument, or the first one of the route.
+// The command gets its resolved env, secrets, directory, umask, host, container and confinement, but none of its output processing, probes or hooks.
+// The route is named after the target route, e.g. "exec:api", in its namespace.
+func contextManifest() (Manifest, string, error) {
+	if ArgMajor == "" {
+		return Manifest{}, "", errors.New("a command in the context of a route requires a route")
+	}
+	manifest, err := DecodeConfig()
+	if err != nil {
+		return Manifest{}, "", err
+	}
+	rt, ok := manifest.Routes[ArgMajor]
+	if !ok {
+		return Manifest{}, "", errors.New("route " + ArgMajor + " not defined")
+	}
+	if len(rt.Procs) == 0 {
+		return Manifest{}, "", errors.New("route " + ArgMajor + " has no procs")
+	}
+	p := rt.Procs[0]
+	if ArgMinor != "" {
+		found := false
+		for _, proc := range rt.Procs {
+			if proc.Name == ArgMinor {
+				p, found = proc, true
+				break
+			}
+		}
+		if !found {
+			return Manifest{}, "", errors.New("proc " + ArgMinor + " not defined")
+		}
+	}
+
+	dir := p.Dir
+	if ArgDir != "" {
+		if dir, err = filepath.Abs(ArgDir); err != nil {
+			return Manifest{}, "", err
+		}
+	}
+
+	x := MakeManifest()
+	x.Namespace = manifest.Namespace
+	prog := strings.NewReplacer("|", "_", "#", "_").Replace(filepath.Base(ArgCommand[0]))
+	name := "exec:" + ArgMajor
+	x.Routes[name] = Route{
+		Namespace:    rt.Namespace,
+		MaxInstances: execInstances,
+		Procs: []Proc{{
+			Name:         prog,
+			Path:         ArgCommand[0],
+			Args:         ArgCommand[1:],
+			Dir:          dir,
+			Env:          merge(merge(nil, ArgEnv), p.Env),
+			InheritEnv:   p.InheritEnv,
+			EnvPass:      p.EnvPass,
+			Umask:        p.Umask,
+			Host:         p.Host,
+			SshArgs:      p.SshArgs,
+			Chroot:       p.Chroot,
+			Mounts:       p.Mounts,
+			Unshare:      p.Unshare,
+			Capabilities: p.Capabilities,
+			Image:        p.Image,
+			Runtime:      p.Runtime,
+			Secrets:      p.Secrets,
+			Out:          Output{"std"},
+			Err:          Output{"std"},
+		}},
+	}
+	return x, name, nil
+}
+
 // DecodeConfig returns the manifest found at config path ("op.yaml" by default).
 func DecodeConfig() (Manifest, error) {
 	// read manifest
@@ -402,6 +1690,55 @@ func DecodeConfig() (Manifest, error) {
 		return Manifest{}, fmt.Errorf("config open error: %w", err)
 	}
 
+	return decodeConfig(b0)
+}
+
+// restoreLiteral replaces the literal procs of x with their declarations in the unexpanded config b0, so that they keep their env markers.
+func restoreLiteral(x *Manifest, b0 []byte) error {
+	var raw struct {
+		Routes map[string]struct {
+			Procs   []interface{}
+			Cleanup []interface{}
+		}
+	}
+	decoded := false
+	for rt, route := range x.Routes {
+		for k, procs := range [][]Proc{route.Procs, route.Cleanup} {
+			for p := range procs {
+				if !procs[p].Literal {
+					continue
+				}
+				if !decoded {
+					if err := yaml.Unmarshal(b0, &raw); err != nil {
+						return fmt.Errorf("config parse error: %w", err)
+					}
+					decoded = true
+				}
+
+				nodes := raw.Routes[rt].Procs
+				if k == 1 {
+					nodes = raw.Routes[rt].Cleanup
+				}
+				if len(nodes) != len(procs) {
+					return errors.New(rt + " literal proc error: env expansion changes the proc list")
+				}
+				b, err := yaml.Marshal(nodes[p])
+				if err != nil {
+					return err
+				}
+				proc := Proc{}
+				if err := yaml.Unmarshal(b, &proc); err != nil {
+					return fmt.Errorf("%s literal proc error: %w", rt, err)
+				}
+				procs[p] = proc
+			}
+		}
+	}
+	return nil
+}
+
+// decodeConfig returns the manifest defined by the given raw config.
+func decodeConfig(b0 []byte) (Manifest, error) {
 	b := expandEnv(b0)
 
 	// decode manifest
@@ -409,45 +1746,182 @@ func DecodeConfig() (Manifest, error) {
 	if err := yaml.Unmarshal(b, &x); err != nil {
 		return Manifest{}, fmt.Errorf("config parse error: %w", err)
 	}
+	if err := restoreLiteral(&x, b0); err != nil {
+		return Manifest{}, err
+	}
+	if ArgNamespace != "" {
+		x.Namespace = ArgNamespace
+	}
+
+	// relative proc paths are resolved against the manifest directory
+	base, err := filepath.Abs(filepath.Dir(ConfigPath))
+	if err != nil {
+		return Manifest{}, err
+	}
 
 	// apply vars in top level fields
 	if err := interpretMap(x.Env, x.Var); err != nil {
 		return Manifest{}, err
 	}
+	if err := interpret(&x.LogDir, x.Var); err != nil {
+		return Manifest{}, err
+	}
+	if x.LogDir != "" && !filepath.IsAbs(x.LogDir) {
+		x.LogDir = filepath.Join(base, x.LogDir)
+	}
 
 	// roll out scope declarations from top to bottom
 	// bottom has priority
+	// each env value is interpreted in its declaring scope only
+	if _, ok := x.Routes[ArgMajor]; len(ArgParams) > 0 && !ok {
+		return Manifest{}, errors.New("parameters require a single target route")
+	}
 	for rt, route := range x.Routes {
+		if rt == ArgMajor {
+			if err := route.applyParams(ArgParams); err != nil {
+				return Manifest{}, fmt.Errorf("%s param error: %w", rt, err)
+			}
+		}
 		route.Var = merge(route.Var, x.Var)
 
-		route.Env = merge(route.Env, x.Env)
 		if err := interpretMap(route.Env, route.Var); err != nil {
 			return Manifest{}, err
 		}
+		route.Env = merge(route.Env, x.Env)
 
 		if route.Namespace == "" {
 			route.Namespace = x.Namespace
 		}
+		if route.InheritEnv == nil {
+			route.InheritEnv = x.InheritEnv
+		}
+		if route.EnvPass == nil {
+			route.EnvPass = x.EnvPass
+		}
 		if err := interpret(&route.Namespace, route.Var); err != nil {
 			return Manifest{}, err
 		}
 		if route.Namespace == "" {
 			route.Namespace = "default"
 		}
-
-		for p, proc := range route.Procs {
-			proc.Var = merge(proc.Var, route.Var)
-			proc.Env = merge(proc.Env, route.Env)
-			if err := proc.interpret(); err != nil {
+		if err := interpret(&route.Deprecated, route.Var); err != nil {
+			return Manifest{}, err
+		}
+		if err := interpretHooks(route.PreStart, route.Var); err != nil {
+			return Manifest{}, err
+		}
+		if err := interpretHooks(route.PostStop, route.Var); err != nil {
+			return Manifest{}, err
+		}
+		if err := interpretHooks(route.OnFailure, route.Var); err != nil {
+			return Manifest{}, err
+		}
+		if route.Notify != nil {
+			if err := interpretSlice(route.Notify.Cmd, route.Var); err != nil {
+				return Manifest{}, err
+			}
+			if err := interpret(&route.Notify.Url, route.Var); err != nil {
 				return Manifest{}, err
 			}
+			for _, s := range route.Notify.On {
+				if !validOutcome(s) {
+					return Manifest{}, errors.New(rt + " notify error: unknown outcome " + strconv.Quote(s))
+				}
+			}
+		}
+
+		for i := range route.WaitFor {
+			w := &route.WaitFor[i]
+			for _, s := range []*string{&w.Tcp, &w.Http, &w.Path} {
+				if err := interpret(s, route.Var); err != nil {
+					return Manifest{}, err
+				}
+			}
+		}
+
+		for k, procs := range [][]Proc{route.Procs, route.Cleanup} {
+			for p, proc := range procs {
+				proc.Var = merge(proc.Var, route.Var)
+				if !proc.Literal {
+					if err := interpretMap(proc.Env, proc.Var); err != nil {
+						return Manifest{}, err
+					}
+				}
+				proc.Env = merge(proc.Env, route.Env)
+				if proc.Umask == "" {
+					proc.Umask = route.Umask
+				}
+				if proc.InheritEnv == nil {
+					proc.InheritEnv = route.InheritEnv
+				}
+				if proc.EnvPass == nil {
+					proc.EnvPass = route.EnvPass
+				}
+				if err := proc.interpret(); err != nil {
+					return Manifest{}, err
+				}
+				name := proc.Name
+				if name == "" {
+					name = strconv.Itoa(p)
+					if k == 1 {
+						name = "cleanup" + name
+					}
+				}
+				if err := proc.checkOutput(); err != nil {
+					return Manifest{}, errors.New(rt + "|" + name + " output error: " + err.Error())
+				}
+				if err := proc.checkReload(); err != nil {
+					return Manifest{}, errors.New(rt + "|" + name + " reload error: " + err.Error())
+				}
+				proc.resolvePaths(base)
+
+				// default log files, named like the server names procs
+				if x.LogDir != "" {
+					prefix := filepath.Join(x.LogDir, rt, name)
+					if len(proc.Out) == 0 {
+						proc.Out = Output{prefix + ".out"}
+					}
+					if len(proc.Err) == 0 {
+						proc.Err = Output{prefix + ".err"}
+					}
+				}
 
-			route.Procs[p] = proc
+				procs[p] = proc
+			}
 		}
 
 		x.Routes[rt] = route
 	}
 
+	for name, members := range x.Groups {
+		if _, ok := x.Routes[name]; ok {
+			return Manifest{}, errors.New("group " + name + ": name already used by a route")
+		}
+		for _, member := range members {
+			if _, ok := x.Routes[member]; !ok {
+				return Manifest{}, errors.New("group " + name + ": route " + member + " not defined")
+			}
+		}
+	}
+
+	// a tag selection is targeted as a group of the routes carrying the tags
+	if len(ArgTags) > 0 {
+		var members []string
+		for name, route := range x.Routes {
+			if route.HasTags(ArgTags) {
+				members = append(members, name)
+			}
+		}
+		if len(members) == 0 {
+			return Manifest{}, errors.New("no route tagged " + strings.Join(ArgTags, " and "))
+		}
+		sort.Strings(members)
+		if x.Groups == nil {
+			x.Groups = make(map[string][]string)
+		}
+		x.Groups[TagTarget+strings.Join(ArgTags, ",")] = members
+	}
+
 	return x, nil
 }
 
@@ -461,6 +1935,15 @@ func interpretMap(s map[string]string, m map[string]string) error {
 	return nil
 }
 
+func interpretHooks(s []Hook, m map[string]string) error {
+	for i := range s {
+		if err := interpretSlice(s[i].Cmd, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func interpretSlice(s []string, m map[string]string) error {
 	for i := range s {
 		if err := interpret(&s[i], m); err != nil {
@@ -471,21 +1954,68 @@ func interpretSlice(s []string, m map[string]string) error {
 }
 
 // interpret parses the string s points to as a template, and replaces it with the result of executing this template on m.
+// Raw sections are copied as they are, without their markers.
 func interpret(s *string, m map[string]string) error {
-	tmpl, err := template.New("").Parse(*s)
-	if err != nil {
-		return err
-	}
-
 	b := &strings.Builder{}
-	if err := tmpl.Execute(b, m); err != nil {
-		return err
+	rest := *s
+	for {
+		i := strings.Index(rest, string(rawOpen))
+		seg := rest
+		if i >= 0 {
+			seg = rest[:i]
+		}
+
+		tmpl, err := template.New("").Parse(seg)
+		if err != nil {
+			return err
+		}
+		if err := tmpl.Execute(b, m); err != nil {
+			return err
+		}
+
+		if i < 0 {
+			break
+		}
+		rest = rest[i+len(rawOpen):]
+
+		// an unterminated raw section extends to the end
+		j := strings.Index(rest, string(rawClose))
+		if j < 0 {
+			b.WriteString(rest)
+			break
+		}
+		b.WriteString(rest[:j])
+		rest = rest[j+len(rawClose):]
 	}
 	*s = b.String()
 
 	return nil
 }
 
+// stripRaw returns s without its raw section markers.
+func stripRaw(s string) string {
+	b := &strings.Builder{}
+	for {
+		i := strings.Index(s, string(rawOpen))
+		if i < 0 {
+			b.WriteString(s)
+			break
+		}
+		b.WriteString(s[:i])
+		s = s[i+len(rawOpen):]
+
+		// an unterminated raw section extends to the end
+		j := strings.Index(s, string(rawClose))
+		if j < 0 {
+			b.WriteString(s)
+			break
+		}
+		b.WriteString(s[:j])
+		s = s[j+len(rawClose):]
+	}
+	return b.String()
+}
+
 // merge copies the keys from src into dst. Keys that already exist in dst preserve their value.
 // Returns the resulting map (useful when dst is nil).
 func merge(dst map[string]string, src map[string]string) map[string]string {
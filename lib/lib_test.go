@@ -0,0 +1,190 @@
+package lib
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parsed holds the values checked by TestParseArgs.
+type parsed struct {
+	Switch  CmdSwitch
+	Major   string
+	Minor   string
+	Count   int
+	Stdin   bool
+	Signal  string
+	Params  map[string]string
+	Command []string
+}
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want parsed
+	}{
+		{nil, parsed{}},
+		{[]string{"route"}, parsed{Major: "route"}},
+		{[]string{"route", "proc"}, parsed{Major: "route", Minor: "proc"}},
+		{[]string{"-g", "-i", "route", "proc"}, parsed{Major: "route", Minor: "proc", Stdin: true}},
+		{[]string{"route", "-i", "proc"}, parsed{Major: "route", Minor: "proc", Stdin: true}},
+		{[]string{"-u", "route", "proc", "3"}, parsed{Switch: CmdScale, Major: "route", Minor: "proc", Count: 3}},
+		{[]string{"-x", "ls -l"}, parsed{Switch: CmdExec, Major: "ls -l"}},
+		{[]string{"-k", "route"}, parsed{Switch: CmdKill, Major: "route"}},
+		{[]string{"kill", "route"}, parsed{Switch: CmdKill, Major: "route"}},
+		{[]string{"run", "route", "proc"}, parsed{Major: "route", Minor: "proc"}},
+		{[]string{"scale", "route", "proc", "2"}, parsed{Switch: CmdScale, Major: "route", Minor: "proc", Count: 2}},
+		{[]string{"list"}, parsed{Switch: CmdList}},
+		{[]string{"route", "kill"}, parsed{Major: "route", Minor: "kill"}},
+		{[]string{"route", "a=1", "proc", "b=2"}, parsed{Major: "route", Minor: "proc", Params: map[string]string{"a": "1", "b": "2"}}},
+		{[]string{"--route", "route", "a=1"}, parsed{Major: "route", Params: map[string]string{"a": "1"}}},
+		{[]string{"exec", "--", "ls", "-l"}, parsed{Switch: CmdExec, Command: []string{"ls", "-l"}}},
+		{[]string{"exec", "route", "--", "ls", "--", "-i"}, parsed{Switch: CmdExec, Major: "route", Command: []string{"ls", "--", "-i"}}},
+		{[]string{"signal", "route.proc", "HUP"}, parsed{Switch: CmdKill, Major: "route", Minor: "proc", Signal: "HUP"}},
+		{[]string{"signal", "route", "proc", "HUP"}, parsed{Switch: CmdKill, Major: "route", Minor: "proc", Signal: "HUP"}},
+		{[]string{"signal", "route", "HUP", "a=1"}, parsed{Switch: CmdKill, Major: "route", Signal: "HUP", Params: map[string]string{"a": "1"}}},
+		{[]string{"-k", "route", "--signal", "TERM"}, parsed{Switch: CmdKill, Major: "route", Signal: "TERM"}},
+	}
+	for _, test := range tests {
+		x, err := parseArgs(test.args)
+		if err != nil {
+			t.Errorf("%q: %v", test.args, err)
+			continue
+		}
+		got := parsed{x.Switch, x.Major, x.Minor, x.Count, x.Stdin, x.Signal, x.Params, x.Command}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %+v, want %+v", test.args, got, test.want)
+		}
+	}
+}
+
+func TestParseArgsConfig(t *testing.T) {
+	t.Setenv("OP", "")
+	t.Setenv("OP_GLOBAL", "/global.yaml")
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"route"}, "op.yaml"},
+		{[]string{"-g", "route"}, "/global.yaml"},
+		{[]string{"--config", "other.yaml", "route"}, "other.yaml"},
+	}
+	for _, test := range tests {
+		x, err := parseArgs(test.args)
+		if err != nil {
+			t.Errorf("%q: %v", test.args, err)
+			continue
+		}
+		if x.Config != test.want {
+			t.Errorf("%q: got config %q, want %q", test.args, x.Config, test.want)
+		}
+	}
+}
+
+func TestParseArgsErrors(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-z"}, "flag provided but not defined"},
+		{[]string{"-k", "-k", "route"}, "repeated switch -k"},
+		{[]string{"-k", "-r", "route"}, "switches -k, -r cannot be combined"},
+		{[]string{"kill", "route", "-r"}, "cannot be combined"},
+		{[]string{"-g", "--config", "other.yaml", "route"}, "cannot be combined"},
+		{[]string{"--file", "in.txt", "route", "proc"}, "requires -f"},
+		{[]string{"route", "a=1", "a=2"}, "repeated parameter a"},
+		{[]string{"--proc", "proc"}, "requires a route"},
+		{[]string{"route", "proc", "--proc", "other"}, "proc given both"},
+		{[]string{"--tag", "web", "route"}, "cannot be combined with a route"},
+		{[]string{"-u", "route", "proc", "many"}, "invalid instance count"},
+		{[]string{"route", "proc", "extra"}, "unexpected argument \"extra\""},
+		{[]string{"route", "--", "ls"}, "requires -x"},
+		{[]string{"signal"}, "a signal is required"},
+		{[]string{"signal", "route.proc", "HUP", "--signal", "TERM"}, "signal given both"},
+		{[]string{"signal", "route.proc", "HUP", "--proc", "other"}, "proc given both"},
+		{[]string{"--namespace", "a|b"}, "must not be empty"},
+	}
+	for _, test := range tests {
+		_, err := parseArgs(test.args)
+		if err == nil {
+			t.Errorf("%q: no error", test.args)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q: got error %q, want %q", test.args, err, test.want)
+		}
+	}
+}
+
+func TestDecodeConfigLiteral(t *testing.T) {
+	t.Setenv("PRICE", "3")
+
+	b := []byte(`routes:
+  r:
+    var:
+      name: x
+    procs:
+      - name: plain
+        path: /bin/echo
+        args: ["${PRICE}", '\${PRICE}', "{{.name}}", "{{raw}}{{.name}} ${PRICE}{{/raw}}"]
+      - name: literal
+        path: /bin/echo
+        literal: true
+        args: ["${PRICE}", "{{.name}}", "{{raw}}${PRICE}{{/raw}}"]
+        env:
+          A: "{{raw}}{{.name}}{{/raw}}"
+        in: "{{raw}}in{{/raw}}"
+`)
+	x, err := decodeConfig(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	procs := x.Routes["r"].Procs
+
+	want := []string{"3", "${PRICE}", "x", "{{.name}} ${PRICE}"}
+	if !reflect.DeepEqual(procs[0].Args, want) {
+		t.Errorf("plain args: got %q, want %q", procs[0].Args, want)
+	}
+	want = []string{"${PRICE}", "{{.name}}", "${PRICE}"}
+	if !reflect.DeepEqual(procs[1].Args, want) {
+		t.Errorf("literal args: got %q, want %q", procs[1].Args, want)
+	}
+	if s := procs[1].Env["A"]; s != "{{.name}}" {
+		t.Errorf("literal env: got %q, want %q", s, "{{.name}}")
+	}
+	if procs[1].In != "in" {
+		t.Errorf("literal in: got %q, want %q", procs[1].In, "in")
+	}
+}
+
+func TestReadSamples(t *testing.T) {
+	old := BasePath
+	BasePath = t.TempDir()
+	defer func() { BasePath = old }()
+
+	if err := os.MkdirAll(BasePath+"/stats", 0700); err != nil {
+		t.Fatal(err)
+	}
+	// a line recorded before truncation counts, then later runs
+	b := []byte("100 1.00 10 0\n110 1.00 10 1 3\n120 1.00 10 1 5\n130 1.00 10 0 2\n")
+	if err := os.WriteFile(StatsPath("ns", "r"), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	samples, err := ReadSamples("ns", "r", time.Unix(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 4 {
+		t.Fatalf("got %d samples, want 4", len(samples))
+	}
+	if n := Truncated(samples); n != 7 {
+		t.Errorf("truncated: got %d, want 7", n)
+	}
+	if n := Restarts(samples); n != 1 {
+		t.Errorf("restarts: got %d, want 1", n)
+	}
+}
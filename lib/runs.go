@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"time"
+)
+
+// A LogLine is a line of process output, as written to clients in the JSON output format, shipped, and archived.
+type LogLine struct {
+	Time      time.Time
+	Namespace string
+	Route     string
+	Proc      string
+	Stream    string // "out" or "err"
+	Line      string
+}
+
+// A RouteStatus describes an active route, or a finished route run, as listed in JSON format.
+type RouteStatus struct {
+	Namespace string
+	Route     string    // route name, suffixed by the instance, if any
+	Active    bool      // the route is active; otherwise, this is a finished run
+	Proc      string    // running proc, if any
+	State     string    // for active routes, "running", "ready", or what the route is doing, e.g. "queued" or "waiting for db"; for finished runs, the outcome
+	Services  []string  // ready procs still running in the background
+	Pid       int       // running proc process ID; 0 if none
+	Restarts  int       // proc restarts, by trigger or retry, and route restarts
+	ExitCode  *int      // exit code of the last exited proc, -1 if terminated by a signal; nil if none has exited
+	Run       string    // run identifier
+	Start     time.Time // run start; zero while queued
+	End       time.Time // finished runs only
+	Error     string    // finished runs only
+
+	Deprecated string // deprecation notice of the route, if any
+}
+
+// RunPath returns the directory holding the archived output of the given route run.
+func RunPath(id string) string {
+	return BasePath + "/runs/" + id
+}
+
+// ReadRun returns the archived output of the given route run, in order of arrival.
+func ReadRun(id string) ([]LogLine, error) {
+	dir := RunPath(id)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, errors.New("run " + id + " not archived")
+		}
+		return nil, err
+	}
+
+	var r []LogLine
+	for _, entry := range entries {
+		f, err := os.Open(dir + "/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		sc := bufio.NewScanner(f)
+		sc.Buffer(nil, 1<<20)
+		for sc.Scan() {
+			var line LogLine
+			if json.Unmarshal(sc.Bytes(), &line) == nil {
+				r = append(r, line)
+			}
+		}
+		err = sc.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(r, func(i, j int) bool {
+		return r[i].Time.Before(r[j].Time)
+	})
+	return r, nil
+}
@@ -0,0 +1,120 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"time"
+)
+
+// statsMax is the size after which a stats file is halved, discarding older samples.
+const statsMax = 1 << 20
+
+// A Sample is a point in a route's resource usage history.
+type Sample struct {
+	Time      time.Time
+	CPU       float64 // CPU usage of the active proc since the previous sample, in percent
+	RSS       int64   // resident memory of the active proc, in bytes
+	Restarts  int     // proc restarts in the current route run
+	Truncated int     // output lines truncated in the current route run
+}
+
+// StatsPath returns the path of the stats file of the given route.
+func StatsPath(namespace, route string) string {
+	return BasePath + "/stats/" + namespace + "_" + route
+}
+
+// AppendSample adds a sample to the stats file of the given route.
+func AppendSample(namespace, route string, s Sample) error {
+	path := StatsPath(namespace, route)
+	if err := os.MkdirAll(BasePath+"/stats", 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d %.2f %d %d %d\n", s.Time.Unix(), s.CPU, s.RSS, s.Restarts, s.Truncated)
+	info, statErr := f.Stat()
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	if statErr == nil && info.Size() > statsMax {
+		return halveStats(path)
+	}
+	return nil
+}
+
+// halveStats discards the older half of a stats file.
+func halveStats(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	b = b[len(b)/2:]
+	for i, c := range b {
+		if c == '\n' {
+			b = b[i+1:]
+			break
+		}
+	}
+	return os.WriteFile(path, b, 0600)
+}
+
+// ReadSamples returns the samples of the given route recorded after since, in chronological order.
+func ReadSamples(namespace, route string, since time.Time) ([]Sample, error) {
+	f, err := os.Open(StatsPath(namespace, route))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r []Sample
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var (
+			s    Sample
+			unix int64
+		)
+		// lines recorded before truncation counts lack the last field
+		if n, err := fmt.Sscanf(sc.Text(), "%d %f %d %d %d", &unix, &s.CPU, &s.RSS, &s.Restarts, &s.Truncated); err != nil && n != 4 {
+			continue // skip corrupt lines
+		}
+		s.Time = time.Unix(unix, 0)
+		if s.Time.After(since) {
+			r = append(r, s)
+		}
+	}
+	return r, sc.Err()
+}
+
+// Restarts returns the total number of restarts across the given chronological samples.
+func Restarts(samples []Sample) int {
+	return runTotal(samples, func(s Sample) int { return s.Restarts })
+}
+
+// Truncated returns the total number of truncated output lines across the given chronological samples.
+// The first sample counts in full, since a short route run may only be sampled once.
+func Truncated(samples []Sample) int {
+	if len(samples) == 0 {
+		return 0
+	}
+	return samples[0].Truncated + runTotal(samples, func(s Sample) int { return s.Truncated })
+}
+
+// runTotal sums a per-run count across the given chronological samples.
+// Sample counts are reset with each route run, so only increases are summed.
+func runTotal(samples []Sample, count func(Sample) int) int {
+	n := 0
+	for i := 1; i < len(samples); i++ {
+		if d := count(samples[i]) - count(samples[i-1]); d >= 0 {
+			n += d
+		} else {
+			n += count(samples[i])
+		}
+	}
+	return n
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"os"
+
 	"github.com/blitz-frost/op"
 )
 
 func main() {
-	op.Run()
+	os.Exit(op.Run())
 }
@@ -1,42 +1,87 @@
 package op
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
+	"strings"
 
 	"github.com/blitz-frost/op/cli"
 	"github.com/blitz-frost/op/lib"
 	"github.com/blitz-frost/op/srv"
+
+	"gopkg.in/yaml.v2"
 )
 
-func Run() {
+// Run executes the command line command, and returns the exit status of the program.
+func Run() int {
+	// confinement helpers only execute their target command
+	srv.Confine()
+	lib.Init()
+
 	// on print switch, print routes found in config file and exit
 	//
 	// on meta switch with no further arguments - print variants and active variant
 	// otherwise applies the next arg as template variant
 	switch lib.ArgSwitch {
 	case lib.CmdPrint:
-		manifest, err := lib.DecodeConfig()
+		var (
+			manifest lib.Manifest
+			err      error
+		)
+		if lib.ArgVariant != "" {
+			manifest, err = lib.DecodeVariant(lib.ArgVariant)
+		} else {
+			manifest, err = lib.DecodeConfig()
+		}
 		if err != nil {
 			fmt.Println(err)
-			return
+			return 1
 		}
+
+		if lib.ArgResolve {
+			if err := printManifest(manifest); err != nil {
+				fmt.Println(err)
+				return 1
+			}
+			return 0
+		}
+
 		for name, rt := range manifest.Routes {
+			if !rt.HasTags(lib.ArgTags) {
+				continue
+			}
 			s := ""
 			if rt.Default {
 				s = " - default"
 			}
+			if rt.Deprecated != "" {
+				s += " - deprecated: " + rt.Deprecated
+			}
 			fmt.Println(rt.Namespace + ": " + name + s)
 		}
-		return
+		namespace := manifest.Namespace
+		if namespace == "" {
+			namespace = "default"
+		}
+		if len(lib.ArgTags) > 0 {
+			return 0
+		}
+		for name, members := range manifest.Groups {
+			fmt.Println(namespace + ": " + name + " - group: " + strings.Join(members, ", "))
+		}
+		return 0
 
 	case lib.CmdMeta:
 		if lib.ArgMajor == "" {
 			meta, err := lib.DecodeMeta()
 			if err != nil {
 				fmt.Println(err)
-				return
+				return 1
 			}
 
 			fmt.Println("Defined variants:")
@@ -47,26 +92,156 @@ func Run() {
 		} else {
 			if err := lib.ExecuteTemplate(lib.ArgMajor); err != nil {
 				fmt.Println(err)
-				return
+				return 1
 			}
 		}
-		return
+		return 0
+
+	case lib.CmdSimulate:
+		if err := printSimulation(); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		return 0
+
+	case lib.CmdStats:
+		if err := printStats(); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		return 0
+
+	case lib.CmdHelp:
+		printHelp()
+		return 0
+
+	case lib.CmdLogs:
+		// archived runs are read directly, without a server
+		if lib.ArgRun != "" {
+			if err := printRun(); err != nil {
+				fmt.Println(err)
+				return 1
+			}
+			return 0
+		}
 	}
 
+	finish, err := setupOutput()
+	if err != nil {
+		fmt.Println("output setup error:", err)
+		return 1
+	}
+	defer finish()
+
 	// if lock file already exists, run as client
 	// otherwise run as server
 	asSrv := true
 	if _, err := os.OpenFile(lib.BasePath+"/lock", os.O_CREATE|os.O_EXCL, 0000); err != nil {
 		if !errors.Is(err, os.ErrExist) {
 			fmt.Println("lock file creation error:", err)
-			return
+			return 1
 		}
 		asSrv = false
 	}
 
 	if asSrv {
-		srv.Run()
+		return srv.Run()
+	}
+	return cli.Run()
+}
+
+// setupOutput redirects op output according to the output options.
+// The returned function must be called once done, to close the save file and run the pager.
+func setupOutput() (func(), error) {
+	var (
+		outW io.Writer = os.Stdout
+		errW io.Writer = os.Stderr
+	)
+
+	// paged output is combined into a single buffer
+	var buf *bytes.Buffer
+	if lib.ArgPager {
+		buf = &bytes.Buffer{}
+		paged := lib.NewFmt(buf)
+		outW, errW = paged, paged
+	}
+
+	var f *os.File
+	if lib.ArgSave != "" {
+		var err error
+		if f, err = os.Create(lib.ArgSave); err != nil {
+			return nil, err
+		}
+		save := lib.NewFmt(f)
+		outW = io.MultiWriter(outW, save)
+		errW = io.MultiWriter(errW, save)
+	}
+
+	lib.Stdout.Redirect(outW)
+	lib.Stderr.Redirect(errW)
+
+	return func() {
+		lib.Stdout.Redirect(os.Stdout)
+		lib.Stderr.Redirect(os.Stderr)
+		if f != nil {
+			f.Close()
+		}
+		if buf != nil {
+			page(buf)
+		}
+	}, nil
+}
+
+// page displays the contents of r through the $PAGER command, "less" by default.
+func page(r io.Reader) {
+	args := strings.Fields(os.Getenv("PAGER"))
+	if len(args) == 0 {
+		args = []string{"less"}
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = r
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Println("pager error:", err)
+	}
+}
+
+// printManifest writes the given manifest to stdout, as YAML or JSON.
+func printManifest(m lib.Manifest) error {
+	var (
+		b   []byte
+		err error
+	)
+	if lib.ArgJson {
+		b, err = json.MarshalIndent(m, "", "  ")
+		b = append(b, '\n')
 	} else {
-		cli.Run()
+		b, err = yaml.Marshal(m)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(b)
+	return err
+}
+
+// printHelp lists the defined verbs, along with their equivalent switches, and the options.
+func printHelp() {
+	fmt.Println("usage: op [verb | switch] [options] [route [proc]] [name=value ...]")
+	fmt.Println()
+	fmt.Println("verbs:")
+	for _, v := range lib.Verbs {
+		sw := string(v.Sw)
+		if sw == "" {
+			sw = "  "
+		}
+		fmt.Printf("  %-9s %s  %s\n", v.Name, sw, v.Desc)
 	}
+	fmt.Println()
+	fmt.Println("options:")
+	lib.PrintOptions(os.Stdout)
+	fmt.Println()
+	fmt.Println("Verbs take the place of their switch, before the route; a route named like a verb is run with \"op run name\".")
 }
@@ -0,0 +1,34 @@
+package op
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/blitz-frost/op/lib"
+	"github.com/blitz-frost/op/srv"
+)
+
+// printRun prints the archived output of the run named by ArgRun, in the server output format.
+// Lines are written to the stream they came from.
+func printRun() error {
+	lines, err := lib.ReadRun(lib.ArgRun)
+	if err != nil {
+		return err
+	}
+
+	color := lib.ColorOutput()
+	for _, line := range lines {
+		w := os.Stdout
+		if line.Stream == "err" {
+			w = os.Stderr
+		}
+		if lib.LogFormat == lib.FormatJson {
+			b, _ := json.Marshal(line) // cannot fail
+			w.Write(append(b, '\n'))
+			continue
+		}
+		start, end := srv.LineStyle(line.Stream == "err", color)
+		w.Write([]byte(srv.LinePrefix(line.Route, line.Proc, color) + start + line.Line + end + "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,383 @@
+package op
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blitz-frost/op/lib"
+	"github.com/blitz-frost/op/srv"
+)
+
+// serverDefaults are the server defaults and limits the simulation follows.
+var serverDefaults = srv.Defaults()
+
+// simulatedRunsShown bounds the listed runs of a route started by a schedule or interval.
+const simulatedRunsShown = 20
+
+// An event is a simulated action, at an offset from the start of the simulation.
+type event struct {
+	at   time.Duration
+	text string
+}
+
+// printSimulation prints the timeline of decisions the server would make when running the targeted routes,
+// over the next ArgFor, without running anything.
+// Proc runs are assumed to complete instantly, so offsets only account for configured waits.
+func printSimulation() error {
+	manifest, err := lib.DecodeConfig()
+	if err != nil {
+		return err
+	}
+
+	routes := manifest.Routes
+	if lib.ArgMajor != "" {
+		rt, ok := routes[lib.ArgMajor]
+		if !ok {
+			return errors.New("route not defined")
+		}
+		routes = map[string]lib.Route{lib.ArgMajor: rt}
+	}
+
+	names := make([]string, 0, len(routes))
+	for name, rt := range routes {
+		if lib.ArgMajor == "" && !rt.Default {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Println("simulating " + lib.ArgFor.String() + "; proc runs are assumed to complete instantly")
+	now := time.Now()
+	for _, name := range names {
+		events := simulateRoute(name, routes[name])
+
+		fmt.Println(routes[name].Namespace + ": " + name)
+		for _, e := range events {
+			if e.at > lib.ArgFor {
+				break
+			}
+			fmt.Printf("  +%-10s %s\n", e.at, e.text)
+		}
+
+		if err := printScheduledRuns(routes[name], now); err != nil {
+			fmt.Println("  schedule error: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// printScheduledRuns prints the runs that a dedicated server started at now would start on its own, over the next ArgFor.
+// Each run goes through the timeline of a single run.
+func printScheduledRuns(rt lib.Route, now time.Time) error {
+	runs, err := srv.ScheduledRuns(rt, now, now.Add(lib.ArgFor))
+	if err != nil || len(runs) == 0 {
+		return err
+	}
+
+	s := "  a dedicated server (op -s) runs it " + strconv.Itoa(len(runs)) + " times; a run due while the previous one is still active is "
+	if rt.Overlap == "queue" {
+		s += "queued"
+	} else {
+		s += "skipped"
+	}
+	fmt.Println(s)
+
+	desc := "scheduled run"
+	if rt.Every > 0 {
+		desc = "interval run"
+		if rt.Schedule != "" {
+			desc = "scheduled or interval run"
+		}
+	}
+	var delay string
+	if rt.Every > 0 && rt.Jitter > 0 {
+		delay = ", delayed by up to " + time.Duration(rt.Jitter).String()
+	}
+	for i, t := range runs {
+		if i == simulatedRunsShown {
+			fmt.Println("  ... " + strconv.Itoa(len(runs)-i) + " more runs")
+			break
+		}
+		fmt.Printf("  +%-10s %s at %s%s\n", t.Sub(now).Round(time.Second), desc, t.Format("2006-01-02 15:04:05"), delay)
+	}
+	return nil
+}
+
+// simulateRoute returns the chronological events of a single route run.
+func simulateRoute(name string, rt lib.Route) []event {
+	var (
+		r  []event
+		at time.Duration
+	)
+	add := func(text string) {
+		r = append(r, event{at, text})
+	}
+
+	if rt.Deprecated != "" {
+		add("warn: deprecated: " + rt.Deprecated)
+	}
+	if len(rt.PreStart) > 0 {
+		add("run " + strconv.Itoa(len(rt.PreStart)) + " prestart hooks")
+	}
+
+	// concurrent procs start once their dependencies have
+	concurrent := rt.Parallel
+	for _, proc := range rt.Procs {
+		if len(proc.DependsOn) > 0 {
+			concurrent = true
+		}
+	}
+	var offsets []time.Duration
+	if concurrent {
+		add("start procs concurrently, as their dependencies allow")
+		offsets = dependencyOffsets(rt.Procs, at)
+	}
+
+	var services []string
+	for i, proc := range rt.Procs {
+		if lib.ArgMinor != "" && proc.Name != lib.ArgMinor {
+			continue
+		}
+		pname := proc.Name
+		if pname == "" {
+			pname = strconv.Itoa(i)
+		}
+		prefix := name + "|" + pname + ": "
+		if concurrent {
+			at = offsets[i]
+			if len(proc.DependsOn) > 0 {
+				add(prefix + "dependencies succeeded or ready: " + strings.Join(proc.DependsOn, ", "))
+			}
+		}
+
+		if proc.Delay > 0 {
+			add(prefix + "wait " + time.Duration(proc.Delay).String())
+			at += time.Duration(proc.Delay)
+		}
+		if len(proc.PreStart) > 0 {
+			add(prefix + "run " + strconv.Itoa(len(proc.PreStart)) + " prestart hooks")
+		}
+		if src := strings.TrimPrefix(proc.In, lib.InProc); concurrent && src != proc.In {
+			add(prefix + "wait until " + src + " has started")
+		}
+		add(prefix + "start " + strings.Join(append([]string{proc.Path}, proc.Args...), " "))
+
+		for _, t := range proc.Triggers {
+			add(prefix + "on output matching " + strconv.Quote(t.Match) + ", " + t.Action)
+		}
+
+		if proc.Ready != nil {
+			s := prefix + "wait until ready (" + describeProbe(*proc.Ready) + ")"
+			if proc.Ready.Timeout > 0 {
+				s += ", failing after " + time.Duration(proc.Ready.Timeout).String()
+			}
+			add(s + ", then continue while it runs")
+			services = append(services, pname)
+		} else if consumer := consumerOf(rt.Procs, i, concurrent); consumer != "" {
+			add(prefix + "continue while it runs, piping stdout into " + consumer)
+			services = append(services, pname)
+		} else if concurrent {
+			add(prefix + "run concurrently")
+			services = append(services, pname)
+		} else {
+			add(prefix + "wait for exit")
+		}
+
+		if proc.Retries > 0 {
+			backoff := time.Duration(proc.RetryBackoff)
+			if backoff <= 0 {
+				backoff = serverDefaults.Backoff
+			}
+			n := proc.Retries
+			if n > serverDefaults.BackoffShift+1 {
+				n = serverDefaults.BackoffShift + 1
+			}
+			waits := make([]string, n)
+			for j := range waits {
+				waits[j] = (backoff << j).String()
+			}
+			s := "on failure, retry after " + strings.Join(waits, ", ")
+			if proc.Retries > n {
+				s += ", then every " + (backoff << serverDefaults.BackoffShift).String() + ", up to " + strconv.Itoa(proc.Retries) + " retries"
+			}
+			add(prefix + s + ", then abort route")
+		} else {
+			add(prefix + "on failure, abort route")
+		}
+
+		if hc := proc.HealthCheck; hc != nil {
+			interval := time.Duration(hc.Interval)
+			if interval <= 0 {
+				interval = serverDefaults.HealthInterval
+			}
+			failures := hc.Failures
+			if failures <= 0 {
+				failures = serverDefaults.HealthFailures
+			}
+			add(prefix + "while it runs, check health (" + describeHealth(*hc) + ") every " + interval.String() + "; after " + strconv.Itoa(failures) + " consecutive failures, at the earliest " + (interval * time.Duration(failures)).String() + " after start, interrupt it as failed")
+		}
+		if len(proc.Watch) > 0 {
+			add(prefix + "while it runs, on changes to " + strings.Join(proc.Watch, ", ") + ", restart it once they stop for " + serverDefaults.WatchDebounce.String() + ", without using a retry")
+		}
+
+		if len(proc.PostStop) > 0 {
+			add(prefix + "run " + strconv.Itoa(len(proc.PostStop)) + " poststop hooks after exit")
+		}
+	}
+
+	if concurrent {
+		sort.SliceStable(r, func(i, j int) bool {
+			return r[i].at < r[j].at
+		})
+		at = r[len(r)-1].at
+	}
+
+	if len(services) > 0 {
+		add("wait for " + strings.Join(services, ", ") + " to exit")
+	}
+	if len(rt.PostStop) > 0 {
+		add("run " + strconv.Itoa(len(rt.PostStop)) + " poststop hooks")
+	}
+	add("finish")
+
+	if s := describeRestart(rt); s != "" {
+		add(s)
+	}
+
+	return r
+}
+
+// describeRestart returns a description of the restart policy of a route, or an empty string if it is not restarted.
+func describeRestart(rt lib.Route) string {
+	backoff := time.Duration(rt.RestartBackoff)
+	if backoff <= 0 {
+		backoff = serverDefaults.Backoff
+	}
+
+	var s string
+	switch rt.Restart {
+	case "always":
+		s = "unless killed, run the route again " + backoff.String() + " after a successful run; "
+	case "on-failure":
+	default:
+		return ""
+	}
+
+	n := rt.RestartMax
+	if n <= 0 || n > serverDefaults.BackoffShift+1 {
+		n = serverDefaults.BackoffShift + 1
+	}
+	waits := make([]string, n)
+	for i := range waits {
+		waits[i] = (backoff << i).String()
+	}
+	s += "after consecutive failed runs, run it again after " + strings.Join(waits, ", ")
+	switch {
+	case rt.RestartMax <= 0:
+		s += ", then every " + (backoff << serverDefaults.BackoffShift).String()
+	case rt.RestartMax > n:
+		s += ", then every " + (backoff << serverDefaults.BackoffShift).String() + ", up to " + strconv.Itoa(rt.RestartMax) + " restarts, then stop"
+	default:
+		s += ", then stop"
+	}
+	return s + "; a run whose procs became ready starts the backoff over"
+}
+
+// dependencyOffsets returns the offsets at which the dependencies of each proc are satisfied, for procs that start no earlier than start.
+// Runs complete instantly, so a proc satisfies its dependents once its delay has passed.
+// Undefined dependencies and cycles are ignored.
+func dependencyOffsets(procs []lib.Proc, start time.Duration) []time.Duration {
+	index := make(map[string]int, len(procs))
+	for i, proc := range procs {
+		name := proc.Name
+		if name == "" {
+			name = strconv.Itoa(i)
+		}
+		index[name] = i
+	}
+
+	r := make([]time.Duration, len(procs))
+	done := make([]bool, len(procs))
+	visiting := make([]bool, len(procs))
+	var visit func(i int) time.Duration // returns the offset at which the i-th proc satisfies its dependents
+	visit = func(i int) time.Duration {
+		if !done[i] && !visiting[i] {
+			visiting[i] = true
+			r[i] = start
+			deps := procs[i].DependsOn
+			if src := strings.TrimPrefix(procs[i].In, lib.InProc); src != procs[i].In {
+				deps = append(deps[:len(deps):len(deps)], src)
+			}
+			for _, name := range deps {
+				if j, ok := index[name]; ok {
+					if t := visit(j); t > r[i] {
+						r[i] = t
+					}
+				}
+			}
+			visiting[i] = false
+			done[i] = true
+		}
+		return r[i] + time.Duration(procs[i].Delay)
+	}
+	for i := range procs {
+		visit(i)
+	}
+	return r
+}
+
+// describeProbe returns a short description of a readiness check.
+func describeProbe(p lib.Probe) string {
+	switch {
+	case p.Tcp != "":
+		return "tcp " + p.Tcp
+	case p.Http != "":
+		return "http " + p.Http
+	case p.File != "":
+		return "file " + p.File
+	case p.Log != "":
+		return "log " + strconv.Quote(p.Log)
+	}
+	return "no check"
+}
+
+// describeHealth returns a short description of a health check.
+func describeHealth(hc lib.HealthCheck) string {
+	switch {
+	case len(hc.Cmd) > 0:
+		return "command " + strings.Join(hc.Cmd, " ")
+	case hc.Tcp != "":
+		return "tcp " + hc.Tcp
+	case hc.Http != "":
+		return "http " + hc.Http
+	}
+	return "no check"
+}
+
+// consumerOf returns the name of the first proc that reads the stdout of the i-th one, or an empty string if there is none.
+// Only later procs are considered, unless parallel.
+func consumerOf(procs []lib.Proc, i int, parallel bool) string {
+	name := procs[i].Name
+	if name == "" {
+		name = strconv.Itoa(i)
+	}
+	j := i + 1
+	if parallel {
+		j = 0
+	}
+	for ; j < len(procs); j++ {
+		if procs[j].In != lib.InProc+name {
+			continue
+		}
+		if procs[j].Name == "" {
+			return strconv.Itoa(j)
+		}
+		return procs[j].Name
+	}
+	return ""
+}
@@ -0,0 +1,98 @@
+package srv
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+const (
+	anomalyWindow   = time.Minute // recent period checked against the baseline
+	anomalyBaseline = time.Hour   // history used as baseline
+	anomalyMinBase  = 6           // baseline samples required before alerting
+	anomalyRestarts = 3           // restarts in the recent period required for a restart alert
+	anomalyFactor   = 4           // recent restart rate to baseline rate ratio required for a restart alert
+	anomalyMemory   = 2           // recent to baseline memory ratio required for a memory alert
+)
+
+// An analyzer watches the usage samples of a route for sharp deviations from its recent baseline.
+type analyzer struct {
+	history []lib.Sample
+	alerted bool // an alert has been raised and the route has not recovered since
+}
+
+// newAnalyzer returns an analyzer seeded with the persisted samples of the given route.
+func newAnalyzer(namespace, route string) *analyzer {
+	history, _ := lib.ReadSamples(namespace, route, time.Now().Add(-anomalyBaseline))
+	return &analyzer{history: history}
+}
+
+// add records a new sample and returns a description of all current anomalies.
+// An empty string is returned if there are none, or if they have already been reported.
+func (x *analyzer) add(s lib.Sample) string {
+	x.history = append(x.history, s)
+
+	// discard samples older than the baseline
+	cut := s.Time.Add(-anomalyBaseline)
+	i := 0
+	for i < len(x.history) && !x.history[i].Time.After(cut) {
+		i++
+	}
+	x.history = x.history[i:]
+
+	// split into baseline and recent samples
+	recentCut := s.Time.Add(-anomalyWindow)
+	n := 0
+	for n < len(x.history) && !x.history[n].Time.After(recentCut) {
+		n++
+	}
+	if n < anomalyMinBase {
+		return ""
+	}
+	base, recent := x.history[:n], x.history[n-1:] // recent includes the last baseline sample, for restart deltas
+
+	var reasons []string
+
+	restarts := lib.Restarts(recent)
+	baseSpan := base[len(base)-1].Time.Sub(base[0].Time)
+	baseRate := 0.0
+	if baseSpan > 0 {
+		baseRate = float64(lib.Restarts(base)) / baseSpan.Minutes()
+	}
+	rate := float64(restarts) / anomalyWindow.Minutes()
+	if restarts >= anomalyRestarts && rate > anomalyFactor*baseRate {
+		reasons = append(reasons, fmt.Sprintf("restart rate %.1f/min (baseline %.1f/min)", rate, baseRate))
+	}
+
+	baseRSS, rss := avgRSS(base), avgRSS(recent[1:])
+	if baseRSS > 0 && rss > anomalyMemory*baseRSS {
+		reasons = append(reasons, fmt.Sprintf("memory %.1fMB (baseline %.1fMB)", rss/(1<<20), baseRSS/(1<<20)))
+	}
+
+	if len(reasons) == 0 {
+		x.alerted = false
+		return ""
+	}
+	if x.alerted {
+		return ""
+	}
+	x.alerted = true
+	return strings.Join(reasons, "; ")
+}
+
+// avgRSS returns the average resident memory of the given samples, ignoring those without a running process.
+func avgRSS(samples []lib.Sample) float64 {
+	sum, n := 0.0, 0
+	for _, s := range samples {
+		if s.RSS > 0 {
+			sum += float64(s.RSS)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return sum / float64(n)
+}
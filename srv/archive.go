@@ -0,0 +1,96 @@
+package srv
+
+import (
+	"os"
+	"time"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+// An archive appends the output lines of a process stream to the archive of its route run, as JSON lines.
+// The file is opened on the first line, and closed on flush.
+type archive struct {
+	runId string
+	name  string // file name, after the process
+	line  lib.LogLine
+
+	f      *os.File
+	failed bool // an error has been reported; further lines are discarded
+}
+
+func newArchive(runId, namespace, route, proc string, err bool) *archive {
+	stream := "out"
+	if err {
+		stream = "err"
+	}
+	return &archive{
+		runId: runId,
+		name:  proc,
+		line: lib.LogLine{
+			Namespace: namespace,
+			Route:     route,
+			Proc:      proc,
+			Stream:    stream,
+		},
+	}
+}
+
+// add appends a line.
+func (x *archive) add(text []byte) {
+	if x.failed {
+		return
+	}
+	if x.f == nil {
+		dir := lib.RunPath(x.runId)
+		err := os.MkdirAll(dir, 0700)
+		if err == nil {
+			x.f, err = os.OpenFile(dir+"/"+x.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		}
+		if err != nil {
+			stderr.Println(x.line.Route+"|"+x.name+" archive error:", err)
+			x.failed = true
+			return
+		}
+	}
+	x.f.Write(appendJsonLine(nil, x.line, text, time.Now()))
+}
+
+func (x *archive) close() {
+	if x.f != nil {
+		x.f.Close()
+		x.f = nil
+	}
+}
+
+// pruneRuns removes the run archives that have not been written to for lib.RunRetention.
+func pruneRuns() {
+	dir := lib.BasePath + "/runs"
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	limit := time.Now().Add(-lib.RunRetention)
+	for _, entry := range entries {
+		if runModTime(dir + "/" + entry.Name()).After(limit) {
+			continue
+		}
+		if err := os.RemoveAll(dir + "/" + entry.Name()); err != nil {
+			stderr.Println("run archive prune error:", err)
+		}
+	}
+}
+
+// runModTime returns the last time a run archive has been written to.
+func runModTime(dir string) time.Time {
+	var r time.Time
+	if info, err := os.Stat(dir); err == nil {
+		r = info.ModTime()
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && info.ModTime().After(r) {
+			r = info.ModTime()
+		}
+	}
+	return r
+}
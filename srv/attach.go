@@ -0,0 +1,142 @@
+package srv
+
+import (
+	"errors"
+	"io"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+// errNotInteractive is returned when writing input to a process that does not accept it.
+var errNotInteractive = errors.New("process is not interactive")
+
+// writeInput writes b to the stdin of an interactive process.
+func (x *proc) writeInput(b []byte) error {
+	if x.input == nil {
+		return errNotInteractive
+	}
+	x.inputMux.Lock()
+	defer x.inputMux.Unlock()
+	_, err := x.input.Write(b)
+	return err
+}
+
+// runningProc returns the named running process of the route, or its current one if name is empty.
+// Returns nil if there is none.
+func (x *route) runningProc(name string) *proc {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	if x.proc != nil && (name == "" || x.proc.name == name) && x.proc.cmd.ProcessState == nil {
+		return x.proc
+	}
+	for _, p := range x.services {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// forwardInput writes the client stdin to the interactive process p of the named route, until EOF.
+// Returns false if writing fails.
+// The process stdin stays open for later clients.
+func (x command) forwardInput(name string, p *proc) bool {
+	b := make([]byte, 4096)
+	for {
+		n, err := x.stdin.Read(b)
+		if n > 0 {
+			if err := p.writeInput(b[:n]); err != nil {
+				x.stderr.Write([]byte(name + "|" + p.name + " input error: " + err.Error() + "\n"))
+				return false
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				x.stderr.Write([]byte(name + " stdin error: " + err.Error() + "\n"))
+				return false
+			}
+			return true
+		}
+	}
+}
+
+// executeFeed writes the client stdin to an interactive running process of the target route, until EOF.
+// The process keeps running, and its stdin stays open.
+func (x command) executeFeed() error {
+	if x.Route == "" || x.group() != nil {
+		return errors.New("writing stdin requires a route")
+	}
+	name := instanceName(x.Route, x.Instance)
+
+	rt, ok := activeGet(x.Namespace, name)
+	if !ok {
+		x.stderr.Write([]byte(name + " not active\n"))
+		x.fail(1)
+		return nil
+	}
+	p := rt.runningProc(x.Proc)
+	if p == nil || p.input == nil {
+		x.stderr.Write([]byte(name + " stdin error: no interactive process running\n"))
+		x.fail(1)
+		return nil
+	}
+	if x.stdin == nil {
+		return nil
+	}
+
+	if !x.forwardInput(name, p) {
+		x.fail(1)
+	}
+	return nil
+}
+
+// executeAttach streams the live output of the target route, or of one of its processes, to the client, until the route terminates
+// or the client detaches, and sets the client exit status as a wait would.
+// If the client forwards its stdin, it is written to the target process, which must be interactive.
+func (x command) executeAttach() error {
+	if x.Route == "" || x.group() != nil {
+		return errors.New("attaching requires a route")
+	}
+	name := instanceName(x.Route, x.Instance)
+
+	rt, ok := activeGet(x.Namespace, name)
+	if !ok {
+		x.stderr.Write([]byte(name + " not active\n"))
+		x.fail(1)
+		return nil
+	}
+	if lib.LogBufferSize == 0 {
+		x.stderr.Write([]byte(name + " attach error: output is not kept; see OP_LOG_BUFFER\n"))
+		x.fail(1)
+		return nil
+	}
+
+	if x.stdin != nil {
+		p := rt.runningProc(x.Proc)
+		if p == nil || p.input == nil {
+			x.stderr.Write([]byte(name + " attach error: no interactive process running\n"))
+			x.fail(1)
+			return nil
+		}
+		go x.forwardInput(name, p)
+	}
+
+	// only live output; earlier lines are printed by CmdLogs
+	buf := logBufferGet(x.Namespace, name)
+	_, sub := buf.subscribe(x.Proc)
+	defer buf.unsubscribe(sub)
+	x.follow(rt, name, sub)
+
+	select {
+	case <-rt.done:
+	default:
+		return nil // detached
+	}
+	if f, ok := historyLast(x.Namespace, name); ok {
+		x.stderr.Write([]byte(f.String() + "\n"))
+		if f.err != nil {
+			x.fail(f.exitStatus())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package srv
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// killGrace is the time a command has to exit after being interrupted, before it is killed.
+const killGrace = 10 * time.Second
+
+var (
+	auxWg     sync.WaitGroup // signal all auxiliary commands terminated
+	forced    []string       // descriptions of commands killed after their grace period
+	forcedMux sync.Mutex
+)
+
+// runCancelable runs cmd until it exits or ctx is done.
+// On cancelation, the process group of cmd is interrupted, and killed if it does not exit within grace.
+// A command that is killed after its grace period is recorded under desc, for the shutdown report.
+// A zero grace kills the group at once, as an expected outcome that is not recorded.
+func runCancelable(ctx context.Context, cmd *exec.Cmd, grace time.Duration, desc string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// signal the whole group, so that children holding the output pipes terminate as well
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+
+	if err := startCmd(cmd); err != nil {
+		return err
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-exited:
+			return
+		case <-ctx.Done():
+		}
+
+		pgid := -cmd.Process.Pid
+		if grace == 0 {
+			syscall.Kill(pgid, syscall.SIGKILL)
+			return
+		}
+		syscall.Kill(pgid, syscall.SIGINT)
+		t := time.NewTimer(grace)
+		select {
+		case <-exited:
+			t.Stop()
+		case <-t.C:
+			syscall.Kill(pgid, syscall.SIGKILL)
+			recordForced(desc)
+		}
+	}()
+
+	err := cmd.Wait()
+	close(exited)
+	return err
+}
+
+// recordForced adds a forcefully terminated command to the shutdown report.
+func recordForced(desc string) {
+	forcedMux.Lock()
+	forced = append(forced, desc)
+	forcedMux.Unlock()
+}
+
+// reportForced prints the commands that had to be killed since the last report.
+func reportForced() {
+	forcedMux.Lock()
+	defer forcedMux.Unlock()
+
+	if len(forced) > 0 {
+		stderr.Println("force-terminated: " + strings.Join(forced, ", "))
+		forced = nil
+	}
+}
+
+// A terminator stops a started process, first by asking it nicely, then by force.
+type terminator interface {
+	interrupt() error // request a graceful exit
+	kill() error      // terminate immediately
+	release()         // free associated resources, once the process has exited
+}
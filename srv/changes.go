@@ -0,0 +1,70 @@
+package srv
+
+import (
+	"sync"
+	"time"
+)
+
+// listDelay coalesces bursts of route state changes into a single listing.
+const listDelay = 100 * time.Millisecond
+
+// clearScreen moves the cursor home and clears a terminal.
+const clearScreen = "\x1b[H\x1b[2J"
+
+// changes wakes the clients watching route states.
+var changes = struct {
+	sync.Mutex
+	ch chan struct{} // closed on the next change
+}{ch: make(chan struct{})}
+
+// stateChanged signals that a route became active or finished, or that its current proc, services, readiness, restarts or exit code changed.
+func stateChanged() {
+	changes.Lock()
+	close(changes.ch)
+	changes.ch = make(chan struct{})
+	changes.Unlock()
+}
+
+// nextChange returns a channel that is closed on the next route state change.
+func nextChange() <-chan struct{} {
+	changes.Lock()
+	defer changes.Unlock()
+	return changes.ch
+}
+
+// watchList writes the list of the targeted routes, then again after each state change, until the command is canceled.
+// Terminal clients get the list redrawn in place; others get each list after a blank line, or one JSON array per line.
+func (x command) watchList() {
+	for first := true; ; first = false {
+		// taken before listing, so that no change goes unnoticed
+		ch := nextChange()
+
+		b, err := x.listing()
+		if err != nil {
+			x.stderr.Write([]byte("list encoding error: " + err.Error() + "\n"))
+			return
+		}
+		switch {
+		case x.Color && !x.Json:
+			b = append([]byte(clearScreen), b...)
+		case !first && !x.Json:
+			b = append([]byte{'\n'}, b...)
+		}
+		if _, err := x.stdout.Write(b); err != nil {
+			return
+		}
+
+		select {
+		case <-ch:
+		case <-x.ctx.Done():
+			return
+		}
+		t := time.NewTimer(listDelay)
+		select {
+		case <-t.C:
+		case <-x.ctx.Done():
+			t.Stop()
+			return
+		}
+	}
+}
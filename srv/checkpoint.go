@@ -0,0 +1,86 @@
+package srv
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+// checkpointDir returns the directory holding the progress of interrupted route runs.
+func checkpointDir() string {
+	return lib.BasePath + "/checkpoints"
+}
+
+// A checkpoint records the progress of a route run, so that it may be resumed after a failure or a server restart.
+type checkpoint struct {
+	RunId string // run that recorded the checkpoint, as archived; see CmdLogs
+	Next  string // first proc that has not yet succeeded, or that moved to the background
+}
+
+func checkpointPath(namespace, route string) string {
+	return checkpointDir() + "/" + namespace + "_" + route + ".json"
+}
+
+// checkpointed returns true if the route records its progress.
+// Only sequential task routes are checkpointed, and only when running all their procs.
+func (x *route) checkpointed() bool {
+	return x.checkpoint && !x.concurrent && x.cfg.Kind != kindService && len(x.tasks) > 0
+}
+
+// checkpointSave records that the run must resume from the i-th process.
+// Failures are only reported, since they do not affect the run itself.
+func (x *route) checkpointSave(i int) {
+	if !x.checkpointed() {
+		return
+	}
+	if i >= len(x.tasks) {
+		x.checkpointRemove()
+		return
+	}
+
+	b, err := json.Marshal(checkpoint{
+		RunId: x.id,
+		Next:  x.task(i).Name,
+	})
+	if err == nil {
+		err = os.MkdirAll(checkpointDir(), 0700)
+	}
+	if err == nil {
+		err = os.WriteFile(checkpointPath(x.namespace, x.name), b, 0600)
+	}
+	if err != nil {
+		x.stderr.Write([]byte(x.name + " checkpoint error: " + err.Error() + "\n"))
+	}
+}
+
+// checkpointRemove discards the route's progress, once a run has succeeded.
+func (x *route) checkpointRemove() {
+	if x.checkpointed() {
+		os.Remove(checkpointPath(x.namespace, x.name))
+	}
+}
+
+// executeResume runs the target route starting from the proc its last interrupted run had not completed.
+func (x command) executeResume() error {
+	if x.Route == "" || x.Proc != "" || x.group() != nil {
+		return errors.New("resume requires a single route")
+	}
+
+	b, err := os.ReadFile(checkpointPath(x.Namespace, instanceName(x.Route, x.Instance)))
+	if errors.Is(err, os.ErrNotExist) {
+		return errors.New("no checkpoint; the last run has succeeded or never started")
+	}
+	if err != nil {
+		return err
+	}
+	var c checkpoint
+	if err := json.Unmarshal(b, &c); err != nil {
+		return err
+	}
+
+	x.stderr.Write([]byte(instanceName(x.Route, x.Instance) + " resuming run " + c.RunId + " from " + c.Next + "\n"))
+	x.From = c.Next
+	return x.executeRun()
+}
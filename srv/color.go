@@ -0,0 +1,34 @@
+package srv
+
+import (
+	"hash/fnv"
+	"strconv"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+// prefixColors are the ANSI foreground colors of output line prefixes.
+// Red is left out, so that it does not suggest errors.
+var prefixColors = []int{32, 33, 34, 35, 36, 92, 93, 94, 95, 96}
+
+// LinePrefix returns the "route|proc: " prefix of output lines.
+// If color is set, the prefix is colored as determined by a hash of the route and proc, so that it is stable across runs.
+func LinePrefix(route, proc string, color bool) string {
+	s := route + "|" + proc
+	if !color {
+		return s + ": "
+	}
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	c := prefixColors[h.Sum32()%uint32(len(prefixColors))]
+	return "\x1b[" + strconv.Itoa(c) + "m" + s + "\x1b[0m: "
+}
+
+// LineStyle returns the terminal codes that surround the contents of output lines, if any.
+// Stderr lines are highlighted with lib.StderrStyle, if color is set.
+func LineStyle(err, color bool) (start, end string) {
+	if !err || !color || lib.StderrStyle == "" {
+		return "", ""
+	}
+	return "\x1b[" + lib.StderrStyle + "m", "\x1b[0m"
+}
@@ -0,0 +1,75 @@
+package srv
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// containerRuntimes are the runtimes looked up when a proc does not specify one, in order of preference.
+var containerRuntimes = []string{"podman", "docker"}
+
+// containerSeq numbers the containers started by the server, so that their names are unique.
+// A removed container may still hold its name for a while, so restarts and copies of a proc cannot reuse it.
+var containerSeq uint64
+
+// containerCmd returns a command that runs the proc command inside a container of the given image.
+// The working directory is bind mounted at the same path and used as container working directory, along with the proc mounts.
+// The env values are passed by name only, so that they do not show up in the runtime command line.
+func containerCmd(cfg config, env map[string]string, runtime string) (*exec.Cmd, error) {
+	if runtime == "" {
+		for _, name := range containerRuntimes {
+			if _, err := exec.LookPath(name); err == nil {
+				runtime = name
+				break
+			}
+		}
+		if runtime == "" {
+			return nil, errors.New("no container runtime found")
+		}
+	}
+
+	dir, err := filepath.Abs(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	name := "op-" + cfg.runId + "-" + cfg.Name + "-" + strconv.FormatUint(atomic.AddUint64(&containerSeq, 1), 10)
+	args := []string{"run", "--rm", "-i", "--name", name, "-v", dir + ":" + dir, "-w", dir}
+	if cfg.Tty {
+		args = append(args, "-t")
+	}
+	for _, m := range cfg.Mounts {
+		source, err := filepath.Abs(m.Source)
+		if err != nil {
+			return nil, err
+		}
+		v := source + ":" + filepath.Join("/", m.Target)
+		if m.ReadOnly {
+			v += ":ro"
+		}
+		args = append(args, "-v", v)
+	}
+
+	names := make([]string, 0, len(env))
+	for k := range env {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		args = append(args, "-e", k)
+	}
+
+	args = append(args, cfg.Image, cfg.Path)
+	args = append(args, cfg.Args...)
+
+	cmd := exec.Command(runtime, args...)
+	cmd.Dir = cfg.Dir
+	// the runtime itself needs the server environment
+	cmd.Env = append(os.Environ(), envList(env)...)
+	return cmd, nil
+}
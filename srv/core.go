@@ -0,0 +1,129 @@
+package srv
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+// startMux guards the process-wide state that started processes inherit.
+// Starts hold it for reading, while temporary changes of that state, such as a core size limit, hold it for writing,
+// so that no process inherits a state meant for another.
+var startMux sync.RWMutex
+
+// startCmd starts cmd, while no process-wide state is temporarily changed.
+func startCmd(cmd *exec.Cmd) error {
+	startMux.RLock()
+	defer startMux.RUnlock()
+	return cmd.Start()
+}
+
+// startWithCore starts cmd with the core size limit applied, so that the process inherits it.
+// A nil core leaves the limit unchanged. A nil limit means unlimited. The limit is capped by the current hard limit.
+func startWithCore(cmd *exec.Cmd, core *lib.Core) error {
+	if core == nil {
+		return startCmd(cmd)
+	}
+
+	startMux.Lock()
+	defer startMux.Unlock()
+
+	var old syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_CORE, &old); err != nil {
+		return err
+	}
+	size := int64(-1)
+	if core.Limit != nil {
+		size = int64(*core.Limit)
+	}
+	lim := capRlimit(old, size)
+	if err := syscall.Setrlimit(syscall.RLIMIT_CORE, &lim); err != nil {
+		return err
+	}
+	defer syscall.Setrlimit(syscall.RLIMIT_CORE, &old)
+
+	return cmd.Start()
+}
+
+// reportCrash writes a line about a process killed by a signal, and moves its core dump into the configured directory, if any.
+func (x *proc) reportCrash() {
+	state := x.cmd.ProcessState
+	if state == nil {
+		return
+	}
+	ws, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		return
+	}
+
+	msg := x.route + "|" + x.name + ": killed by signal " + ws.Signal().String()
+	if ws.CoreDump() {
+		msg += ", core dumped"
+		if x.core != nil && x.core.Dir != "" {
+			if path, err := x.saveCore(state.Pid()); err != nil {
+				msg += "; core not saved: " + err.Error()
+			} else {
+				msg += " to " + path
+			}
+		}
+	}
+	x.notify.Write([]byte(msg + "\n"))
+}
+
+// saveCore moves the core dump of the given process from its working directory into the core directory.
+// Only core patterns that write into the working directory ("core" or "core.[pid]") are supported.
+func (x *proc) saveCore(pid int) (string, error) {
+	dir := x.cmd.Dir
+	if dir == "" {
+		dir = "."
+	}
+
+	src := ""
+	for _, name := range []string{"core." + strconv.Itoa(pid), "core"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			src = filepath.Join(dir, name)
+			break
+		}
+	}
+	if src == "" {
+		return "", os.ErrNotExist
+	}
+
+	if err := os.MkdirAll(x.core.Dir, 0755); err != nil {
+		return "", err
+	}
+	dst := filepath.Join(x.core.Dir, x.route+"-"+x.name+"-"+x.runId+"-"+strconv.Itoa(pid)+".core")
+	if err := os.Rename(src, dst); err == nil {
+		return dst, nil
+	}
+
+	// rename fails across filesystems
+	if err := copyFile(src, dst); err != nil {
+		return "", err
+	}
+	return dst, os.Remove(src)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
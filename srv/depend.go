@@ -0,0 +1,163 @@
+package srv
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+// addDependencies adds to manifest the routes of all that its routes depend on, transitively.
+// Returns the names of the added routes, or an error if a dependency is not defined or if they form a cycle.
+func addDependencies(manifest, all map[string]lib.Route) (map[string]struct{}, error) {
+	added := make(map[string]struct{})
+
+	// depth first search; a route reached again while still on the stack closes a cycle
+	const (
+		visiting = iota + 1
+		visited
+	)
+	state := make(map[string]int)
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("%s dependency error: cycle", name)
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+
+		for _, dep := range manifest[name].DependsOn {
+			if _, ok := manifest[dep]; !ok {
+				rt, ok := all[dep]
+				if !ok {
+					return fmt.Errorf("%s dependency error: route %s not defined", name, dep)
+				}
+				manifest[dep] = rt
+				added[dep] = struct{}{}
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+
+		state[name] = visited
+		return nil
+	}
+
+	names := make([]string, 0, len(manifest))
+	for name := range manifest {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+
+	return added, nil
+}
+
+// settle marks the route as ready for its dependents: all its processes have succeeded or are running in the background as ready.
+func (x *route) settle() {
+	x.mux.Lock()
+	x.up = true
+	x.mux.Unlock()
+	x.settleOnce.Do(func() {
+		close(x.settled)
+	})
+}
+
+// waitDependencies blocks until all the routes x depends on have settled.
+// Returns an error if one of them terminates before settling, or if x is canceled.
+func (x *route) waitDependencies() error {
+	if len(x.deps) > 0 {
+		x.markStarted()
+	}
+	for _, dep := range x.deps {
+		x.activeSet("waiting for " + dep.name)
+		select {
+		case <-dep.settled:
+		case <-dep.done:
+			select {
+			case <-dep.settled:
+			default:
+				return fmt.Errorf("dependency %s stopped before becoming ready", dep.name)
+			}
+		case <-x.ctx.Done():
+			x.activeSet("canceled")
+			return errors.New("canceled")
+		}
+	}
+	return nil
+}
+
+// killOrdered cancels the given routes and waits for their termination.
+// Each route is only canceled once all the given routes that depend on it have terminated, so that dependencies outlive their dependents.
+// Routes that none of the others depend on are canceled at once.
+func killOrdered(rts []*route) {
+	in := make(map[*route]struct{}, len(rts))
+	for _, rt := range rts {
+		in[rt] = struct{}{}
+	}
+	dependents := make(map[*route][]*route)
+	for _, rt := range rts {
+		for _, dep := range rt.deps {
+			if _, ok := in[dep]; ok && dep != rt {
+				dependents[dep] = append(dependents[dep], rt)
+			}
+		}
+	}
+	// cannot happen with validated dependencies, but must not hang
+	if hasCycle(rts, dependents) {
+		dependents = nil
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(len(rts))
+	for _, rt := range rts {
+		go func(rt *route) {
+			for _, other := range dependents[rt] {
+				<-other.done
+			}
+			rt.kill()
+			<-rt.done
+			wg.Done()
+		}(rt)
+	}
+	wg.Wait()
+}
+
+// hasCycle returns true if the given dependents relation forms a cycle.
+func hasCycle(rts []*route, dependents map[*route][]*route) bool {
+	const (
+		visiting = iota + 1
+		visited
+	)
+	state := make(map[*route]int)
+	var visit func(rt *route) bool
+	visit = func(rt *route) bool {
+		switch state[rt] {
+		case visiting:
+			return true
+		case visited:
+			return false
+		}
+		state[rt] = visiting
+		for _, other := range dependents[rt] {
+			if visit(other) {
+				return true
+			}
+		}
+		state[rt] = visited
+		return false
+	}
+	for _, rt := range rts {
+		if visit(rt) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+// errDetached is returned by detached processes that have been left running on server shutdown.
+var errDetached = errors.New("detached, left running")
+
+// adoptPoll is the interval at which adopted processes are checked for exit.
+const adoptPoll = time.Second
+
+// detachOutput opens the files a detached process writes into directly, since it must outlive the server's pipes.
+// Out and Err are used if they name a single file; otherwise, output goes to a log file in the proc record directory.
+func detachOutput(cfg config, umask int) (stdout, stderr *os.File, files []*os.File, err error) {
+	open := func(sinks lib.Output) (*os.File, error) {
+		if len(sinks) == 1 && sinks[0] != "std" && sinks[0] != "out" && sinks[0] != "syslog" && sinks[0] != "journal" {
+			return createOutput(sinks[0], cfg.Append, umask)
+		}
+		if err := os.MkdirAll(recordDir(), 0700); err != nil {
+			return nil, err
+		}
+		return createOutput(recordDir()+"/"+cfg.runId+"-"+cfg.Name+".log", true, umask)
+	}
+
+	if stdout, err = open(cfg.Out); err != nil {
+		return
+	}
+	files = append(files, stdout)
+
+	if len(cfg.Err) == 0 || len(cfg.Err) == 1 && cfg.Err[0] == "out" {
+		stderr = stdout
+		return
+	}
+	if stderr, err = open(cfg.Err); err != nil {
+		stdout.Close()
+		return nil, nil, nil, err
+	}
+	files = append(files, stderr)
+	return
+}
+
+// executeAdopt registers the detached processes left running by a previous server as active routes, so that they can be listed and killed.
+// If there is an argument, only processes of that route are adopted.
+// Waits for the adopted processes to terminate.
+func (x command) executeAdopt() error {
+	if isDraining() {
+		return errDraining
+	}
+	recs, err := readRecords()
+	if err != nil {
+		return err
+	}
+
+	var detached []procRecord
+	for _, rec := range recs {
+		if !rec.Detached || !rec.orphaned() || rec.Namespace != x.Namespace || x.Route != "" && rec.Route != x.Route {
+			continue
+		}
+		if !rec.running() {
+			rec.remove()
+			continue
+		}
+		detached = append(detached, rec)
+	}
+
+	for _, rt := range adoptRoutes(x.ctx, detached, x.stdout, x.stderr) {
+		<-rt.done
+	}
+	return nil
+}
+
+// adoptRoutes registers the recorded processes as active routes, one per recorded route, and starts supervising them.
+// Returns the routes that have been registered.
+func adoptRoutes(ctx context.Context, recs []procRecord, wout, werr io.Writer) []*route {
+	type key struct{ namespace, route string }
+	groups := make(map[key][]procRecord)
+	var keys []key
+	for _, rec := range recs {
+		k := key{rec.Namespace, rec.Route}
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], rec)
+	}
+
+	var r []*route
+	for _, k := range keys {
+		rt := newRoute(ctx, k.route, lib.Route{Namespace: k.namespace}, nil, wout, werr, werr, false)
+		if err := activeSet(rt); err != nil {
+			werr.Write([]byte(k.route + " adopt error: " + err.Error() + "\n"))
+			continue
+		}
+		for _, rec := range groups[k] {
+			wout.Write([]byte(rec.Route + "|" + rec.Proc + " adopted, pid " + strconv.Itoa(rec.Pid) + "\n"))
+		}
+		go rt.adopt(groups[k])
+		r = append(r, rt)
+	}
+	return r
+}
+
+// adopt supervises processes started by a previous server, until they exit or the route is canceled.
+// The processes are not children of the server, so their exit is detected by polling.
+// The route must already be active.
+func (x *route) adopt(recs []procRecord) {
+	x.start = recs[0].Start
+	defer func() {
+		activeRemove(x.namespace, x.name)
+		close(x.done)
+		x.kill()
+	}()
+
+	t := time.NewTicker(adoptPoll)
+	defer t.Stop()
+	for len(recs) > 0 {
+		s := recs[0].Proc + " (adopted)"
+		for _, rec := range recs[1:] {
+			s += " +" + rec.Proc
+		}
+		x.activeSet(s)
+
+		select {
+		case <-t.C:
+			var left []procRecord
+			for _, rec := range recs {
+				if rec.running() {
+					left = append(left, rec)
+				} else {
+					rec.remove()
+				}
+			}
+			recs = left
+		case <-x.ctx.Done():
+			wg := sync.WaitGroup{}
+			for _, rec := range recs {
+				// detached processes are left running again on server shutdown
+				if rec.Detached && mainCtx.Err() != nil {
+					continue
+				}
+				wg.Add(1)
+				go func(rec procRecord) {
+					terminatePid(rec.Pid, x.name+"|"+rec.Proc)
+					rec.remove()
+					wg.Done()
+				}(rec)
+			}
+			wg.Wait()
+			return
+		}
+	}
+}
+
+// terminatePid interrupts a process that is not a child of the server, killing it if it is still alive after the grace period.
+func terminatePid(pid int, desc string) {
+	syscall.Kill(pid, syscall.SIGINT)
+
+	t := time.NewTicker(adoptPoll / 10)
+	defer t.Stop()
+	deadline := time.Now().Add(killGrace)
+	for alive(pid) {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			recordForced(desc)
+			return
+		}
+		<-t.C
+	}
+}
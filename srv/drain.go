@@ -0,0 +1,65 @@
+package srv
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	drainCh   = make(chan struct{}) // closed once the server is draining
+	drainOnce sync.Once
+)
+
+// errDraining is returned by commands that would start runs while the server is draining.
+var errDraining = errors.New("server is draining; not accepting new runs")
+
+// isDraining returns true if the server no longer accepts new runs.
+func isDraining() bool {
+	select {
+	case <-drainCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// executeDrain stops the server from accepting new runs, waits for all active routes to terminate, then shuts it down.
+// Restart policies no longer apply while draining, so restarting routes terminate after their current run.
+// If the command is canceled before that, the server keeps draining, but does not shut down on its own.
+func (x command) executeDrain() {
+	drainOnce.Do(func() { close(drainCh) })
+
+	last := ""
+	for {
+		var rts []*route
+		activeRangeAll(func(rt *route) {
+			rts = append(rts, rt)
+		})
+		if len(rts) == 0 {
+			break
+		}
+
+		names := make([]string, len(rts))
+		for i, rt := range rts {
+			names[i] = rt.namespace + ":" + rt.name
+		}
+		sort.Strings(names)
+		if s := strings.Join(names, ", "); s != last {
+			x.stderr.Write([]byte("draining; waiting for " + s + "\n"))
+			last = s
+		}
+
+		for _, rt := range rts {
+			select {
+			case <-rt.done:
+			case <-x.ctx.Done():
+				return
+			}
+		}
+	}
+
+	x.stderr.Write([]byte("drained; shutting down\n"))
+	x.executeExit()
+}
@@ -0,0 +1,203 @@
+package srv
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+// logLevels ranks the level names recognized in output lines.
+var logLevels = map[string]int{
+	"trace":    0,
+	"debug":    1,
+	"info":     2,
+	"notice":   2,
+	"warn":     3,
+	"warning":  3,
+	"err":      4,
+	"error":    4,
+	"crit":     5,
+	"critical": 5,
+	"fatal":    5,
+	"panic":    5,
+}
+
+// levelWords matches the level names of logLevels.
+const levelWords = `(trace|debug|info|notice|warn|warning|err|error|crit|critical|fatal|panic)`
+
+// levelRe detects the level of common log formats: logfmt and JSON level fields, bracketed levels, and level words leading the line, possibly after a timestamp.
+// Level words elsewhere in the line are part of the message, and are ignored.
+var levelRe = regexp.MustCompile(`(?i)` +
+	`(?:^|\W)level"?\s*[=:]\s*"?` + levelWords + `\b` +
+	`|\[\s*` + levelWords + `\s*\]` +
+	`|^(?:\d[\d\-:T./,+Z]*\s+){0,2}` + levelWords + `\b`)
+
+// levelScan is the length of the line start searched for a level.
+const levelScan = 128
+
+// detectLevel returns the rank of the level of an output line, or -1 if none is found.
+func detectLevel(line []byte) int {
+	if len(line) > levelScan {
+		line = line[:levelScan]
+	}
+	m := levelRe.FindSubmatch(line)
+	if m == nil {
+		return -1
+	}
+	for _, s := range m[1:] {
+		if s != nil {
+			return logLevels[strings.ToLower(string(s))]
+		}
+	}
+	return -1
+}
+
+// A logFilter is a compiled lib.LogFilter.
+type logFilter struct {
+	drop    []*regexp.Regexp
+	level   int  // minimum rank of kept lines; -1 keeps all
+	repeats bool // collapse identical consecutive lines
+}
+
+func compileLogFilter(cfg lib.LogFilter) (*logFilter, error) {
+	x := &logFilter{level: -1, repeats: cfg.CollapseRepeats}
+	for _, s := range cfg.Drop {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, err
+		}
+		x.drop = append(x.drop, re)
+	}
+	if cfg.Level != "" {
+		rank, ok := logLevels[strings.ToLower(cfg.Level)]
+		if !ok {
+			return nil, errors.New("unknown level " + cfg.Level)
+		}
+		x.level = rank
+	}
+	return x, nil
+}
+
+// keep returns true if the line, or record, passes the filter.
+func (x *logFilter) keep(b []byte) bool {
+	first := b
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		first = b[:i]
+	}
+	first = bytes.TrimRight(first, "\r")
+	for _, re := range x.drop {
+		if re.Match(first) {
+			return false
+		}
+	}
+	if x.level >= 0 {
+		if rank := detectLevel(first); rank >= 0 && rank < x.level {
+			return false
+		}
+	}
+	return true
+}
+
+// repeatReport is the minimum interval between reports of a line that keeps repeating.
+const repeatReport = time.Second
+
+// A filter drops unwanted lines before they reach the destination, and optionally collapses repeated ones.
+// If records is set, each write is a whole record, judged by its first line; otherwise, lines are judged one by one.
+type filter struct {
+	dst     io.Writer
+	lf      *logFilter
+	records bool
+
+	part []byte // incomplete line
+
+	last     []byte    // last forwarded line, if collapsing repeats
+	repeats  int       // unreported repeats of last
+	reported time.Time // last report of repeats
+}
+
+func (x *filter) Write(b []byte) (int, error) {
+	var r []byte
+	if x.records {
+		r = x.pass(r, b)
+	} else {
+		x.part = append(x.part, b...)
+		for {
+			i := bytes.IndexByte(x.part, '\n')
+			if i < 0 {
+				break
+			}
+			r = x.pass(r, x.part[:i+1])
+			x.part = x.part[i+1:]
+		}
+		// the remaining part must not alias the next write
+		x.part = append([]byte(nil), x.part...)
+	}
+
+	if len(r) > 0 {
+		if _, err := x.dst.Write(r); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// pass appends the line, or record, to r if it passes the filter.
+// Repeats of the previous line are counted instead, and reported once a different line arrives, or at most every repeatReport.
+func (x *filter) pass(r, b []byte) []byte {
+	if !x.lf.keep(b) {
+		return r
+	}
+	if !x.lf.repeats {
+		return append(r, b...)
+	}
+
+	if bytes.Equal(b, x.last) {
+		x.repeats++
+		if time.Since(x.reported) >= repeatReport {
+			r = x.appendRepeats(r)
+		}
+		return r
+	}
+	r = x.appendRepeats(r)
+	x.last = append(x.last[:0], b...)
+	x.reported = time.Now()
+	return append(r, b...)
+}
+
+// appendRepeats appends a report of the unreported repeats to r, if any.
+func (x *filter) appendRepeats(r []byte) []byte {
+	x.reported = time.Now()
+	if x.repeats == 0 {
+		return r
+	}
+	msg := "last message repeated " + strconv.Itoa(x.repeats) + " times\n"
+	if x.repeats == 1 {
+		msg = "last message repeated once\n"
+	}
+	x.repeats = 0
+	return append(r, msg...)
+}
+
+// Flush forwards the incomplete line, if it passes the filter, and reports pending repeats.
+func (x *filter) Flush() error {
+	var r []byte
+	if len(x.part) > 0 {
+		r = x.pass(r, x.part)
+		x.part = nil
+	}
+	if len(r) > 0 && r[len(r)-1] != '\n' && x.repeats > 0 {
+		r = append(r, '\n')
+	}
+	r = x.appendRepeats(r)
+	if len(r) == 0 {
+		return nil
+	}
+	_, err := x.dst.Write(r)
+	return err
+}
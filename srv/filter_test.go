@@ -0,0 +1,79 @@
+package srv
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+func TestDetectLevel(t *testing.T) {
+	tests := []struct {
+		line string
+		want int
+	}{
+		{"plain message", -1},
+		{"INFO starting", 2},
+		{"2024-01-01T10:00:00Z WARN disk low", 3},
+		{"2024/01/01 10:00:00 error: failed", 4},
+		{"[debug] connecting", 1},
+		{"[ ERROR ] failed", 4},
+		{`time=10:00 level=warning msg="disk low"`, 3},
+		{`{"level":"fatal","msg":"bye"}`, 5},
+		{`{"msg":"x", "level": "trace"}`, 0},
+		{"info: information", 2},
+		{"infos are not levels", -1},
+	}
+	for _, test := range tests {
+		if got := detectLevel([]byte(test.line)); got != test.want {
+			t.Errorf("%q: got %d, want %d", test.line, got, test.want)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	tests := []struct {
+		cfg     lib.LogFilter
+		records bool
+		writes  []string
+		want    string
+	}{
+		{lib.LogFilter{Drop: []string{"^health"}}, false, []string{"a\nhealth ok\n", "b\n"}, "a\nb\n"},
+		{lib.LogFilter{Drop: []string{"x"}}, false, []string{"a", "x\nb", "\nc"}, "b\nc"},
+		{lib.LogFilter{Level: "warn"}, false, []string{"INFO a\nWARN b\nplain\nERROR c\n"}, "WARN b\nplain\nERROR c\n"},
+		{lib.LogFilter{Level: "error"}, true, []string{"WARN a\n  at x\n", "ERROR b\n  at y\n"}, "ERROR b\n  at y\n"},
+		{lib.LogFilter{CollapseRepeats: true}, false, []string{"a\na\na\nb\nb\nc\n"}, "a\nlast message repeated 2 times\nb\nlast message repeated once\nc\n"},
+		{lib.LogFilter{CollapseRepeats: true}, false, []string{"a\na\na"}, "a\nlast message repeated once\na"},
+		{lib.LogFilter{CollapseRepeats: true}, false, []string{"a\n", "a\n"}, "a\nlast message repeated once\n"},
+	}
+	for i, test := range tests {
+		lf, err := compileLogFilter(test.cfg)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		var buf bytes.Buffer
+		x := &filter{dst: &buf, lf: lf, records: test.records}
+		for _, s := range test.writes {
+			if n, err := x.Write([]byte(s)); n != len(s) || err != nil {
+				t.Fatalf("%d: write returned %d, %v", i, n, err)
+			}
+		}
+		if err := x.Flush(); err != nil {
+			t.Fatalf("%d: flush error: %v", i, err)
+		}
+		if buf.String() != test.want {
+			t.Errorf("%d: got %q, want %q", i, buf.String(), test.want)
+		}
+	}
+}
+
+func TestCompileLogFilterErrors(t *testing.T) {
+	for _, cfg := range []lib.LogFilter{
+		{Drop: []string{"("}},
+		{Level: "loud"},
+	} {
+		if _, err := compileLogFilter(cfg); err == nil {
+			t.Errorf("%+v: no error", cfg)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package srv
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// groupIdle is the duration after which a pending record is forwarded, if no new lines arrive.
+const groupIdle = 200 * time.Millisecond
+
+// groupMax is the record length past which a record is forwarded without waiting for its end, to bound memory.
+// Its remaining lines form a record of their own.
+const groupMax = 1 << 20
+
+// A flusher holds buffered output.
+type flusher interface {
+	Flush() error
+}
+
+// A grouper merges continuation lines into the preceding record, forwarding each record in a single write.
+// Records are forwarded when the next one starts, after an idle period, or once they grow past groupMax.
+type grouper struct {
+	dst io.Writer
+	re  *regexp.Regexp
+
+	mux   sync.Mutex
+	rec   []byte // complete lines of the current record
+	part  []byte // incomplete line
+	timer *time.Timer
+}
+
+func newGrouper(w io.Writer, re *regexp.Regexp) *grouper {
+	return &grouper{
+		dst: w,
+		re:  re,
+	}
+}
+
+func (x *grouper) Write(b []byte) (int, error) {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+
+	var err error
+	x.part = append(x.part, b...)
+	for {
+		i := bytes.IndexByte(x.part, '\n')
+		if i < 0 {
+			break
+		}
+		line := x.part[:i+1]
+		if len(x.rec) > 0 && !x.re.Match(bytes.TrimRight(line, "\r\n")) {
+			if e := x.forward(); e != nil {
+				err = e
+			}
+		}
+		x.rec = append(x.rec, line...)
+		x.part = x.part[i+1:]
+		if len(x.rec) >= groupMax {
+			if e := x.forward(); e != nil {
+				err = e
+			}
+		}
+	}
+
+	if x.timer != nil {
+		x.timer.Stop()
+	}
+	if len(x.rec) > 0 {
+		x.timer = time.AfterFunc(groupIdle, func() {
+			x.mux.Lock()
+			x.forward()
+			x.mux.Unlock()
+		})
+	}
+
+	return len(b), err
+}
+
+// forward writes the current record to the destination.
+func (x *grouper) forward() error {
+	if len(x.rec) == 0 {
+		return nil
+	}
+	_, err := x.dst.Write(x.rec)
+	x.rec = x.rec[:0]
+	return err
+}
+
+// Flush forwards all pending output, including incomplete lines.
+func (x *grouper) Flush() error {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+
+	if x.timer != nil {
+		x.timer.Stop()
+	}
+	x.rec = append(x.rec, x.part...)
+	x.part = x.part[:0]
+	return x.forward()
+}
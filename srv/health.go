@@ -0,0 +1,111 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+// Health check defaults.
+const (
+	healthInterval = 10 * time.Second
+	healthFailures = 3
+)
+
+// watchHealth runs the process health check periodically, until it exits.
+// After too many consecutive failures, the process is interrupted and marked as unhealthy, so that its exit counts as a failure.
+func (x *proc) watchHealth() {
+	hc := *x.health
+	interval := time.Duration(hc.Interval)
+	if interval <= 0 {
+		interval = healthInterval
+	}
+	timeout := time.Duration(hc.Timeout)
+	if timeout <= 0 {
+		timeout = interval
+	}
+	max := hc.Failures
+	if max <= 0 {
+		max = healthFailures
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-x.done:
+			return
+		case <-t.C:
+		}
+
+		err := x.checkHealth(hc, timeout)
+		if err == nil {
+			failures = 0
+			continue
+		}
+		if isDone(x.done) {
+			return
+		}
+		failures++
+		x.notify.Write([]byte(x.route + "|" + x.name + " health check failed (" + strconv.Itoa(failures) + "/" + strconv.Itoa(max) + "): " + err.Error() + "\n"))
+		if failures < max {
+			continue
+		}
+
+		x.mux.Lock()
+		x.unhealthy = err.Error()
+		x.mux.Unlock()
+		x.cancel()
+		return
+	}
+}
+
+// checkHealth runs a single health check, bounded by timeout.
+func (x *proc) checkHealth(hc lib.HealthCheck, timeout time.Duration) error {
+	switch {
+	case len(hc.Cmd) > 0:
+		ctx, cancel := context.WithTimeout(x.routeCtx, timeout)
+		defer cancel()
+		cmd := exec.Command(hc.Cmd[0], hc.Cmd[1:]...)
+		cmd.Env = x.cmd.Env
+		cmd.Dir = x.cmd.Dir
+		// a check that outlives its timeout has failed, so there is no point in waiting for it to clean up
+		err := runCancelable(ctx, cmd, 0, x.route+"|"+x.name+" health check")
+		if err != nil && ctx.Err() == context.DeadlineExceeded {
+			return errors.New("timed out after " + timeout.String())
+		}
+		return err
+	case hc.Tcp != "" || hc.Http != "":
+		if !checkProbe(x, lib.Probe{Tcp: hc.Tcp, Http: hc.Http}, timeout) {
+			return errors.New("no response")
+		}
+		return nil
+	}
+	return errors.New("no check defined")
+}
+
+// unhealthyError returns the error of a process interrupted by its health check, or nil.
+func (x *proc) unhealthyError() error {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	if x.unhealthy == "" {
+		return nil
+	}
+	return errors.New("unhealthy: " + x.unhealthy)
+}
+
+// isDone returns true if ch is closed.
+func isDone(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
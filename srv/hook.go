@@ -0,0 +1,100 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+// runHooks executes the given hooks in order, with prefixed output.
+// Failures of non-fatal hooks are only reported; the first fatal failure is returned.
+// A running hook is interrupted when ctx is done.
+func runHooks(ctx context.Context, hooks []lib.Hook, env []string, dir, prefix string, wout, werr io.Writer) error {
+	for i, hook := range hooks {
+		if err := runHook(ctx, hook, env, dir, prefix, wout, werr); err != nil {
+			if hook.Fatal {
+				return err
+			}
+			werr.Write([]byte(fmt.Sprintf("%s %d warning: %v\n", prefix, i, err)))
+		}
+	}
+	return nil
+}
+
+func runHook(ctx context.Context, hook lib.Hook, env []string, dir, prefix string, wout, werr io.Writer) error {
+	if len(hook.Cmd) == 0 {
+		return errors.New("no command defined")
+	}
+
+	p := []byte(prefix + ": ")
+	cmd := exec.Command(hook.Cmd[0], hook.Cmd[1:]...)
+	cmd.Env = env
+	cmd.Dir = dir
+	pout, perr := newPrefixer(p, wout), newPrefixer(p, werr)
+	cmd.Stdout = capLines(pout, 0)
+	cmd.Stderr = capLines(perr, 0)
+	err := runCancelable(ctx, cmd, killGrace, prefix)
+	pout.Flush()
+	perr.Flush()
+	return err
+}
+
+// baseEnv returns the given env, overlaid on top of the server environment if inherit is set.
+// Otherwise, only the server envs named in pass are used as base.
+func baseEnv(inherit *bool, pass []string, env map[string]string) map[string]string {
+	server := make(map[string]string)
+	if inherit != nil && *inherit {
+		for _, kv := range os.Environ() {
+			if i := strings.IndexByte(kv, '='); i > 0 {
+				server[kv[:i]] = kv[i+1:]
+			}
+		}
+	} else {
+		for _, k := range pass {
+			if v, ok := os.LookupEnv(k); ok {
+				server[k] = v
+			}
+		}
+	}
+	return merge(env, server)
+}
+
+// metaEnv returns the env values that describe the orchestration context of a process.
+func metaEnv(namespace, route, proc, runId string) map[string]string {
+	return map[string]string{
+		"OP_NAMESPACE":  namespace,
+		"OP_ROUTE":      route,
+		"OP_PROC":       proc,
+		"OP_RUN_ID":     runId,
+		"OP_SERVER_PID": strconv.Itoa(os.Getpid()),
+	}
+}
+
+// envList converts an env map to the "key=value" form.
+func envList(m map[string]string) []string {
+	r := make([]string, 0, len(m))
+	for k, v := range m {
+		r = append(r, k+"="+v)
+	}
+	return r
+}
+
+// merge returns a new map containing the keys of both maps.
+// Keys that exist in both take their value from dst.
+func merge(dst, src map[string]string) map[string]string {
+	r := make(map[string]string, len(dst)+len(src))
+	for k, v := range src {
+		r[k] = v
+	}
+	for k, v := range dst {
+		r[k] = v
+	}
+	return r
+}
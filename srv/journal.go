@@ -0,0 +1,104 @@
+package srv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+)
+
+// journalSocket is the native protocol socket of systemd-journald.
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalLineMax is the length past which lines are truncated, so that entries fit in a single datagram.
+// Larger datagrams fail with EMSGSIZE under the default socket buffer sizes.
+const journalLineMax = 48 << 10
+
+// A journalSink forwards output lines to systemd-journald, one entry per line.
+// Entries are tagged with the "op" identifier, and carry the namespace, route and proc as fields.
+// Lines that fail to be sent are dropped, without holding back the following ones.
+type journalSink struct {
+	conn   *net.UnixConn
+	fields []byte // common fields, in native protocol format
+	part   []byte
+}
+
+func newJournalSink(namespace, route, proc string, err bool) (*journalSink, error) {
+	conn, e := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if e != nil {
+		return nil, e
+	}
+
+	priority := 6 // info
+	if err {
+		priority = 3 // err
+	}
+	var b []byte
+	b = appendJournalField(b, "PRIORITY", strconv.Itoa(priority))
+	b = appendJournalField(b, "SYSLOG_IDENTIFIER", "op")
+	b = appendJournalField(b, "OP_NAMESPACE", namespace)
+	b = appendJournalField(b, "OP_ROUTE", route)
+	b = appendJournalField(b, "OP_PROC", proc)
+	return &journalSink{conn: conn, fields: b}, nil
+}
+
+// appendJournalField appends a field in native protocol format.
+// Values that contain newlines are length prefixed.
+func appendJournalField(b []byte, key, value string) []byte {
+	if !bytes.ContainsRune([]byte(value), '\n') {
+		b = append(b, key...)
+		b = append(b, '=')
+		b = append(b, value...)
+		return append(b, '\n')
+	}
+	b = append(b, key...)
+	b = append(b, '\n')
+	var n [8]byte
+	binary.LittleEndian.PutUint64(n[:], uint64(len(value)))
+	b = append(b, n[:]...)
+	b = append(b, value...)
+	return append(b, '\n')
+}
+
+func (x *journalSink) Write(b []byte) (int, error) {
+	var err error
+	x.part = append(x.part, b...)
+	for {
+		i := bytes.IndexByte(x.part, '\n')
+		if i < 0 {
+			break
+		}
+		line := x.part[:i]
+		x.part = x.part[i+1:]
+		// a failed line must not hold back the following ones
+		if e := x.send(line); e != nil && err == nil {
+			err = e
+		}
+	}
+	x.part = append([]byte(nil), x.part...)
+	return len(b), err
+}
+
+func (x *journalSink) send(line []byte) error {
+	line = bytes.TrimRight(line, "\r")
+	if len(line) > journalLineMax {
+		line = append(line[:journalLineMax:journalLineMax], " ...[truncated "+strconv.Itoa(len(line)-journalLineMax)+" bytes]"...)
+	}
+	msg := appendJournalField(append([]byte(nil), x.fields...), "MESSAGE", string(line))
+	_, err := x.conn.Write(msg)
+	return err
+}
+
+// Flush sends the incomplete line, if any.
+func (x *journalSink) Flush() error {
+	if len(x.part) == 0 {
+		return nil
+	}
+	err := x.send(x.part)
+	x.part = nil
+	return err
+}
+
+func (x *journalSink) Close() error {
+	return x.conn.Close()
+}
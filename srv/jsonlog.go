@@ -0,0 +1,93 @@
+package srv
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+// A jsonLiner writes each line of process output as a JSON object on its own line.
+// Buffers the current line until it is terminated, or flushed.
+type jsonLiner struct {
+	dst  io.Writer
+	line lib.LogLine
+	buf  []byte
+}
+
+func newJsonLiner(w io.Writer, namespace, route, proc string, err bool) *jsonLiner {
+	stream := "out"
+	if err {
+		stream = "err"
+	}
+	return &jsonLiner{
+		dst: w,
+		line: lib.LogLine{
+			Namespace: namespace,
+			Route:     route,
+			Proc:      proc,
+			Stream:    stream,
+		},
+	}
+}
+
+func (x *jsonLiner) Write(b []byte) (int, error) {
+	var r []byte
+	for rest := b; len(rest) > 0; {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			x.buf = append(x.buf, rest...)
+			break
+		}
+		x.buf = append(x.buf, rest[:i]...)
+		r = x.encode(r)
+		rest = rest[i+1:]
+	}
+	if len(r) == 0 {
+		return len(b), nil
+	}
+	if _, err := x.dst.Write(r); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// encode appends the JSON form of the buffered line to r, and clears the buffer.
+func (x *jsonLiner) encode(r []byte) []byte {
+	r = appendJsonLine(r, x.line, x.buf, time.Now())
+	x.buf = x.buf[:0]
+	return r
+}
+
+// Flush writes the current unterminated line, if any.
+func (x *jsonLiner) Flush() error {
+	if len(x.buf) == 0 {
+		return nil
+	}
+	_, err := x.dst.Write(x.encode(nil))
+	return err
+}
+
+// appendJsonLine appends the JSON form of a line of output to r, followed by a newline.
+func appendJsonLine(r []byte, line lib.LogLine, text []byte, t time.Time) []byte {
+	line.Time = t
+	line.Line = string(text)
+	b, _ := json.Marshal(line) // cannot fail
+	r = append(r, b...)
+	return append(r, '\n')
+}
+
+// newClientWriter returns the writer through which the output of a process stream reaches w, in the server's output format.
+// color applies to prefixes, and to stderr lines.
+func newClientWriter(w io.Writer, namespace, route, proc string, err, color bool) io.Writer {
+	if lib.LogFormat == lib.FormatJson {
+		return newJsonLiner(w, namespace, route, proc, err)
+	}
+	p := newPrefixer([]byte(LinePrefix(route, proc, color)), w)
+	if start, end := LineStyle(err, color); start != "" {
+		p.start, p.end = []byte(start), []byte(end)
+	}
+	return p
+}
@@ -0,0 +1,117 @@
+package srv
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+// routeSlots limits the number of routes running at once to lib.MaxConcurrentRoutes.
+// Routes over the limit wait in order of arrival.
+var routeSlots = struct {
+	sync.Mutex
+	used  int
+	queue []*route
+}{}
+
+// acquireSlot blocks until the route may run under the server's route limit.
+// Returns an error if the route is canceled while queued.
+func (x *route) acquireSlot() error {
+	if lib.MaxConcurrentRoutes <= 0 {
+		return nil
+	}
+
+	routeSlots.Lock()
+	if routeSlots.used < lib.MaxConcurrentRoutes {
+		routeSlots.used++
+		routeSlots.Unlock()
+		return nil
+	}
+	x.slot = make(chan struct{})
+	routeSlots.queue = append(routeSlots.queue, x)
+	routeSlots.Unlock()
+
+	x.activeSet("queued")
+	x.markStarted()
+	select {
+	case <-x.slot:
+		return nil
+	case <-x.ctx.Done():
+	}
+
+	routeSlots.Lock()
+	defer routeSlots.Unlock()
+	for i, rt := range routeSlots.queue {
+		if rt == x {
+			routeSlots.queue = append(routeSlots.queue[:i], routeSlots.queue[i+1:]...)
+			x.activeSet("canceled")
+			return errors.New("canceled")
+		}
+	}
+	// the slot was handed over concurrently with the cancellation
+	return nil
+}
+
+// releaseSlot hands the route's slot over to the first queued route, if any.
+func (x *route) releaseSlot() {
+	if lib.MaxConcurrentRoutes <= 0 {
+		return
+	}
+
+	routeSlots.Lock()
+	defer routeSlots.Unlock()
+	if len(routeSlots.queue) == 0 {
+		routeSlots.used--
+		return
+	}
+	next := routeSlots.queue[0]
+	routeSlots.queue = routeSlots.queue[1:]
+	close(next.slot)
+	stateChanged() // queue positions moved
+}
+
+// queueString describes the position of the route in the slot queue, for listings.
+// Returns an empty string if it is not queued.
+func (x *route) queueString() string {
+	routeSlots.Lock()
+	defer routeSlots.Unlock()
+	for i, rt := range routeSlots.queue {
+		if rt == x {
+			return " (position " + strconv.Itoa(i+1) + " of " + strconv.Itoa(len(routeSlots.queue)) + ")"
+		}
+	}
+	return ""
+}
+
+// procSlots limits the number of processes running at once to lib.MaxConcurrentProcs; nil if unlimited.
+// Processes over the limit wait in order of arrival.
+var procSlots chan struct{}
+
+func init() {
+	if lib.MaxConcurrentProcs > 0 {
+		procSlots = make(chan struct{}, lib.MaxConcurrentProcs)
+	}
+}
+
+// acquireProcSlot blocks until the process may start under the server's process limit.
+// Returns errCanceled if the process is canceled while waiting.
+func (x *proc) acquireProcSlot() error {
+	if procSlots == nil {
+		return nil
+	}
+	select {
+	case procSlots <- struct{}{}:
+		return nil
+	case <-x.done:
+		return errCanceled
+	}
+}
+
+// releaseProcSlot frees a slot taken by acquireProcSlot.
+func releaseProcSlot() {
+	if procSlots != nil {
+		<-procSlots
+	}
+}
@@ -0,0 +1,369 @@
+package srv
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+// A logLine is a line of process output kept in memory.
+type logLine struct {
+	seq  uint64 // server-wide order of arrival
+	time time.Time
+	proc string
+	err  bool // written to stderr
+	text []byte
+}
+
+// A logRing holds the most recent lines of a single process stream, up to a total size.
+type logRing struct {
+	lines []logLine
+	size  int
+}
+
+// A logBuffer keeps the recent output of a route's processes, across restarts.
+type logBuffer struct {
+	mux   sync.Mutex
+	rings map[string]*logRing // by proc name and stream
+	subs  map[*logSub]struct{}
+}
+
+// A logSub receives the lines added to a log buffer, as they arrive.
+type logSub struct {
+	proc    string       // only lines of this process and its copies; all if empty
+	ch      chan logLine // lines are dropped if full, rather than blocking output
+	dropped uint64       // lines dropped since the last delivered one; accessed atomically
+}
+
+// logSubBuffer is the number of lines a slow follower may lag behind before lines are dropped.
+const logSubBuffer = 1024
+
+// logSeq orders lines across all buffers.
+var logSeq uint64
+
+// logBuffers holds the output of the active routes and of the last run of finished ones still in the history, by namespace and active name.
+var logBuffers = struct {
+	sync.Mutex
+	m map[string]*logBuffer
+}{m: make(map[string]*logBuffer)}
+
+// logBufferReset clears the output buffer of the named route, for a new run.
+// Subscribers are kept.
+func logBufferReset(namespace, name string) {
+	buf := logBufferGet(namespace, name)
+	buf.mux.Lock()
+	buf.rings = make(map[string]*logRing)
+	buf.mux.Unlock()
+}
+
+// logBufferGet returns the output buffer of the named route, creating it if needed.
+func logBufferGet(namespace, name string) *logBuffer {
+	logBuffers.Lock()
+	defer logBuffers.Unlock()
+	key := namespace + "|" + name
+	buf, ok := logBuffers.m[key]
+	if !ok {
+		buf = newLogBuffer()
+		logBuffers.m[key] = buf
+	}
+	return buf
+}
+
+// logBuffersPrune removes the buffers of the routes that are neither active nor in the history, unless they are being followed.
+func logBuffersPrune() {
+	logBuffers.Lock()
+	defer logBuffers.Unlock()
+	for key, buf := range logBuffers.m {
+		i := strings.IndexByte(key, '|')
+		namespace, name := key[:i], key[i+1:]
+		if _, ok := activeGet(namespace, name); ok {
+			continue
+		}
+		if _, ok := historyLast(namespace, name); ok {
+			continue
+		}
+		buf.mux.Lock()
+		followed := len(buf.subs) > 0
+		buf.mux.Unlock()
+		if !followed {
+			delete(logBuffers.m, key)
+		}
+	}
+}
+
+func newLogBuffer() *logBuffer {
+	return &logBuffer{
+		rings: make(map[string]*logRing),
+		subs:  make(map[*logSub]struct{}),
+	}
+}
+
+// add stores a line of the given process stream, evicting the oldest lines of that stream past the size limit.
+func (x *logBuffer) add(proc string, err bool, text []byte) {
+	max := int(lib.LogBufferSize)
+	if len(text) > max {
+		text = text[:max]
+	}
+	line := logLine{
+		seq:  atomic.AddUint64(&logSeq, 1),
+		time: time.Now(),
+		proc: proc,
+		err:  err,
+		text: append([]byte(nil), text...),
+	}
+
+	key := proc + "|out"
+	if err {
+		key = proc + "|err"
+	}
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	r, ok := x.rings[key]
+	if !ok {
+		r = &logRing{}
+		x.rings[key] = r
+	}
+	r.lines = append(r.lines, line)
+	r.size += len(line.text)
+	n := 0
+	for r.size > max {
+		r.size -= len(r.lines[n].text)
+		n++
+	}
+	if n > 0 {
+		r.lines = append(r.lines[:0:0], r.lines[n:]...)
+	}
+
+	for sub := range x.subs {
+		if !sub.match(proc) {
+			continue
+		}
+		select {
+		case sub.ch <- line:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+// match returns true if the subscriber wants the lines of the named process.
+func (x *logSub) match(proc string) bool {
+	return matchProc(x.proc, proc)
+}
+
+// matchProc returns true if name is the given process or one of its copies, or if proc is empty.
+func matchProc(proc, name string) bool {
+	return proc == "" || name == proc || strings.HasPrefix(name, proc+"#")
+}
+
+// subscribe returns the kept lines, like snapshot, along with a subscriber receiving all further lines.
+// The subscriber must be removed through unsubscribe.
+func (x *logBuffer) subscribe(proc string) ([]logLine, *logSub) {
+	sub := &logSub{
+		proc: proc,
+		ch:   make(chan logLine, logSubBuffer),
+	}
+	x.mux.Lock()
+	x.subs[sub] = struct{}{}
+	lines := x.collect(proc)
+	x.mux.Unlock()
+	return lines, sub
+}
+
+func (x *logBuffer) unsubscribe(sub *logSub) {
+	x.mux.Lock()
+	delete(x.subs, sub)
+	x.mux.Unlock()
+}
+
+// snapshot returns the kept lines of the named process, or of all processes if proc is empty, in order of arrival.
+// Copies of a process are included along with it.
+func (x *logBuffer) snapshot(proc string) []logLine {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	return x.collect(proc)
+}
+
+// collect implements snapshot, with x locked.
+func (x *logBuffer) collect(proc string) []logLine {
+	var r []logLine
+	for _, ring := range x.rings {
+		for _, line := range ring.lines {
+			if matchProc(proc, line.proc) {
+				r = append(r, line)
+			}
+		}
+	}
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].seq < r[j].seq
+	})
+	return r
+}
+
+// A logTap copies the lines written through it into a log buffer, and to the log shipper.
+type logTap struct {
+	dst       io.Writer
+	buf       *logBuffer // nil if output is not kept in memory
+	archive   *archive   // nil if runs are not archived
+	namespace string
+	route     string
+	proc      string
+	err       bool
+	max       int // overlong lines are cut
+
+	partial []byte // current unterminated line
+}
+
+func newLogTap(w io.Writer, runId, namespace, route, proc string, err bool) *logTap {
+	x := &logTap{
+		dst:       w,
+		namespace: namespace,
+		route:     route,
+		proc:      proc,
+		err:       err,
+		max:       shipLineMax,
+	}
+	if lib.LogBufferSize > 0 {
+		x.buf = logBufferGet(namespace, route)
+		x.max = int(lib.LogBufferSize)
+	}
+	if lib.RunRetention > 0 {
+		x.archive = newArchive(runId, namespace, route, proc, err)
+	}
+	return x
+}
+
+// add hands over a complete line.
+func (x *logTap) add(text []byte) {
+	if x.buf != nil {
+		x.buf.add(x.proc, x.err, text)
+	}
+	if logShipper != nil {
+		logShipper.add(x.namespace, x.route, x.proc, x.err, text)
+	}
+	if x.archive != nil {
+		x.archive.add(text)
+	}
+}
+
+func (x *logTap) Write(b []byte) (int, error) {
+	for rest := b; len(rest) > 0; {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			x.partial = append(x.partial, rest...)
+			// overlong lines are cut, to bound memory
+			if len(x.partial) >= x.max {
+				x.Flush()
+			}
+			break
+		}
+		if len(x.partial) > 0 {
+			x.partial = append(x.partial, rest[:i]...)
+			x.add(x.partial)
+			x.partial = x.partial[:0]
+		} else {
+			x.add(rest[:i])
+		}
+		rest = rest[i+1:]
+	}
+	return x.dst.Write(b)
+}
+
+// Flush hands over the current unterminated line, if any, and closes the archive file.
+func (x *logTap) Flush() error {
+	if len(x.partial) > 0 {
+		x.add(x.partial)
+		x.partial = x.partial[:0]
+	}
+	if x.archive != nil {
+		x.archive.close()
+	}
+	return nil
+}
+
+// executeLogs writes the kept output of the target route, or of one of its processes, to the client.
+// Lines are prefixed as they were when the route ran, and written to the stream they came from.
+// When following, the output of an active route keeps being streamed until it terminates or the client cancels.
+func (x command) executeLogs() error {
+	if x.Route == "" {
+		return errors.New("logs require a route")
+	}
+	name := instanceName(x.Route, x.Instance)
+
+	rt, active := activeGet(x.Namespace, name)
+
+	logBuffers.Lock()
+	buf, ok := logBuffers.m[x.Namespace+"|"+name]
+	logBuffers.Unlock()
+	if !ok {
+		x.stderr.Write([]byte(name + " logs error: no output kept\n"))
+		return nil
+	}
+
+	if !x.Follow || !active {
+		for _, line := range buf.snapshot(x.Proc) {
+			x.writeLogLine(name, line)
+		}
+		return nil
+	}
+
+	lines, sub := buf.subscribe(x.Proc)
+	defer buf.unsubscribe(sub)
+	for _, line := range lines {
+		x.writeLogLine(name, line)
+	}
+	x.follow(rt, name, sub)
+	return nil
+}
+
+// writeLogLine writes a kept line of the named route to the client, prefixed as it was when the route ran, to the stream it came from.
+func (x command) writeLogLine(name string, line logLine) {
+	w, stream := x.stdout, "out"
+	if line.err {
+		w, stream = x.errStream(), "err"
+	}
+	if lib.LogFormat == lib.FormatJson {
+		w.Write(appendJsonLine(nil, lib.LogLine{
+			Namespace: x.Namespace,
+			Route:     name,
+			Proc:      line.proc,
+			Stream:    stream,
+		}, line.text, line.time))
+		return
+	}
+	start, end := LineStyle(line.err, x.Color)
+	w.Write([]byte(LinePrefix(name, line.proc, x.Color) + start + string(line.text) + end + "\n"))
+}
+
+// follow writes the lines received by sub to the client, until the route terminates or the command is canceled.
+func (x command) follow(rt *route, name string, sub *logSub) {
+	for {
+		select {
+		case line := <-sub.ch:
+			if n := atomic.SwapUint64(&sub.dropped, 0); n > 0 {
+				x.stderr.Write([]byte(name + " logs: " + strconv.FormatUint(n, 10) + " lines dropped\n"))
+			}
+			x.writeLogLine(name, line)
+		case <-rt.done:
+			// drain what arrived before termination
+			for {
+				select {
+				case line := <-sub.ch:
+					x.writeLogLine(name, line)
+				default:
+					return
+				}
+			}
+		case <-x.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// notifyTimeout bounds the delivery of a notification, to a command or a URL.
+const notifyTimeout = 10 * time.Second
+
+// A notification holds the details of a terminated route, as delivered to notify commands and URLs.
+type notification struct {
+	Namespace string
+	Route     string
+	RunId     string
+	Outcome   string // see route.outcome
+	Error     string // empty on success
+	Proc      string // first process that failed, if any
+	Start     time.Time
+	End       time.Time
+	Wall      float64 // seconds
+	User      float64 // seconds
+	Sys       float64 // seconds
+	MaxRss    int64   // bytes
+}
+
+// notify delivers the details of the route's last run to its notify command and URL, in the background.
+// Nothing is delivered if the outcome of the run is not selected by the notify config.
+func (x *route) notify() {
+	cfg := x.cfg.Notify
+	if cfg == nil {
+		return
+	}
+
+	x.mux.Lock()
+	f := x.last
+	x.mux.Unlock()
+	if len(cfg.On) > 0 {
+		selected := false
+		for _, s := range cfg.On {
+			selected = selected || s == f.outcome
+		}
+		if !selected {
+			return
+		}
+	}
+
+	n := notification{
+		Namespace: x.namespace,
+		Route:     x.name,
+		RunId:     f.id,
+		Outcome:   f.outcome,
+		Proc:      x.failGet(),
+		Start:     f.end.Add(-f.usage.wall),
+		End:       f.end,
+		Wall:      f.usage.wall.Seconds(),
+		User:      f.usage.user.Seconds(),
+		Sys:       f.usage.sys.Seconds(),
+		MaxRss:    f.usage.maxRSS,
+	}
+	if f.err != nil {
+		n.Error = f.err.Error()
+	}
+	b, err := json.Marshal(n)
+	if err != nil {
+		x.stderr.Write([]byte(x.name + " notify error: " + err.Error() + "\n"))
+		return
+	}
+
+	if len(cfg.Cmd) > 0 {
+		p := []byte(x.name + "|notify: ")
+		cmd := exec.Command(cfg.Cmd[0], cfg.Cmd[1:]...)
+		cmd.Env = envList(merge(metaEnv(x.namespace, x.name, n.Proc, n.RunId), baseEnv(x.cfg.InheritEnv, x.cfg.EnvPass, x.cfg.Env)))
+		cmd.Stdin = bytes.NewReader(b)
+		pout, perr := newPrefixer(p, x.stdout), newPrefixer(p, x.stderr)
+		cmd.Stdout = capLines(pout, 0)
+		cmd.Stderr = capLines(perr, 0)
+		auxWg.Add(1)
+		go func() {
+			// not interrupted by server shutdown, which is often what is being announced
+			ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			if err := runCancelable(ctx, cmd, killGrace, x.name+"|notify"); err != nil {
+				x.stderr.Write([]byte(x.name + " notify error: " + err.Error() + "\n"))
+			}
+			pout.Flush()
+			perr.Flush()
+			cancel()
+			auxWg.Done()
+		}()
+	}
+
+	if cfg.Url != "" {
+		auxWg.Add(1)
+		go func() {
+			if err := postNotification(cfg.Url, b); err != nil {
+				x.stderr.Write([]byte(x.name + " notify error: " + err.Error() + "\n"))
+			}
+			auxWg.Done()
+		}()
+	}
+}
+
+// postNotification sends a JSON notification to url, expecting a 2xx response.
+func postNotification(url string, b []byte) error {
+	client := http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("unexpected status " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+// probeInterval is the default time between readiness checks.
+const probeInterval = time.Second
+
+// waitReady checks the readiness of p until the probe passes, p exits or ctx is done.
+// result must deliver the run result of p; it is only consumed if p exits before becoming ready.
+// Returns true if p became ready. Otherwise, returns the run result, or the probe error after canceling p.
+func waitReady(ctx context.Context, p *proc, probe lib.Probe, result <-chan error) (bool, error) {
+	interval := time.Duration(probe.Interval)
+	if interval <= 0 {
+		interval = probeInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	var timeout <-chan time.Time
+	if probe.Timeout > 0 {
+		tt := time.NewTimer(time.Duration(probe.Timeout))
+		defer tt.Stop()
+		timeout = tt.C
+	}
+
+	for {
+		if checkProbe(p, probe, interval) {
+			p.mux.Lock()
+			p.ready = true
+			p.mux.Unlock()
+			stateChanged()
+			return true, nil
+		}
+
+		select {
+		case err := <-result:
+			return false, err
+		case <-timeout:
+			p.cancel()
+			<-result
+			return false, errors.New("ready timeout")
+		case <-ctx.Done():
+			return false, <-result
+		case <-t.C:
+		}
+	}
+}
+
+// checkProbe returns true if the readiness check passes.
+// Network checks are bounded by the given timeout.
+func checkProbe(p *proc, probe lib.Probe, timeout time.Duration) bool {
+	switch {
+	case probe.Tcp != "":
+		conn, err := net.DialTimeout("tcp", probe.Tcp, timeout)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	case probe.Http != "":
+		client := http.Client{Timeout: timeout}
+		resp, err := client.Get(probe.Http)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode < 400
+	case probe.File != "":
+		_, err := os.Stat(probe.File)
+		return err == nil
+	case probe.Log != "":
+		return p.isReady()
+	}
+	return false
+}
+
+// reserveService accounts for a background process about to be supervised, unless the route has stopped accepting them.
+// A successful reservation must be followed by supervise, or released through servicesWg.Done.
+func (x *route) reserveService() bool {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	if x.servicesClosed || x.ctx.Err() != nil {
+		return false
+	}
+	x.servicesWg.Add(1)
+	return true
+}
+
+// closeServices stops accepting background processes, so that the route may wait for the current ones.
+func (x *route) closeServices() {
+	x.mux.Lock()
+	x.servicesClosed = true
+	x.mux.Unlock()
+}
+
+// supervise waits for a ready process to exit, while the route moves on.
+// The process must have been reserved through reserveService.
+// Processes canceled for a restart are started again in place, with the current config of the i-th task, unless they feed a pipeline.
+// A failure aborts the route, unless it is already terminating.
+func (x *route) supervise(i int, p *proc, cfg config, result <-chan error) {
+	x.serviceAdd(p)
+
+	ctx, cancel := x.runCtx()
+	env := envList(baseEnv(cfg.InheritEnv, cfg.EnvPass, cfg.Env))
+	hookPrefix := x.name + "|" + cfg.Name
+
+	go func() {
+		defer x.servicesWg.Done()
+
+		var err error
+		for {
+			err = <-result
+			if p.scaledDown() {
+				err = nil
+			}
+			x.procExited(p)
+			if hookErr := runHooks(mainCtx, cfg.PostStop, env, cfg.Dir, hookPrefix+"|poststop", cfg.stdout, cfg.stderr); hookErr != nil && err == nil {
+				err = errors.New("poststop error: " + hookErr.Error())
+				break
+			}
+			if !p.restarting() || ctx.Err() != nil || cfg.pipeOut != nil || cfg.pipeIn != nil {
+				break
+			}
+
+			x.countRestart()
+			// reloads may have changed the config since the last start; copies keep their own name
+			name := cfg.Name
+			cfg = x.task(i)
+			cfg.Name = name
+			env = envList(baseEnv(cfg.InheritEnv, cfg.EnvPass, cfg.Env))
+			if err = runHooks(ctx, cfg.PreStart, env, cfg.Dir, hookPrefix+"|prestart", cfg.stdout, cfg.stderr); err != nil {
+				err = errors.New("prestart error: " + err.Error())
+				break
+			}
+			next, setupErr := newProc(ctx, x.name, cfg)
+			if setupErr != nil {
+				err = setupErr
+				break
+			}
+			x.serviceReplace(p, next)
+			p = next
+
+			ch := make(chan error, 1)
+			codes := cfg.SuccessCodes
+			go func() {
+				ch <- checkExit(next.run(), codes)
+			}()
+			result = ch
+		}
+
+		x.serviceRemove(p)
+		x.mux.Lock()
+		if err != nil && ctx.Err() == nil && x.servicesErr == nil {
+			x.servicesErr = errors.New(p.name + " run error: " + err.Error())
+			if x.failed == "" {
+				x.failed = p.name
+			}
+		}
+		x.mux.Unlock()
+
+		if err != nil && ctx.Err() == nil {
+			cancel()
+		}
+	}()
+}
+
+// servicesCount returns the number of ready processes still running in the background.
+func (x *route) servicesCount() int {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	return len(x.services)
+}
+
+// servicesError returns the first background process failure, if any.
+func (x *route) servicesError() error {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	return x.servicesErr
+}
+
+// serviceAdd registers a process running alongside the current one.
+func (x *route) serviceAdd(p *proc) {
+	x.mux.Lock()
+	x.services = append(x.services, p)
+	x.mux.Unlock()
+	stateChanged()
+}
+
+// serviceRemove unregisters an exited process.
+func (x *route) serviceRemove(p *proc) {
+	defer stateChanged()
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	for i, s := range x.services {
+		if s == p {
+			x.services = append(x.services[:i], x.services[i+1:]...)
+			return
+		}
+	}
+}
+
+// serviceReplace substitutes a restarted background process.
+func (x *route) serviceReplace(old, p *proc) {
+	defer stateChanged()
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	for i, s := range x.services {
+		if s == old {
+			x.services[i] = p
+		}
+	}
+	if x.proc == old {
+		x.proc = p
+	}
+}
@@ -0,0 +1,135 @@
+package srv
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A rateLimiter drops lines past a per second rate, and reports how many it dropped once the next second starts.
+// If records is set, each write is a whole record, which is kept or dropped as a unit; otherwise, lines are limited one by one.
+type rateLimiter struct {
+	dst     io.Writer
+	lines   int // per second; 0 means unlimited
+	bytes   int // per second; 0 means unlimited
+	records bool
+
+	mux        sync.Mutex
+	window     time.Time // start of the current second
+	nLines     int       // forwarded during the current second
+	nBytes     int
+	suppressed int // lines dropped since the last report
+	timer      *time.Timer
+	part       []byte // incomplete line
+}
+
+func newRateLimiter(w io.Writer, lines, bytes int, records bool) *rateLimiter {
+	return &rateLimiter{
+		dst:     w,
+		lines:   lines,
+		bytes:   bytes,
+		records: records,
+	}
+}
+
+func (x *rateLimiter) Write(b []byte) (int, error) {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+
+	var r []byte
+	if x.records {
+		r = x.limit(r, b)
+	} else {
+		x.part = append(x.part, b...)
+		for {
+			i := bytes.IndexByte(x.part, '\n')
+			if i < 0 {
+				break
+			}
+			r = x.limit(r, x.part[:i+1])
+			x.part = x.part[i+1:]
+		}
+		// the remaining part must not alias the next write
+		x.part = append([]byte(nil), x.part...)
+	}
+
+	if len(r) > 0 {
+		if _, err := x.dst.Write(r); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// limit appends the line, or record, to r if the rate allows it.
+func (x *rateLimiter) limit(r, b []byte) []byte {
+	now := time.Now()
+	if now.Sub(x.window) >= time.Second {
+		r = x.appendReport(r)
+		x.window = now
+		x.nLines, x.nBytes = 0, 0
+	}
+
+	n := bytes.Count(b, []byte{'\n'})
+	if n == 0 {
+		n = 1
+	}
+	if x.lines > 0 && x.nLines+n > x.lines || x.bytes > 0 && x.nBytes+len(b) > x.bytes {
+		x.suppressed += n
+		if x.timer == nil {
+			// report even if the process falls silent
+			x.timer = time.AfterFunc(x.window.Add(time.Second).Sub(now), x.report)
+		}
+		return r
+	}
+	x.nLines += n
+	x.nBytes += len(b)
+	return append(r, b...)
+}
+
+// appendReport appends the suppression marker to r, if lines have been dropped.
+func (x *rateLimiter) appendReport(r []byte) []byte {
+	if x.suppressed == 0 {
+		return r
+	}
+	if len(r) > 0 && r[len(r)-1] != '\n' {
+		r = append(r, '\n')
+	}
+	r = append(r, "… "+strconv.Itoa(x.suppressed)+" lines suppressed\n"...)
+	x.suppressed = 0
+	return r
+}
+
+// report writes the suppression marker at the end of a second with dropped lines.
+func (x *rateLimiter) report() {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	x.timer = nil
+	if r := x.appendReport(nil); len(r) > 0 {
+		x.dst.Write(r)
+	}
+}
+
+// Flush forwards the incomplete line, if the rate allows it, and writes the suppression marker, if due.
+func (x *rateLimiter) Flush() error {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+
+	var r []byte
+	if len(x.part) > 0 {
+		r = x.limit(r, x.part)
+		x.part = nil
+	}
+	if x.timer != nil {
+		x.timer.Stop()
+		x.timer = nil
+	}
+	r = x.appendReport(r)
+	if len(r) == 0 {
+		return nil
+	}
+	_, err := x.dst.Write(r)
+	return err
+}
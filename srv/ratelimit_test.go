@@ -0,0 +1,36 @@
+package srv
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRateLimiter(t *testing.T) {
+	tests := []struct {
+		lines, bytes int
+		records      bool
+		writes       []string
+		want         string
+	}{
+		{0, 0, false, []string{"a\nb\nc\n"}, "a\nb\nc\n"},
+		{2, 0, false, []string{"a\nb\nc\nd\n"}, "a\nb\n… 2 lines suppressed\n"},
+		{2, 0, false, []string{"a", "\nb\nc"}, "a\nb\n… 1 lines suppressed\n"},
+		{0, 5, false, []string{"ab\n", "c\n", "d\n"}, "ab\nc\n… 1 lines suppressed\n"},
+		{3, 0, true, []string{"a\n  b\n", "c\n  d\n", "e\n"}, "a\n  b\ne\n… 2 lines suppressed\n"},
+	}
+	for i, test := range tests {
+		var buf bytes.Buffer
+		x := newRateLimiter(&buf, test.lines, test.bytes, test.records)
+		for _, s := range test.writes {
+			if n, err := x.Write([]byte(s)); n != len(s) || err != nil {
+				t.Fatalf("%d: write returned %d, %v", i, n, err)
+			}
+		}
+		if err := x.Flush(); err != nil {
+			t.Fatalf("%d: flush error: %v", i, err)
+		}
+		if buf.String() != test.want {
+			t.Errorf("%d: got %q, want %q", i, buf.String(), test.want)
+		}
+	}
+}
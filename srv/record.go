@@ -0,0 +1,153 @@
+package srv
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+// recoverWg tracks the routes of processes taken over from a crashed server.
+var recoverWg sync.WaitGroup
+
+// recordDir returns the directory holding the records of running processes.
+func recordDir() string {
+	return lib.BasePath + "/procs"
+}
+
+// A procRecord identifies a running process, so that another server may take it over.
+// Records are written on start, and removed once the process has exited.
+type procRecord struct {
+	Namespace  string
+	Route      string
+	Proc       string
+	RunId      string
+	Pid        int
+	StartTicks uint64 // process start time, to tell pid reuse apart; 0 if unknown
+	Start      time.Time
+	Server     int // pid of the server that started the process
+	Detached   bool
+}
+
+// newRecord returns the record of a started process.
+func newRecord(p *proc, start time.Time) procRecord {
+	pid := p.cmd.Process.Pid
+	ticks, _ := procStartTime(pid)
+	return procRecord{
+		Namespace:  p.namespace,
+		Route:      p.route,
+		Proc:       p.name,
+		RunId:      p.runId,
+		Pid:        pid,
+		StartTicks: ticks,
+		Start:      start,
+		Server:     os.Getpid(),
+		Detached:   p.detached,
+	}
+}
+
+func (x procRecord) path() string {
+	return recordDir() + "/" + x.RunId + "-" + x.Proc + ".json"
+}
+
+func (x procRecord) save() error {
+	if err := os.MkdirAll(recordDir(), 0700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(x)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(x.path(), b, 0600)
+}
+
+func (x procRecord) remove() {
+	os.Remove(x.path())
+}
+
+// running returns true if the recorded process still exists.
+func (x procRecord) running() bool {
+	if !alive(x.Pid) {
+		return false
+	}
+	if x.StartTicks == 0 {
+		return true
+	}
+	ticks, err := procStartTime(x.Pid)
+	return err == nil && ticks == x.StartTicks
+}
+
+// orphaned returns true if the server that started the process is gone.
+func (x procRecord) orphaned() bool {
+	return !alive(x.Server)
+}
+
+// readRecords returns all stored process records.
+// Unreadable records are skipped.
+func readRecords() ([]procRecord, error) {
+	entries, err := os.ReadDir(recordDir())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var r []procRecord
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		b, err := os.ReadFile(recordDir() + "/" + e.Name())
+		if err != nil {
+			continue
+		}
+		var rec procRecord
+		if json.Unmarshal(b, &rec) != nil {
+			continue
+		}
+		r = append(r, rec)
+	}
+	return r, nil
+}
+
+// alive returns true if a process with the given pid exists.
+func alive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// recoverProcs takes over the processes left running by a crashed server, so that they can still be listed and killed.
+// Detached processes are left for explicit adoption.
+func recoverProcs() {
+	recs, err := readRecords()
+	if err != nil {
+		stderr.Println("proc records error:", err)
+		return
+	}
+
+	var lost []procRecord
+	for _, rec := range recs {
+		if rec.Detached || !rec.orphaned() {
+			continue
+		}
+		if !rec.running() {
+			rec.remove()
+			continue
+		}
+		lost = append(lost, rec)
+	}
+
+	for _, rt := range adoptRoutes(mainCtx, lost, stdout, stderr) {
+		recoverWg.Add(1)
+		go func(rt *route) {
+			<-rt.done
+			recoverWg.Done()
+		}(rt)
+	}
+}
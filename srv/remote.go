@@ -0,0 +1,98 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// remoteCmd returns a command that runs the proc command on cfg.Host, through the ssh binary.
+// The env values and the remote process ID are kept in a private temporary directory on the host, so that neither shows up in command lines,
+// and so that the returned interrupt function signals the right process. The directory is removed once the process exits,
+// or by the returned closer, if the process is not started.
+// SIGTERM is used, since asynchronous commands of non-interactive shells ignore SIGINT.
+func remoteCmd(ctx context.Context, cfg config, env map[string]string) (*exec.Cmd, func() error, io.Closer, error) {
+	dir, err := remoteDir(ctx, cfg, env)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	d := shellQuote(dir)
+
+	// explicit stdin redirection, since asynchronous commands otherwise read from /dev/null
+	run := []string{shellQuote(cfg.Path)}
+	for _, arg := range cfg.Args {
+		run = append(run, shellQuote(arg))
+	}
+	script := "d=" + d + "; trap 'rm -rf \"$d\"' EXIT; . \"$d/env\" && rm \"$d/env\" && "
+	if cfg.Dir != "" {
+		script += "cd " + shellQuote(cfg.Dir) + " && "
+	}
+	script += "{ " + strings.Join(run, " ") + " 0<&0 & p=$!; echo $p > \"$d/pid\"; wait $p; }"
+
+	args := append([]string{}, cfg.SshArgs...)
+	if cfg.Tty {
+		args = append(args, "-tt")
+	} else {
+		args = append(args, "-T")
+	}
+	args = append(args, cfg.Host, script)
+
+	cmd := exec.Command("ssh", args...)
+	// ssh itself needs the server environment, for agent sockets and config lookup
+	cmd.Env = os.Environ()
+
+	interrupt := func() error {
+		sig := append(append([]string{}, cfg.SshArgs...), "-T", cfg.Host, "kill -TERM $(cat "+d+"/pid)")
+		return exec.Command("ssh", sig...).Run()
+	}
+
+	return cmd, interrupt, remoteCleanup{cfg, dir}, nil
+}
+
+// A remoteCleanup removes the temporary directory of a remote proc that is not started.
+type remoteCleanup struct {
+	cfg config
+	dir string
+}
+
+func (x remoteCleanup) Close() error {
+	args := append(append([]string{}, x.cfg.SshArgs...), "-T", x.cfg.Host, "rm -rf "+shellQuote(x.dir))
+	return exec.Command("ssh", args...).Run()
+}
+
+// remoteDir creates a directory only accessible to the remote account on cfg.Host, holding a script that exports the env values, and returns its path.
+// The script is sent through the ssh stdin.
+func remoteDir(ctx context.Context, cfg config, env map[string]string) (string, error) {
+	names := make([]string, 0, len(env))
+	for k := range env {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, k := range names {
+		b.WriteString("export " + shellQuote(k+"="+env[k]) + "\n")
+	}
+
+	args := append(append([]string{}, cfg.SshArgs...), "-T", cfg.Host, `umask 077 && d=$(mktemp -d) && cat > "$d/env" && echo "$d"`)
+	cmd := exec.CommandContext(ctx, "ssh", args...)
+	cmd.Env = os.Environ()
+	cmd.Stdin = strings.NewReader(b.String())
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	dir := strings.TrimSuffix(string(out), "\n")
+	if !strings.HasPrefix(dir, "/") || strings.ContainsRune(dir, '\n') {
+		return "", errors.New("unexpected remote temporary directory " + shellQuote(dir))
+	}
+	return dir, nil
+}
+
+// shellQuote quotes s for use as a single POSIX shell word.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,16 @@
+//go:build !freebsd && !dragonfly
+// +build !freebsd,!dragonfly
+
+package srv
+
+import "syscall"
+
+// capRlimit returns lim with its soft limit set to size, capped by the hard limit.
+// A negative size means the hard limit.
+func capRlimit(lim syscall.Rlimit, size int64) syscall.Rlimit {
+	lim.Cur = lim.Max
+	if size >= 0 && uint64(size) < lim.Max {
+		lim.Cur = uint64(size)
+	}
+	return lim
+}
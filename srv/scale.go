@@ -0,0 +1,128 @@
+package srv
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+// startCopy starts the k-th copy of the i-th process, which has multiple instances.
+// Copies run in the background, supervised like ready processes.
+func (x *route) startCopy(i int, cfg config, k int) error {
+	if cfg.pipeIn != nil || cfg.pipeOut != nil || strings.HasPrefix(cfg.In, lib.InProc) {
+		return errors.New(cfg.Name + " instances error: not supported in pipelines")
+	}
+
+	cfg.Name = instanceName(cfg.Name, strconv.Itoa(k))
+	ctx, _ := x.runCtx()
+	env := envList(baseEnv(cfg.InheritEnv, cfg.EnvPass, cfg.Env))
+	if err := runHooks(ctx, cfg.PreStart, env, cfg.Dir, x.name+"|"+cfg.Name+"|prestart", cfg.stdout, cfg.stderr); err != nil {
+		return errors.New(cfg.Name + " prestart error: " + err.Error())
+	}
+	if !x.reserveService() {
+		return errors.New(cfg.Name + " instances error: route is stopping")
+	}
+	p, err := newProc(ctx, x.name, cfg)
+	if err != nil {
+		x.servicesWg.Done()
+		return err
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- checkExit(p.run(), cfg.SuccessCodes)
+	}()
+	x.supervise(i, p, cfg, result)
+	return nil
+}
+
+// copies returns the running copies of the named process, by copy number.
+func (x *route) copies(name string) map[int]*proc {
+	r := make(map[int]*proc)
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	for _, p := range x.services {
+		if s := strings.TrimPrefix(p.name, name+"#"); s != p.name {
+			if k, err := strconv.Atoi(s); err == nil {
+				r[k] = p
+			}
+		}
+	}
+	return r
+}
+
+// scaleDown interrupts the process as part of a scale down, so that its exit does not count as a failure.
+func (x *proc) scaleDown() {
+	x.mux.Lock()
+	x.scaled = true
+	x.mux.Unlock()
+	x.cancel()
+}
+
+func (x *proc) scaledDown() bool {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	return x.scaled
+}
+
+// executeScale adjusts the number of running instances of a process of an active route, starting or stopping copies as needed.
+// Copies are stopped gracefully, highest numbers first, in the background.
+// The new count also applies to later runs of the route, if it restarts.
+func (x command) executeScale() error {
+	if x.Count < 1 {
+		return errors.New("instance count must be at least 1")
+	}
+	rt, ok := activeGet(x.Namespace, instanceName(x.Route, x.Instance))
+	if !ok {
+		return errors.New("route not active")
+	}
+
+	rt.mux.Lock()
+	i := 0
+	for ; i < len(rt.tasks); i++ {
+		if rt.tasks[i].Name == x.Proc {
+			break
+		}
+	}
+	if i == len(rt.tasks) {
+		rt.mux.Unlock()
+		return errors.New("process not defined")
+	}
+	if rt.tasks[i].Instances < 1 {
+		rt.mux.Unlock()
+		return errors.New("process does not have instances enabled")
+	}
+	rt.tasks[i].Instances = x.Count
+	cfg := rt.tasks[i]
+	rt.mux.Unlock()
+
+	copies := rt.copies(cfg.Name)
+	n := 1 + len(copies)
+
+	for k := 2; n < x.Count; k++ {
+		if _, ok := copies[k]; ok {
+			continue
+		}
+		if err := rt.startCopy(i, cfg, k); err != nil {
+			return err
+		}
+		n++
+	}
+
+	if n > x.Count {
+		nums := make([]int, 0, len(copies))
+		for k := range copies {
+			nums = append(nums, k)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(nums)))
+		for _, k := range nums[:n-x.Count] {
+			copies[k].scaleDown()
+		}
+	}
+
+	x.stdout.Write([]byte(rt.name + "|" + cfg.Name + " scaled to " + strconv.Itoa(x.Count) + "\n"))
+	return nil
+}
@@ -0,0 +1,356 @@
+package srv
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+// Overlap policies, for periodic runs of a route that is still active.
+const (
+	overlapSkip  = "skip"
+	overlapQueue = "queue"
+)
+
+// A cronField holds the allowed values of a cron expression field, as a bitset.
+type cronField uint64
+
+// A cronSchedule is a parsed cron expression: minute, hour, day of month, month and day of week.
+type cronSchedule struct {
+	minute, hour, dom, month, dow cronField
+
+	domAny, dowAny bool // field is "*"; if both day fields are restricted, either may match
+}
+
+// cronMacros maps the supported shorthand expressions to their equivalents.
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron parses a standard 5 field cron expression.
+// Fields may be "*", numbers, ranges ("1-5") and lists ("1,3"), each with an optional step ("*/15").
+// Day of week 7 is Sunday, like 0.
+func parseCron(s string) (cronSchedule, error) {
+	if m, ok := cronMacros[s]; ok {
+		s = m
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return cronSchedule{}, errors.New("cron expression must have 5 fields")
+	}
+
+	var (
+		x   cronSchedule
+		err error
+	)
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	dst := [5]*cronField{&x.minute, &x.hour, &x.dom, &x.month, &x.dow}
+	for i, f := range fields {
+		if *dst[i], err = parseCronField(f, bounds[i][0], bounds[i][1]); err != nil {
+			return cronSchedule{}, errors.New("cron field " + strconv.Quote(f) + ": " + err.Error())
+		}
+	}
+	if x.dow&(1<<7) != 0 {
+		x.dow |= 1
+	}
+	x.domAny = fields[2] == "*"
+	x.dowAny = fields[4] == "*"
+	return x, nil
+}
+
+func parseCronField(s string, min, max int) (cronField, error) {
+	var r cronField
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, errors.New("invalid step")
+			}
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, errors.New("invalid value")
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, errors.New("invalid value")
+				}
+			} else if step > 1 {
+				hi = max // "n/step" runs from n to the end
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, errors.New("value out of range")
+		}
+
+		for v := lo; v <= hi; v += step {
+			r |= 1 << v
+		}
+	}
+	return r, nil
+}
+
+// match returns true if the schedule fires during the minute of t.
+func (x cronSchedule) match(t time.Time) bool {
+	if x.minute&(1<<t.Minute()) == 0 || x.hour&(1<<t.Hour()) == 0 || x.month&(1<<t.Month()) == 0 {
+		return false
+	}
+	dom := x.dom&(1<<t.Day()) != 0
+	dow := x.dow&(1<<t.Weekday()) != 0
+	if x.domAny || x.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// periodic tracks the route runs started by the server itself, by namespace and route.
+var periodic = struct {
+	sync.Mutex
+	queued map[string]bool // a run is waiting for the previous one to finish
+}{queued: make(map[string]bool)}
+
+// runPeriodic starts a run of the named route, as defined by manifest, on behalf of the server.
+// If the route is still active, the run is skipped or queued according to its overlap policy.
+// desc describes what started the run, for messages.
+func runPeriodic(manifest map[string]lib.Route, name, desc string) {
+	cfg := manifest[name]
+	key := cfg.Namespace + "|" + name
+
+	if isDraining() {
+		stderr.Println(name + " " + desc + " skipped: server draining")
+		return
+	}
+
+	if rt, ok := activeGet(cfg.Namespace, name); ok {
+		if cfg.Overlap != overlapQueue {
+			stderr.Println(name + " " + desc + " skipped: previous run still active")
+			return
+		}
+
+		periodic.Lock()
+		if periodic.queued[key] {
+			periodic.Unlock()
+			stderr.Println(name + " " + desc + " skipped: a run is already queued")
+			return
+		}
+		periodic.queued[key] = true
+		periodic.Unlock()
+
+		go func() {
+			select {
+			case <-rt.done:
+			case <-mainCtx.Done():
+			}
+			periodic.Lock()
+			delete(periodic.queued, key)
+			periodic.Unlock()
+			if mainCtx.Err() == nil {
+				runPeriodic(manifest, name, desc)
+			}
+		}()
+		return
+	}
+
+	cmd := command{
+		Cmd: lib.Cmd{
+			Sw:        lib.CmdRun,
+			Namespace: cfg.Namespace,
+			Route:     name,
+			Config:    manifest,
+		},
+		stdout: stdout,
+		stderr: stderr,
+		ctx:    mainCtx,
+	}
+	go func() {
+		if err := cmd.executeRun(); err != nil {
+			stderr.Println(name+" "+desc+" error:", err)
+		}
+	}()
+}
+
+// An interval tracks the next run of a route that is repeated at a fixed interval.
+type interval struct {
+	every, jitter time.Duration
+
+	base time.Time // next run, without jitter
+	next time.Time
+}
+
+// advance moves the next run past now, skipping the runs that have been missed.
+// Jitter is drawn again for each run and does not accumulate.
+func (x *interval) advance(now time.Time) {
+	for !x.base.After(now) {
+		x.base = x.base.Add(x.every)
+	}
+	x.next = x.base
+	if x.jitter > 0 {
+		x.next = x.next.Add(time.Duration(rand.Int63n(int64(x.jitter))))
+	}
+}
+
+// intervalOf returns the run interval and jitter of a route, validated; every is 0 if the route is not run at an interval.
+func intervalOf(cfg lib.Route) (every, jitter time.Duration, err error) {
+	every, jitter = time.Duration(cfg.Every), time.Duration(cfg.Jitter)
+	if every == 0 && jitter == 0 {
+		return 0, 0, nil
+	}
+	if every <= 0 || jitter < 0 || jitter >= every {
+		return 0, 0, errors.New("every must be positive, and jitter less than every")
+	}
+	return every, jitter, nil
+}
+
+// ScheduledRuns returns the times at which a dedicated server started at from would run the route on its own, up to until, following its cron schedule and interval.
+// Interval runs are returned without jitter.
+func ScheduledRuns(cfg lib.Route, from, until time.Time) ([]time.Time, error) {
+	var r []time.Time
+	if cfg.Schedule != "" {
+		sched, err := parseCron(cfg.Schedule)
+		if err != nil {
+			return nil, err
+		}
+		for t := from.Truncate(time.Minute).Add(time.Minute); !t.After(until); t = t.Add(time.Minute) {
+			if sched.match(t) {
+				r = append(r, t)
+			}
+		}
+	}
+
+	every, _, err := intervalOf(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if every > 0 {
+		for t := from.Add(every); !t.After(until); t = t.Add(every) {
+			r = append(r, t)
+		}
+		sort.Slice(r, func(i, j int) bool {
+			return r[i].Before(r[j])
+		})
+	}
+	return r, nil
+}
+
+// schedule runs the manifest routes that define a cron schedule, at the start of each matching minute,
+// and the routes that define an interval, every time it elapses.
+// The manifest is decoded again every minute, so that changes apply without restarting the server.
+// Interval changes restart the interval count.
+func schedule() {
+	var (
+		routes    map[string]lib.Route // last successfully decoded
+		crons     map[string]cronSchedule
+		intervals = make(map[string]*interval)
+		reported  map[string]string // errors of the last decoding, by route or "manifest"; only changes are reported
+	)
+	load := func(now time.Time) bool {
+		errs := make(map[string]string)
+		defer func() {
+			for key, s := range errs {
+				if reported[key] != s {
+					stderr.Println(key + " schedule error: " + s)
+				}
+			}
+			reported = errs
+		}()
+
+		manifest, err := lib.DecodeConfig()
+		if err != nil {
+			errs["manifest"] = err.Error()
+			return false
+		}
+		routes = manifest.Routes
+
+		crons = make(map[string]cronSchedule)
+		for name, cfg := range routes {
+			if cfg.Schedule == "" {
+				continue
+			}
+			if crons[name], err = parseCron(cfg.Schedule); err != nil {
+				delete(crons, name)
+				errs[name] = err.Error()
+			}
+		}
+
+		for name := range intervals {
+			if routes[name].Every <= 0 {
+				delete(intervals, name)
+			}
+		}
+		for name, cfg := range routes {
+			every, jitter, err := intervalOf(cfg)
+			if err != nil {
+				delete(intervals, name)
+				errs[name] = err.Error()
+				continue
+			}
+			if every == 0 {
+				continue
+			}
+			if iv, ok := intervals[name]; ok && iv.every == every && iv.jitter == jitter {
+				continue
+			}
+			iv := &interval{every: every, jitter: jitter, base: now}
+			iv.advance(now)
+			intervals[name] = iv
+		}
+		return true
+	}
+	load(time.Now())
+
+	for {
+		now := time.Now()
+		minute := now.Truncate(time.Minute).Add(time.Minute)
+		wake := minute
+		for _, iv := range intervals {
+			if iv.next.Before(wake) {
+				wake = iv.next
+			}
+		}
+
+		t := time.NewTimer(wake.Sub(now))
+		select {
+		case <-mainCtx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		now = time.Now()
+
+		if !now.Before(minute) && load(now) {
+			for name, sched := range crons {
+				if sched.match(minute) {
+					runPeriodic(routes, name, "scheduled run")
+				}
+			}
+		}
+
+		for name, iv := range intervals {
+			if now.Before(iv.next) {
+				continue
+			}
+			iv.advance(now)
+			runPeriodic(routes, name, "interval run")
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package srv
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr  string
+		match []string
+		miss  []string
+	}{
+		{"* * * * *", []string{"2024-01-01 00:00", "2024-06-15 13:37"}, nil},
+		{"*/15 * * * *", []string{"2024-01-01 10:00", "2024-01-01 10:45"}, []string{"2024-01-01 10:10"}},
+		{"5/20 * * * *", []string{"2024-01-01 10:05", "2024-01-01 10:25", "2024-01-01 10:45"}, []string{"2024-01-01 10:00", "2024-01-01 10:20"}},
+		{"0 9-17 * * 1-5", []string{"2024-01-01 09:00", "2024-01-05 17:00"}, []string{"2024-01-01 08:00", "2024-01-06 09:00"}},
+		{"0,30 0 1,15 * *", []string{"2024-03-01 00:30", "2024-03-15 00:00"}, []string{"2024-03-02 00:00", "2024-03-01 00:15"}},
+		{"0 0 * 2 *", []string{"2024-02-10 00:00"}, []string{"2024-03-10 00:00"}},
+		{"0 0 * * 7", []string{"2024-01-07 00:00"}, []string{"2024-01-08 00:00"}},
+		// both day fields restricted: either may match
+		{"0 0 13 * 5", []string{"2024-01-13 00:00", "2024-01-05 00:00"}, []string{"2024-01-06 00:00"}},
+		{"@hourly", []string{"2024-01-01 05:00"}, []string{"2024-01-01 05:01"}},
+		{"@weekly", []string{"2024-01-07 00:00"}, []string{"2024-01-01 00:00"}},
+		{"@yearly", []string{"2024-01-01 00:00"}, []string{"2024-02-01 00:00"}},
+	}
+	for _, test := range tests {
+		x, err := parseCron(test.expr)
+		if err != nil {
+			t.Errorf("%q: %v", test.expr, err)
+			continue
+		}
+		for _, s := range test.match {
+			if !x.match(parseMinute(t, s)) {
+				t.Errorf("%q: should match %s", test.expr, s)
+			}
+		}
+		for _, s := range test.miss {
+			if x.match(parseMinute(t, s)) {
+				t.Errorf("%q: should not match %s", test.expr, s)
+			}
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"* * * *", "5 fields"},
+		{"* * * * * *", "5 fields"},
+		{"@often", "5 fields"},
+		{"60 * * * *", "out of range"},
+		{"* 24 * * *", "out of range"},
+		{"* * 0 * *", "out of range"},
+		{"* * * 13 *", "out of range"},
+		{"* * * * 8", "out of range"},
+		{"5-1 * * * *", "out of range"},
+		{"*/0 * * * *", "invalid step"},
+		{"*/x * * * *", "invalid step"},
+		{"a * * * *", "invalid value"},
+		{"1-b * * * *", "invalid value"},
+	}
+	for _, test := range tests {
+		_, err := parseCron(test.expr)
+		if err == nil {
+			t.Errorf("%q: no error", test.expr)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q: got error %q, want %q", test.expr, err, test.want)
+		}
+	}
+}
+
+// parseMinute parses a "2006-01-02 15:04" time.
+func parseMinute(t *testing.T, s string) time.Time {
+	r, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
@@ -0,0 +1,74 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+// resolveSecrets returns the current values of the given secrets.
+// Trailing newlines are trimmed.
+// Secret commands are interrupted when ctx is done; desc identifies them in the shutdown report.
+func resolveSecrets(ctx context.Context, secrets map[string]lib.Secret, desc string) (map[string]string, error) {
+	r := make(map[string]string, len(secrets))
+	for k, s := range secrets {
+		var (
+			b   []byte
+			err error
+		)
+		switch {
+		case s.File != "":
+			b, err = os.ReadFile(s.File)
+		case len(s.Cmd) > 0:
+			buf := bytes.Buffer{}
+			cmd := exec.Command(s.Cmd[0], s.Cmd[1:]...)
+			cmd.Stdout = &buf
+			err = runCancelable(ctx, cmd, killGrace, desc+" secret "+k)
+			b = buf.Bytes()
+		default:
+			err = errors.New("no source defined")
+		}
+		if err != nil {
+			return nil, errors.New(k + ": " + err.Error())
+		}
+		r[k] = strings.TrimRight(string(b), "\r\n")
+	}
+	return r, nil
+}
+
+// watchSecrets periodically re-resolves the process secrets until it exits.
+// Secrets are passed through the env, which cannot change under a running process, so the process is restarted when they change,
+// even if it has a reload signal, which would leave it with the old values.
+func (x *proc) watchSecrets() {
+	t := time.NewTicker(x.secretPoll)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-x.done:
+			return
+		case <-t.C:
+		}
+
+		values, err := resolveSecrets(x.routeCtx, x.secrets, x.route+"|"+x.name)
+		if err != nil {
+			stderr.Println(x.name+" secret error:", err)
+			continue
+		}
+		if reflect.DeepEqual(values, x.secretValues) {
+			continue
+		}
+		x.secretValues = values
+
+		x.notify.Write([]byte(x.route + "|" + x.name + ": secrets changed, restarting\n"))
+		x.requestRestart()
+		return
+	}
+}
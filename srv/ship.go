@@ -0,0 +1,220 @@
+package srv
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+// Log shipping parameters.
+const (
+	shipBatch      = 500              // lines sent at once, at most
+	shipInterval   = time.Second      // maximum delay of a line before it is sent, while the endpoint is reachable
+	shipQueue      = 10000            // lines kept while the endpoint is unreachable; the oldest are dropped past it
+	shipTimeout    = 10 * time.Second // of a single send
+	shipBackoffMax = 30 * time.Second // maximum delay between retries
+	shipLineMax    = 64 << 10         // longer lines are cut
+)
+
+// A shipper forwards process output lines to the lib.LogShip endpoint, as JSON lines, in batches.
+// Failed batches are retried with exponential backoff.
+type shipper struct {
+	mux     sync.Mutex
+	queue   [][]byte // encoded lines
+	dropped int      // lines dropped since the last successful send
+
+	wake chan struct{} // a full batch is ready
+	stop chan struct{} // closed on server shutdown
+	done chan struct{} // closed once the remaining lines have been sent, or given up
+
+	conn net.Conn // tcp endpoints; nil until connected
+}
+
+// logShipper is nil if shipping is disabled.
+var logShipper *shipper
+
+// startShipping starts the log shipper, if configured.
+func startShipping() {
+	if lib.LogShip == "" {
+		return
+	}
+	logShipper = &shipper{
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go logShipper.run()
+}
+
+// stopShipping makes a last attempt to send the queued lines, waiting at most shipTimeout.
+func stopShipping() {
+	if logShipper == nil {
+		return
+	}
+	close(logShipper.stop)
+	select {
+	case <-logShipper.done:
+	case <-time.After(shipTimeout):
+	}
+}
+
+// add queues a line of process output.
+func (x *shipper) add(namespace, route, proc string, err bool, text []byte) {
+	if len(text) > shipLineMax {
+		text = text[:shipLineMax]
+	}
+	stream := "out"
+	if err {
+		stream = "err"
+	}
+	b := appendJsonLine(nil, lib.LogLine{
+		Namespace: namespace,
+		Route:     route,
+		Proc:      proc,
+		Stream:    stream,
+	}, text, time.Now())
+
+	x.mux.Lock()
+	if len(x.queue) >= shipQueue {
+		x.queue = x.queue[1:]
+		x.dropped++
+	}
+	x.queue = append(x.queue, b)
+	full := len(x.queue) >= shipBatch
+	x.mux.Unlock()
+
+	if full {
+		select {
+		case x.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (x *shipper) run() {
+	defer close(x.done)
+
+	failures := 0
+	t := time.NewTimer(shipInterval)
+	for {
+		select {
+		case <-x.stop:
+			t.Stop()
+			// last attempt, without retries
+			for {
+				n, err := x.sendBatch()
+				if err != nil || n == 0 {
+					break
+				}
+			}
+			if x.conn != nil {
+				x.conn.Close()
+			}
+			return
+		case <-x.wake:
+			if failures > 0 {
+				// keep backing off
+				continue
+			}
+			if !t.Stop() {
+				<-t.C
+			}
+		case <-t.C:
+		}
+
+		n, err := x.sendBatch()
+		delay := shipInterval
+		if err == nil {
+			failures = 0
+			if n >= shipBatch {
+				delay = 0
+			}
+		} else {
+			if failures == 0 {
+				stderr.Println("log shipping error:", err)
+			}
+			failures++
+			delay = shipInterval << failures
+			if delay > shipBackoffMax || delay <= 0 {
+				delay = shipBackoffMax
+			}
+		}
+		t.Reset(delay)
+	}
+}
+
+// sendBatch sends the oldest queued lines.
+// If it fails, the lines are queued again, ahead of newer ones.
+// Returns the number of lines left in the queue.
+func (x *shipper) sendBatch() (int, error) {
+	x.mux.Lock()
+	n := len(x.queue)
+	if n > shipBatch {
+		n = shipBatch
+	}
+	batch := x.queue[:n:n]
+	x.queue = x.queue[n:]
+	x.mux.Unlock()
+	if n == 0 {
+		return 0, nil
+	}
+
+	err := x.send(bytes.Join(batch, nil))
+
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	if err != nil {
+		if over := len(batch) + len(x.queue) - shipQueue; over > 0 {
+			if over > len(batch) {
+				over = len(batch)
+			}
+			batch = batch[over:]
+			x.dropped += over
+		}
+		x.queue = append(batch, x.queue...)
+		return len(x.queue), err
+	}
+	if x.dropped > 0 {
+		stderr.Println("log shipping: " + strconv.Itoa(x.dropped) + " lines dropped")
+		x.dropped = 0
+	}
+	return len(x.queue), nil
+}
+
+// send delivers encoded lines to the endpoint.
+func (x *shipper) send(b []byte) error {
+	if strings.HasPrefix(lib.LogShip, "tcp://") {
+		if x.conn == nil {
+			conn, err := net.DialTimeout("tcp", strings.TrimPrefix(lib.LogShip, "tcp://"), shipTimeout)
+			if err != nil {
+				return err
+			}
+			x.conn = conn
+		}
+		x.conn.SetWriteDeadline(time.Now().Add(shipTimeout))
+		if _, err := x.conn.Write(b); err != nil {
+			x.conn.Close()
+			x.conn = nil
+			return err
+		}
+		return nil
+	}
+
+	client := http.Client{Timeout: shipTimeout}
+	resp, err := client.Post(lib.LogShip, "application/x-ndjson", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("endpoint responded " + resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package srv
+
+import (
+	"errors"
+	"os"
+	"strings"
+)
+
+// executeSignal sends the command's signal to the running processes of the targeted routes, instead of killing them.
+// Targets are selected like for kills. If a proc is given, only processes of that name are signaled.
+func (x command) executeSignal() {
+	sig, err := parseSignal(x.Signal)
+	if err != nil {
+		x.stderr.Write([]byte("signal error: " + err.Error() + "\n"))
+		x.fail(1)
+		return
+	}
+
+	var rts []*route
+	switch members := x.group(); {
+	case members != nil:
+		in := make(map[string]struct{}, len(members))
+		for _, name := range members {
+			in[name] = struct{}{}
+		}
+		activeRange(x.Namespace, func(rt *route) {
+			if _, ok := in[rt.base]; ok {
+				rts = append(rts, rt)
+			}
+		})
+	case x.Instance != "":
+		if rt, ok := activeGet(x.Namespace, instanceName(x.Route, x.Instance)); ok {
+			rts = append(rts, rt)
+		}
+	default:
+		activeRange(x.Namespace, func(rt *route) {
+			if x.Route == "" || rt.base == x.Route {
+				rts = append(rts, rt)
+			}
+		})
+	}
+
+	if len(rts) == 0 {
+		x.stderr.Write([]byte("signal error: no matching active route\n"))
+		x.fail(1)
+		return
+	}
+	for _, rt := range rts {
+		if err := rt.signal(x.Proc, sig); err != nil {
+			x.stderr.Write([]byte(rt.name + " signal error: " + err.Error() + "\n"))
+			x.fail(1)
+		}
+	}
+}
+
+// signal sends sig to the named running process of the route, including its copies, or to all its running processes if name is empty.
+func (x *route) signal(name string, sig os.Signal) error {
+	x.mux.Lock()
+	procs := make([]*proc, 0, len(x.services)+1)
+	if x.proc != nil {
+		procs = append(procs, x.proc)
+	}
+	for _, p := range x.services {
+		if p != x.proc {
+			procs = append(procs, p)
+		}
+	}
+	x.mux.Unlock()
+
+	n := 0
+	for _, p := range procs {
+		if name != "" && p.name != name && !strings.HasPrefix(p.name, name+"#") {
+			continue
+		}
+		process := p.process()
+		if process == nil {
+			continue
+		}
+		if err := process.Signal(sig); err != nil {
+			return err
+		}
+		n++
+	}
+	if n == 0 {
+		return errors.New("process not running")
+	}
+	return nil
+}
+
+// process returns the started process, or nil if it has not been started yet.
+func (x *proc) process() *os.Process {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	return x.cmd.Process
+}
@@ -2,17 +2,28 @@
 package srv
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -24,41 +35,134 @@ var (
 	stderr *lib.Fmt = lib.Stderr
 )
 
-// A prefixer prepends a predetermined byte slice before forwarding writes.
-// Buffers until a write ends in a newline.
+// prefixIdle is how long a prefixer holds an unterminated line before forwarding it, e.g. for prompts.
+const prefixIdle = 500 * time.Millisecond
+
+// A prefixer prepends a predetermined byte slice to each line before forwarding it.
+// Buffers the current line until it is terminated, it has been idle for prefixIdle, or the prefixer is flushed.
+// The rest of a line that has been forwarded early is not prefixed again.
 type prefixer struct {
-	dst io.Writer
-	buf []byte
-	n   int
+	dst        io.Writer
+	prefix     []byte
+	start, end []byte // surround line contents, e.g. with terminal styles; may be nil
+
+	mux   sync.Mutex
+	buf   []byte // current line, without prefix
+	mid   bool   // the start of the current line has already been forwarded
+	timer *time.Timer
 }
 
 func newPrefixer(prefix []byte, w io.Writer) *prefixer {
 	b := make([]byte, len(prefix))
 	copy(b, prefix)
 	return &prefixer{
-		dst: w,
-		buf: b,
-		n:   len(b),
+		dst:    w,
+		prefix: b,
 	}
 }
 
 func (x *prefixer) Write(b []byte) (int, error) {
-	x.buf = append(x.buf, b...)
-	if x.buf[len(x.buf)-1] != '\n' {
-		return len(b), nil
+	x.mux.Lock()
+	defer x.mux.Unlock()
+
+	if x.timer != nil {
+		x.timer.Stop()
+	}
+
+	var r []byte
+	for rest := b; len(rest) > 0; {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			x.buf = append(x.buf, rest...)
+			break
+		}
+		r = x.appendLine(r, rest[:i+1])
+		rest = rest[i+1:]
+	}
+
+	if len(x.buf) > 0 {
+		if x.timer == nil {
+			x.timer = time.AfterFunc(prefixIdle, x.idle)
+		} else {
+			x.timer.Reset(prefixIdle)
+		}
+	}
+
+	if len(r) > 0 {
+		if _, err := x.dst.Write(r); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// appendLine appends the current line, completed by b, which ends in a newline, to r.
+func (x *prefixer) appendLine(r, b []byte) []byte {
+	x.buf = append(x.buf, b[:len(b)-1]...)
+	r = x.appendFragment(r)
+	x.mid = false
+	return append(r, '\n')
+}
+
+// appendFragment appends the buffered part of the current line to r, styled, and prefixed if it starts the line.
+func (x *prefixer) appendFragment(r []byte) []byte {
+	if !x.mid {
+		r = append(r, x.prefix...)
+	}
+	r = append(r, x.start...)
+	r = append(r, x.buf...)
+	r = append(r, x.end...)
+	x.buf = x.buf[:0]
+	return r
+}
+
+// idle forwards the start of the current line.
+func (x *prefixer) idle() {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+
+	if len(x.buf) == 0 {
+		return
+	}
+	r := x.appendFragment(nil)
+	x.mid = true
+	x.dst.Write(r)
+}
+
+// Flush forwards the current line, if any, terminating it.
+func (x *prefixer) Flush() error {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+
+	if x.timer != nil {
+		x.timer.Stop()
+	}
+	if len(x.buf) == 0 && !x.mid {
+		return nil
 	}
-	_, err := x.dst.Write(x.buf)
-	x.buf = x.buf[:x.n]
-	return len(b), err
+	_, err := x.dst.Write(x.appendLine(nil, []byte{'\n'}))
+	return err
 }
 
 // A config wraps a lib.Proc with pipe targets.
 type config struct {
 	lib.Proc
-	stdout io.Writer
-	stderr io.Writer
+	namespace string    // parent route namespace
+	runId     string    // parent route run identifier
+	stdin     io.Reader // forwarded client stdin; may be nil
+	stdout    io.Writer
+	stderr    io.Writer
+	messages  io.Writer // op's own messages about the process
+	color     bool      // color the prefixes of lines written to stdout and stderr
+	truncated *int64    // truncated output lines of the route run, counted atomically
+
+	pipeIn  *os.File // read end of the pipeline from the proc named by In; may be nil
+	pipeOut *os.File // write end of the pipeline to a consumer proc; replaces Out if set
 }
 
+// errCanceled is returned by processes that have been interrupted by op.
+var errCanceled = errors.New("canceled")
+
 var (
 	mainCtx     context.Context
 	mainCancel  context.CancelFunc
@@ -87,9 +191,13 @@ func cleanup() {
 	}
 
 	mainCancel()
-	// wait for io and routes
+	// wait for io, routes and auxiliary commands
 	ioWg.Wait()
 	<-routesDone
+	recoverWg.Wait()
+	auxWg.Wait()
+	stopShipping()
+	reportForced()
 
 	os.Remove(lib.LockPath)
 
@@ -121,25 +229,232 @@ func (x procPipe) run() error {
 	return err
 }
 
+var signals = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"KILL":  syscall.SIGKILL,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"TERM":  syscall.SIGTERM,
+	"CONT":  syscall.SIGCONT,
+	"STOP":  syscall.SIGSTOP,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// parseSignal returns the signal with the given name, with or without the "SIG" prefix.
+func parseSignal(s string) (syscall.Signal, error) {
+	sig, ok := signals[strings.TrimPrefix(strings.ToUpper(s), "SIG")]
+	if !ok {
+		return 0, errors.New("unknown signal " + s)
+	}
+	return sig, nil
+}
+
+// checkExecutable returns an error if the executable of p cannot be found.
+// Procs whose path is interpreted elsewhere (remote host, container or chroot) are not checked.
+func checkExecutable(p lib.Proc) error {
+	if p.Host != "" || p.Image != "" || p.Chroot != "" {
+		return nil
+	}
+	if _, err := exec.LookPath(p.Path); err != nil {
+		if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("executable %q not found", p.Path)
+		}
+		return err
+	}
+	return nil
+}
+
+// createOutput opens the named output file for writing, creating it, along with missing parent directories, if necessary.
+// Existing contents are truncated, unless appending.
+// If umask is not negative, created files and directories get their mode set explicitly, so that the server umask does not apply.
+func createOutput(path string, append bool, umask int) (*os.File, error) {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if append {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	if umask < 0 {
+		f, err := os.OpenFile(path, flag, 0666)
+		if errors.Is(err, os.ErrNotExist) {
+			if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+				return nil, err
+			}
+			f, err = os.OpenFile(path, flag, 0666)
+		}
+		return f, err
+	}
+
+	if err := mkdirMode(filepath.Dir(path), os.FileMode(0777&^umask)); err != nil {
+		return nil, err
+	}
+	// only a file created here gets its mode set
+	f, err := os.OpenFile(path, flag|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return os.OpenFile(path, flag, 0666)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(os.FileMode(0666 &^ umask)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// openSinks returns a writer that fans out to all the given output sinks, along with the files it opened, created under umask.
+// The "std" sink is written to std, and the "syslog" and "journal" sinks to the writers returned by service.
+// File and service sink errors are reported, prefixed by desc, and never stop the output from reaching the other sinks.
+func openSinks(desc string, sinks lib.Output, appendMode bool, umask int, std io.Writer, service func(name string) (io.Writer, error)) (io.Writer, []*os.File, error) {
+	var (
+		ws    []io.Writer
+		files []*os.File
+	)
+	for _, sink := range sinks {
+		var (
+			w   io.Writer
+			err error
+		)
+		switch sink {
+		case "std":
+			w = std
+		case "syslog", "journal":
+			if w, err = service(sink); err == nil {
+				w = &sinkWriter{dst: w, desc: desc + " " + sink}
+			}
+		default:
+			var f *os.File
+			if f, err = createOutput(sink, appendMode, umask); err == nil {
+				files = append(files, f)
+				w = &sinkWriter{dst: f, desc: desc + " " + sink}
+			}
+		}
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, nil, err
+		}
+		ws = append(ws, w)
+	}
+
+	if len(ws) == 1 {
+		return ws[0], files, nil
+	}
+	return fanOut(ws), files, nil
+}
+
+// A sinkWriter absorbs the errors of an output sink, so that they do not interrupt output collection.
+// The first error of a streak is reported; the output written meanwhile is lost for that sink.
+type sinkWriter struct {
+	dst     io.Writer
+	desc    string
+	failing bool
+}
+
+func (x *sinkWriter) Write(b []byte) (int, error) {
+	if _, err := x.dst.Write(b); err != nil {
+		if !x.failing {
+			stderr.Println(x.desc+" error:", err)
+		}
+		x.failing = true
+	} else {
+		x.failing = false
+	}
+	return len(b), nil
+}
+
+// A fanOut writes to all its writers, unlike io.MultiWriter, even if some of them fail.
+type fanOut []io.Writer
+
+func (x fanOut) Write(b []byte) (int, error) {
+	for _, w := range x {
+		w.Write(b)
+	}
+	return len(b), nil
+}
+
 // A proc is like a standard library exec.Cmd with context, but uses sigint instead of kill.
 // Will fall back to sigkill if process doesn't exit within a timeout.
 type proc struct {
-	name  string // unique identifier
-	route string // parent route
+	name      string // unique identifier
+	namespace string // parent route namespace
+	route     string // parent route
+	runId     string // parent route run identifier
 
-	cancel context.CancelFunc
-	done   <-chan struct{}
+	routeCtx context.Context // parent route context, for auxiliary commands that may outlive the process
+	cancel   context.CancelFunc
+	done     <-chan struct{}
 
-	cmd *exec.Cmd
+	cmd       *exec.Cmd
+	interrupt func() error // sends the cancel signal, for processes that cannot be signaled locally; may be nil; otherwise a terminator is used
 
 	// config values, to use on restart
 	inCfg  string
-	outCfg string
-	errCfg string
+	outCfg lib.Output
+	errCfg lib.Output
+
+	banner bool // write banners into output files
+
+	retries      int           // allowed failed runs
+	retryBackoff time.Duration // delay before first retry
+
+	detached bool // left running on server shutdown
+
+	ptyMaster *os.File // nil if not running under a pseudo-terminal
+	ptySlave  *os.File
+
+	childEnds  []*os.File // pipe ends held by the process, closed by the server once it has started
+	serverEnds []*os.File // pipe ends used by the server, closed once the process has exited
+
+	pipeIn  *os.File // pipeline ends; nil if not part of a pipeline
+	pipeOut *os.File
+
+	watch []string // paths whose changes restart the process
+
+	usage    rusage // resources consumed, once exited
+	exitCode int    // exit code, once exited; -1 if terminated by a signal
+	exited   bool   // the process has been started and has exited
+
+	core *lib.Core // core dump policy; nil if inherited
+
+	secrets      map[string]lib.Secret // secret sources
+	secretPoll   time.Duration         // secret watch interval; 0 means no watch
+	secretValues map[string]string     // currently applied secret values
+
+	// priorities, applied right after start
+	nice        *int
+	ionice      *int
+	oomScoreAdj *int
 
 	inPipe  procPipe
+	inFile  *os.File // source of inPipe, if read from a file
 	outPipe procPipe
 	errPipe procPipe
+	opened  []io.Closer // every handle opened for the process, closed if it does not start
+
+	input    io.WriteCloser // stdin of interactive processes, written by attached clients; nil otherwise
+	inputMux sync.Mutex     // serializes input writes
+
+	outFiles []*os.File  // files stdout is written to
+	errFiles []*os.File  // files stderr is written to
+	services []io.Closer // syslog and journal connections
+
+	notify io.Writer // target for trigger notifications
+
+	flushers []flusher // output buffers to flush on exit, innermost first
+
+	outTrunc *truncator // nil if line lengths are unlimited
+	errTrunc *truncator
+
+	health *lib.HealthCheck // liveness check; nil if none
+
+	mux       sync.Mutex // guards ready, restart, scaled, unhealthy and the start of cmd
+	ready     bool       // marked ready by a trigger
+	restart   bool       // canceled in order to be restarted
+	scaled    bool       // canceled by a scale down
+	unhealthy string     // last health check error, if canceled by it
 }
 
 func newProc(ctx context.Context, route string, cfg config) (x *proc, err error) {
@@ -150,149 +465,740 @@ func newProc(ctx context.Context, route string, cfg config) (x *proc, err error)
 		}
 	}()
 
-	ctx, cancel := context.WithCancel(ctx)
+	// handles opened so far are closed on failure, since restarts and retries may call newProc again and again
+	var (
+		cmd    *exec.Cmd
+		opened []io.Closer
+	)
+	defer func() {
+		if err != nil {
+			releaseHandles(opened)
+		}
+	}()
+
+	retryBackoff := time.Duration(cfg.RetryBackoff)
+	if retryBackoff == 0 {
+		retryBackoff = defaultBackoff
+	}
+
+	umask := -1
+	if cfg.Umask != "" {
+		var n uint64
+		if n, err = strconv.ParseUint(cfg.Umask, 8, 32); err != nil {
+			errStr = "umask"
+			return
+		}
+		umask = int(n)
+	}
 
-	cmd := exec.Command(cfg.Path, cfg.Args...)
-	cmd.Dir = cfg.Dir
-	env := make([]string, 0, len(cfg.Env))
-	for k, v := range cfg.Env {
-		env = append(env, k+"="+v)
+	// config is checked before anything is opened or started, so that a mistake leaves previous output files intact
+	var continuation *regexp.Regexp
+	if cfg.Continuation != "" {
+		if continuation, err = regexp.Compile(cfg.Continuation); err != nil {
+			errStr = "continuation"
+			return
+		}
+	}
+	var logFilter *logFilter
+	if cfg.LogFilter != nil {
+		if logFilter, err = compileLogFilter(*cfg.LogFilter); err != nil {
+			errStr = "log filter"
+			return
+		}
+	}
+	triggers := cfg.Triggers
+	if cfg.Ready != nil && cfg.Ready.Log != "" {
+		triggers = append(triggers[:len(triggers):len(triggers)], lib.Trigger{Match: cfg.Ready.Log, Action: "ready"})
+	}
+	outTriggers, errTriggers, err := compileTriggers(triggers)
+	if err != nil {
+		errStr = "trigger"
+		return
 	}
-	cmd.Env = env
 
-	prefix := []byte(route + "|" + cfg.Name + ": ")
+	secrets, err := resolveSecrets(ctx, cfg.Secrets, route+"|"+cfg.Name)
+	if err != nil {
+		errStr = "secret"
+		return
+	}
 
-	// setup stdin funnel
-	var inPipe procPipe
-	if cfg.In != "" {
-		inPipe.dst, err = cmd.StdinPipe()
+	// remote procs start from the environment of the remote account, so the server environment is not forwarded
+	inherit := cfg.InheritEnv
+	if cfg.Host != "" {
+		inherit = nil
+	}
+	// metadata takes precedence, so that procs run by nested op instances get their own
+	env := merge(metaEnv(cfg.namespace, route, cfg.Name, cfg.runId), merge(secrets, baseEnv(inherit, cfg.EnvPass, cfg.Env)))
+	var interrupt func() error
+	if cfg.Host != "" {
+		var cleanup io.Closer
+		if cmd, interrupt, cleanup, err = remoteCmd(ctx, cfg, env); err != nil {
+			errStr = "remote"
+			return
+		}
+		opened = append(opened, cleanup)
+	} else if cfg.Image != "" {
+		if cmd, err = containerCmd(cfg, env, cfg.Runtime); err != nil {
+			errStr = "container"
+			return
+		}
+	} else {
+		cmd = exec.Command(cfg.Path, cfg.Args...)
+		cmd.Dir = cfg.Dir
+		cmd.Env = envList(env)
+	}
+
+	if cfg.Interactive && (cfg.pipeIn != nil || cfg.In != "" || cfg.InText != "" || cfg.Detached) {
+		errStr = "interactive"
+		err = errors.New("interactive procs may not have other input, or be detached")
+		return
+	}
+
+	// the pseudo-terminal would replace the pipeline ends, or be bypassed by them
+	if cfg.Tty && (cfg.pipeIn != nil || cfg.pipeOut != nil) {
+		errStr = "tty"
+		err = errors.New("procs under a tty may not be part of a pipeline")
+		return
+	}
+
+	// standard stream pipes are created here rather than through cmd, so that all their ends are known, and closed if the process does not start
+	var childEnds, serverEnds []*os.File
+	newPipe := func(child, server *os.File) {
+		opened = append(opened, child, server)
+		childEnds = append(childEnds, child)
+		serverEnds = append(serverEnds, server)
+	}
+	stdinPipe := func() (io.WriteCloser, error) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		newPipe(r, w)
+		cmd.Stdin = r
+		return w, nil
+	}
+	stderrPipe := func() (io.Reader, error) {
+		r, w, err := os.Pipe()
 		if err != nil {
+			return nil, err
+		}
+		newPipe(w, r)
+		cmd.Stderr = w
+		return r, nil
+	}
+
+	// setup stdin funnel
+	// interactive processes keep their stdin open for attached clients, unless the starting client forwards its own
+	var (
+		inPipe procPipe
+		inFile *os.File
+		input  io.WriteCloser
+	)
+	if cfg.pipeIn != nil {
+		cmd.Stdin = cfg.pipeIn
+	} else if cfg.In != "" {
+		if inPipe.dst, err = stdinPipe(); err != nil {
 			errStr = "stdin"
 			return
 		}
 
-		inPipe.src, err = os.Open(cfg.In)
-		if err != nil {
+		if inFile, err = os.Open(cfg.In); err != nil {
 			errStr = "in file"
 			return
 		}
+		opened = append(opened, inFile)
+		inPipe.src = inFile
+	} else if cfg.InText != "" {
+		if inPipe.dst, err = stdinPipe(); err != nil {
+			errStr = "stdin"
+			return
+		}
+		inPipe.src = strings.NewReader(cfg.InText)
+	} else if cfg.stdin != nil && !cfg.Tty {
+		if inPipe.dst, err = stdinPipe(); err != nil {
+			errStr = "stdin"
+			return
+		}
+		inPipe.src = cfg.stdin
+	} else if cfg.Interactive && !cfg.Tty {
+		if input, err = stdinPipe(); err != nil {
+			errStr = "stdin"
+			return
+		}
 	}
 
-	// setup stdout collection
+	// setup pseudo-terminal
+	// both stdout and stderr are written to it; stdin as well, if no input file is defined
 	var outPipe procPipe
-	if cfg.Out != "" {
-		outPipe.src, err = cmd.StdoutPipe()
+	var ptyMaster, ptySlave *os.File
+	if cfg.Tty {
+		ptyMaster, ptySlave, err = openPty()
 		if err != nil {
-			errStr = "stdout"
+			errStr = "pty"
 			return
 		}
+		opened = append(opened, ptyMaster, ptySlave)
+		cmd.Stdout = ptySlave
+		cmd.Stderr = ptySlave
+		if cfg.In == "" && cfg.InText == "" {
+			cmd.Stdin = ptySlave
+			if cfg.stdin != nil {
+				inPipe.dst = ptyWriter{ptyMaster}
+				inPipe.src = cfg.stdin
+			} else if cfg.Interactive {
+				input = ptyWriter{ptyMaster}
+			}
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Setsid:  true,
+			Setctty: true,
+			Ctty:    1,
+		}
 
-		if cfg.Out == "std" {
-			outPipe.dst = newPrefixer(prefix, cfg.stdout)
-		} else {
-			outPipe.dst, err = os.Create(cfg.Out)
+		// the terminal must be drained even if output is discarded
+		outPipe.src = ptyReader{ptyMaster}
+		outPipe.dst = io.Discard
+	}
+
+	// containers get their mounts from the runtime
+	if confined := cfg.Chroot != "" || len(cfg.Unshare) > 0 || cfg.Capabilities != nil; confined || len(cfg.Mounts) > 0 && cfg.Image == "" {
+		// only the local ssh or container runtime client would be confined
+		if cfg.Host != "" || cfg.Image != "" {
+			errStr = "confine"
+			err = errors.New("remote and container procs cannot be confined")
+			return
+		}
+		if err = confine(cmd, cfg); err != nil {
+			errStr = "confine"
+			return
+		}
+	}
+	// set last, so that the umask applies to whatever wraps the command, and is inherited by it
+	if umask >= 0 {
+		if err = setUmask(cmd, umask); err != nil {
+			errStr = "umask"
+			return
+		}
+	}
+	prepareTermination(cmd)
+
+	// detached processes write directly into files, and are not collected by the server
+	var detachFiles []*os.File
+	if cfg.Detached {
+		if cfg.Tty || cfg.pipeIn != nil || cfg.pipeOut != nil || len(cfg.Triggers) > 0 || cfg.Continuation != "" || cfg.MaxLine > 0 || cfg.LogFilter != nil || cfg.RateLimit != nil || cfg.Ready != nil && cfg.Ready.Log != "" {
+			errStr = "detach"
+			err = errors.New("output of detached procs cannot be processed")
+			return
+		}
+
+		cmd.Stdout, cmd.Stderr, detachFiles, err = detachOutput(cfg, umask)
+		if err != nil {
+			errStr = "detach output"
+			return
+		}
+		for _, f := range detachFiles {
+			opened = append(opened, f)
+		}
+		cfg.Out, cfg.Err = nil, nil
+
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.Setsid = true
+	}
+
+	// setup stdout collection
+	// if merged, stderr is written into the same pipe, preserving ordering
+	merged := len(cfg.Err) == 1 && cfg.Err[0] == "out" && !cfg.Tty
+
+	// pipeline producers write directly into their consumer
+	if cfg.pipeOut != nil {
+		cmd.Stdout = cfg.pipeOut
+		if merged {
+			cmd.Stderr = cfg.pipeOut
+		}
+		cfg.Out = nil
+	}
+	stdoutPipe := func() (io.Reader, error) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		newPipe(w, r)
+		cmd.Stdout = w
+		if merged {
+			cmd.Stderr = w
+		}
+		return r, nil
+	}
+
+	var (
+		outFiles     []*os.File
+		sinkFlushers []flusher // client writers and service sinks, which buffer lines
+		services     []io.Closer
+	)
+	clientWriter := func(w io.Writer, err bool) io.Writer {
+		cw := newClientWriter(w, cfg.namespace, route, cfg.Name, err, cfg.color)
+		if f, ok := cw.(flusher); ok {
+			sinkFlushers = append(sinkFlushers, f)
+		}
+		return cw
+	}
+	serviceWriter := func(err bool) func(string) (io.Writer, error) {
+		return func(name string) (io.Writer, error) {
+			var (
+				s interface {
+					io.WriteCloser
+					flusher
+				}
+				e error
+			)
+			if name == "syslog" {
+				s, e = newSyslogSink(cfg.Syslog, route, cfg.Name, err)
+			} else {
+				s, e = newJournalSink(cfg.namespace, route, cfg.Name, err)
+			}
+			if e != nil {
+				return nil, e
+			}
+			services = append(services, s)
+			opened = append(opened, s)
+			sinkFlushers = append(sinkFlushers, s)
+			return s, nil
+		}
+	}
+	if len(cfg.Out) > 0 {
+		if !cfg.Tty {
+			outPipe.src, err = stdoutPipe()
 			if err != nil {
-				errStr = "out file"
+				errStr = "stdout"
 				return
 			}
 		}
+
+		outPipe.dst, outFiles, err = openSinks(route+"|"+cfg.Name+" out", cfg.Out, cfg.Append, umask, clientWriter(cfg.stdout, false), serviceWriter(false))
+		if err != nil {
+			errStr = "out file"
+			return
+		}
+		for _, f := range outFiles {
+			opened = append(opened, f)
+		}
 	}
 
 	// setup stderr collection
 	var errPipe procPipe
-	if cfg.Err != "" {
-		errPipe.src, err = cmd.StderrPipe()
+	var errFiles []*os.File
+	if len(cfg.Err) > 0 && !cfg.Tty && !merged {
+		errPipe.src, err = stderrPipe()
 		if err != nil {
 			errStr = "stderr"
 			return
 		}
 
-		if cfg.Err == "std" {
-			errPipe.dst = newPrefixer(prefix, cfg.stderr)
-		} else {
-			errPipe.dst, err = os.Create(cfg.Err)
-			if err != nil {
-				errStr = "err file"
-				return
-			}
+		errPipe.dst, errFiles, err = openSinks(route+"|"+cfg.Name+" err", cfg.Err, cfg.Append, umask, clientWriter(cfg.stderr, true), serviceWriter(true))
+		if err != nil {
+			errStr = "err file"
+			return
+		}
+		for _, f := range errFiles {
+			opened = append(opened, f)
 		}
 	}
 
-	return &proc{
-		name:    cfg.Name,
-		route:   route,
-		cancel:  cancel,
-		done:    ctx.Done(),
-		cmd:     cmd,
-		inCfg:   cfg.In,
-		outCfg:  cfg.Out,
-		errCfg:  cfg.Err,
-		inPipe:  inPipe,
-		outPipe: outPipe,
-		errPipe: errPipe,
-	}, nil
-}
+	// a stream must be collected if any trigger watches it
+	// under a pseudo-terminal, both streams are read through stdout
+	if cfg.Tty || merged {
+		outTriggers = append(outTriggers, errTriggers...)
+		errTriggers = nil
+	}
+	if len(outTriggers) > 0 && outPipe.src == nil {
+		if outPipe.src, err = stdoutPipe(); err != nil {
+			errStr = "stdout"
+			return
+		}
+		outPipe.dst = io.Discard
+	}
+	if len(errTriggers) > 0 && errPipe.src == nil {
+		if errPipe.src, err = stderrPipe(); err != nil {
+			errStr = "stderr"
+			return
+		}
+		errPipe.dst = io.Discard
+	}
 
-func (x *proc) run() error {
-	// start execution
-	if err := x.cmd.Start(); err != nil {
-		return fmt.Errorf("start error: %w", err)
+	routeCtx := ctx
+	ctx, cancel := context.WithCancel(ctx)
+
+	x = &proc{
+		name:         cfg.Name,
+		namespace:    cfg.namespace,
+		route:        route,
+		routeCtx:     routeCtx,
+		interrupt:    interrupt,
+		runId:        cfg.runId,
+		cancel:       cancel,
+		done:         ctx.Done(),
+		cmd:          cmd,
+		inCfg:        cfg.In,
+		outCfg:       cfg.Out,
+		errCfg:       cfg.Err,
+		banner:       cfg.Banner,
+		detached:     cfg.Detached,
+		retries:      cfg.Retries,
+		retryBackoff: retryBackoff,
+		ptyMaster:    ptyMaster,
+		ptySlave:     ptySlave,
+		childEnds:    childEnds,
+		serverEnds:   serverEnds,
+		pipeIn:       cfg.pipeIn,
+		pipeOut:      cfg.pipeOut,
+		watch:        cfg.Watch,
+		health:       cfg.HealthCheck,
+		core:         cfg.Core,
+		secrets:      cfg.Secrets,
+		secretPoll:   time.Duration(cfg.SecretPoll),
+		secretValues: secrets,
+		nice:         cfg.Nice,
+		ionice:       cfg.IONice,
+		oomScoreAdj:  cfg.OOMScoreAdj,
+		inPipe:       inPipe,
+		inFile:       inFile,
+		opened:       opened,
+		input:        input,
+		outPipe:      outPipe,
+		errPipe:      errPipe,
+		outFiles:     append(outFiles, detachFiles...),
+		errFiles:     errFiles,
+		notify:       cfg.messages,
+		services:     services,
+		flushers:     sinkFlushers,
 	}
 
-	// funnel input
-	go func() {
-		if err := x.inPipe.run(); err != nil && err != io.EOF {
-			stderr.Println(x.name+" stdin read error:", err)
+	// limit innermost, so that filtered lines do not count, triggers still see dropped lines, and records are dropped as a whole
+	if cfg.RateLimit != nil && (cfg.RateLimit.Lines > 0 || cfg.RateLimit.Bytes > 0) {
+		for _, p := range []*procPipe{&x.outPipe, &x.errPipe} {
+			if p.dst == nil {
+				continue
+			}
+			l := newRateLimiter(p.dst, cfg.RateLimit.Lines, int(cfg.RateLimit.Bytes), continuation != nil)
+			p.dst = l
+			x.flushers = append(x.flushers, l)
 		}
-		if x.inPipe.dst != nil {
-			x.inPipe.dst.(io.Closer).Close()
+	}
+
+	// filter next, for the same reasons
+	if logFilter != nil {
+		for _, p := range []*procPipe{&x.outPipe, &x.errPipe} {
+			if p.dst == nil {
+				continue
+			}
+			f := &filter{dst: p.dst, lf: logFilter, records: continuation != nil}
+			p.dst = f
+			x.flushers = append(x.flushers, f)
 		}
-	}()
+	}
 
-	// must read stdout and stderr before cmd.Wait()
-	wg := sync.WaitGroup{}
-	wg.Add(2)
-	go func() {
-		if err := x.outPipe.run(); err != nil {
-			stderr.Println(x.name+" stdout read error:", err)
+	// group before triggers, so they see individual lines
+	if continuation != nil {
+		if x.outPipe.dst != nil {
+			g := newGrouper(x.outPipe.dst, continuation)
+			x.outPipe.dst = g
+			x.flushers = append(x.flushers, g)
 		}
-		wg.Done()
-	}()
-	go func() {
-		if err := x.errPipe.run(); err != nil {
-			stderr.Println(x.name+" stderr read error:", err)
+		if x.errPipe.dst != nil {
+			g := newGrouper(x.errPipe.dst, continuation)
+			x.errPipe.dst = g
+			x.flushers = append(x.flushers, g)
 		}
-		wg.Done()
-	}()
+	}
 
-	chExit := make(chan error) // inform cancel goroutine process has exited
-	chRet := make(chan error)  // final return value from cancel goroutine
+	if len(outTriggers) > 0 {
+		x.outPipe.dst = &triggerWriter{dst: x.outPipe.dst, triggers: outTriggers, fire: x.fire}
+	}
+	if len(errTriggers) > 0 {
+		x.errPipe.dst = &triggerWriter{dst: x.errPipe.dst, triggers: errTriggers, fire: x.fire}
+	}
 
-	// cancel goroutine
+	// keep recent output in memory, ship it and archive it, as the process writes it
+	if lib.LogBufferSize > 0 || logShipper != nil || lib.RunRetention > 0 {
+		if x.outPipe.dst != nil {
+			t := newLogTap(x.outPipe.dst, cfg.runId, cfg.namespace, route, cfg.Name, false)
+			x.outPipe.dst = t
+			x.flushers = append(x.flushers, t)
+		}
+		if x.errPipe.dst != nil {
+			t := newLogTap(x.errPipe.dst, cfg.runId, cfg.namespace, route, cfg.Name, true)
+			x.errPipe.dst = t
+			x.flushers = append(x.flushers, t)
+		}
+	}
+
+	// bound line lengths first, right after reading, so that no stage buffers more than a line piece
+	if x.outPipe.dst != nil {
+		x.outPipe.dst = capLines(x.outPipe.dst, int(cfg.MaxLine))
+		x.outTrunc, _ = x.outPipe.dst.(*truncator)
+	}
+	if x.errPipe.dst != nil {
+		x.errPipe.dst = capLines(x.errPipe.dst, int(cfg.MaxLine))
+		x.errTrunc, _ = x.errPipe.dst.(*truncator)
+	}
+	for _, t := range []*truncator{x.outTrunc, x.errTrunc} {
+		if t != nil {
+			t.total = cfg.truncated
+			x.flushers = append(x.flushers, t)
+		}
+	}
+
+	return x, nil
+}
+
+func (x *proc) run() error {
+	// start execution, once the server process limit allows it
+	slotErr := x.acquireProcSlot()
+	var err error
+	if slotErr == nil {
+		defer releaseProcSlot()
+		x.mux.Lock() // signals may be sent concurrently, once the process exists
+		err = startWithCore(x.cmd, x.core)
+		x.mux.Unlock()
+	}
+
+	// pipeline ends must only be held by the processes, so that EOF propagates
+	if x.pipeIn != nil {
+		x.pipeIn.Close()
+	}
+	if x.pipeOut != nil {
+		x.pipeOut.Close()
+	}
+
+	if slotErr != nil || err != nil {
+		releaseHandles(x.opened)
+	}
+	if slotErr != nil {
+		return slotErr
+	}
+	if err != nil {
+		return fmt.Errorf("start error: %w", err)
+	}
+
+	if x.ptySlave != nil {
+		x.ptySlave.Close() // only the process should hold the terminal open
+	}
+	for _, f := range x.childEnds {
+		f.Close() // same for the standard stream pipes
+	}
+
+	term := newTerminator(x.cmd)
+	defer term.release()
+
+	start := time.Now()
+	pid := x.cmd.Process.Pid
+	if x.banner {
+		x.writeBanner("start pid=" + strconv.Itoa(pid) + " cmd=" + strconv.Quote(x.cmd.String()))
+	}
+
+	// recorded, so that another server may take over the process
+	rec := newRecord(x, start)
+	if err := rec.save(); err != nil {
+		stderr.Println(x.name+" proc record error:", err)
+	}
+
+	// apply priorities; failure is not fatal
+	if x.nice != nil {
+		if err := setNice(pid, *x.nice); err != nil {
+			stderr.Println(x.name+" nice error:", err)
+		}
+	}
+	if x.ionice != nil {
+		if err := setIONice(pid, *x.ionice); err != nil {
+			stderr.Println(x.name+" ionice error:", err)
+		}
+	}
+	if x.oomScoreAdj != nil {
+		if err := setOOMScoreAdj(pid, *x.oomScoreAdj); err != nil {
+			stderr.Println(x.name+" oom score error:", err)
+		}
+	}
+
+	if x.secretPoll > 0 && len(x.secrets) > 0 {
+		go x.watchSecrets()
+	}
+	if len(x.watch) > 0 {
+		go x.watchFiles()
+	}
+	if x.health != nil {
+		go x.watchHealth()
+	}
+
+	// funnel input
+	go func() {
+		if err := x.inPipe.run(); err != nil && err != io.EOF {
+			stderr.Println(x.name+" stdin read error:", err)
+		}
+		if x.inPipe.dst != nil {
+			x.inPipe.dst.(io.Closer).Close()
+		}
+		if x.inFile != nil {
+			x.inFile.Close()
+		}
+	}()
+
+	// must read stdout and stderr before cmd.Wait()
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		if err := x.outPipe.run(); err != nil {
+			stderr.Println(x.name+" stdout read error:", err)
+		}
+		wg.Done()
+	}()
+	go func() {
+		if err := x.errPipe.run(); err != nil {
+			stderr.Println(x.name+" stderr read error:", err)
+		}
+		wg.Done()
+	}()
+
+	chExit := make(chan error, 1) // inform cancel goroutine process has exited
+	chRet := make(chan error)     // final return value from cancel goroutine
+
+	// cancel goroutine
 	go func() {
 		var err error // return value
 		select {
 		case err = <-chExit:
 			x.cancel() // release context
 		case <-x.done:
+			if x.detached && mainCtx.Err() != nil {
+				err = errDetached
+				break
+			}
 			if x.inPipe.dst != nil {
 				x.inPipe.dst.(io.Closer).Close() // some programs will not exit until stdin is closed
 			}
-			x.cmd.Process.Signal(os.Interrupt)
-			t := time.AfterFunc(10*time.Second, func() {
-				x.cmd.Process.Kill()
+			if x.interrupt != nil {
+				go func() {
+					if err := x.interrupt(); err != nil {
+						stderr.Println(x.name+" interrupt error:", err)
+					}
+				}()
+			} else {
+				term.interrupt()
+			}
+			t := time.AfterFunc(killGrace, func() {
+				term.kill()
+				recordForced(x.route + "|" + x.name)
 			})
 			<-chExit
 			t.Stop()
-			err = errors.New("canceled")
+			err = errCanceled
 		}
 		chRet <- err
 	}()
 
-	wg.Wait()
-	chExit <- x.cmd.Wait()
+	// waits in the background, since detached processes may be left running
+	go func() {
+		wg.Wait()
+		for i := len(x.flushers) - 1; i >= 0; i-- {
+			x.flushers[i].Flush()
+		}
+		if n := x.truncated(); n > 0 {
+			x.notify.Write([]byte(x.route + "|" + x.name + ": " + strconv.Itoa(n) + " lines truncated\n"))
+		}
+		chExit <- x.cmd.Wait()
+	}()
 
-	return <-chRet
+	err = <-chRet
+	if err == errDetached {
+		x.closeFiles()
+		return err
+	}
+	rec.remove()
+	x.usage = newRusage(x.cmd.ProcessState, time.Since(start))
+	if state := x.cmd.ProcessState; state != nil {
+		x.exitCode, x.exited = state.ExitCode(), true
+	}
+	if err != errCanceled {
+		x.reportCrash()
+	} else if unhealthy := x.unhealthyError(); unhealthy != nil {
+		err = unhealthy
+	}
+	if x.banner {
+		result := "ok"
+		if err != nil {
+			result = err.Error()
+		}
+		x.writeBanner("end result=" + strconv.Quote(result) + " " + x.usage.String())
+	}
+	x.closeFiles()
+	if x.ptyMaster != nil {
+		x.ptyMaster.Close()
+	}
+	for _, f := range x.serverEnds {
+		f.Close()
+	}
+
+	return err
+}
+
+// A ptyReader reads from a pseudo-terminal master.
+// The EIO returned after the terminal has been closed by the other side is converted to EOF.
+type ptyReader struct {
+	f *os.File
+}
+
+func (x ptyReader) Read(b []byte) (int, error) {
+	n, err := x.f.Read(b)
+	if errors.Is(err, syscall.EIO) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// A ptyWriter writes to a pseudo-terminal master.
+// Closing it sends an end-of-transmission character, instead of closing the terminal.
+type ptyWriter struct {
+	f *os.File
+}
+
+func (x ptyWriter) Write(b []byte) (int, error) {
+	return x.f.Write(b)
+}
+
+func (x ptyWriter) Close() error {
+	_, err := x.f.Write([]byte{4})
+	return err
+}
+
+// files returns the output files of the process.
+func (x *proc) files() []*os.File {
+	return append(append([]*os.File{}, x.outFiles...), x.errFiles...)
+}
+
+// writeBanner writes a self-describing line into the output files of the process.
+func (x *proc) writeBanner(s string) {
+	line := "=== op " + s + " run=" + x.runId + " route=" + x.route + " proc=" + x.name + " time=" + time.Now().Format(time.RFC3339) + "\n"
+	for _, f := range x.files() {
+		f.Write([]byte(line))
+	}
+}
+
+// releaseHandles closes the given handles, for a process that will not be started.
+func releaseHandles(opened []io.Closer) {
+	for _, c := range opened {
+		c.Close()
+	}
+}
+
+// closeFiles closes the output files and service connections of the process.
+func (x *proc) closeFiles() {
+	for _, f := range x.files() {
+		f.Close()
+	}
+	for _, s := range x.services {
+		s.Close()
+	}
 }
 
 var (
@@ -349,11 +1255,12 @@ func activeRemove(namespace, name string) error {
 		return errors.New("not an active route")
 	}
 
-	rt.cancel()
+	rt.kill()
 	delete(ns, name)
 	if len(ns) == 0 {
 		delete(active, namespace)
 	}
+	stateChanged()
 
 	return nil
 }
@@ -373,47 +1280,318 @@ func activeSet(rt *route) error {
 	}
 
 	ns[rt.name] = rt
+	stateChanged()
 	return nil
 }
 
+// instanceName returns the active name of a route instance.
+// The main instance is named after the route itself.
+func instanceName(route, instance string) string {
+	if instance == "" {
+		return route
+	}
+	return route + "#" + instance
+}
+
+// activeInstance registers the route as active, like activeSet.
+// If the main instance is already active and the route allows more instances, the first free numbered instance is used instead.
+func (x *route) activeInstance() error {
+	err := activeSet(x)
+	if err == nil || x.name != x.base {
+		return err
+	}
+	for i := 2; i <= x.cfg.MaxInstances; i++ {
+		x.name = instanceName(x.base, strconv.Itoa(i))
+		if activeSet(x) == nil {
+			return nil
+		}
+	}
+	x.name = x.base
+	return err
+}
+
+// markStarted signals that the route is starting its hooks and procs, or is waiting for something else to happen first, so that the routes of the next priority of the same run may start.
+func (x *route) markStarted() {
+	x.startedOnce.Do(func() {
+		close(x.started)
+	})
+}
+
+// startOrder returns the given route names in the order they are started: by decreasing priority, then by name.
+func startOrder(manifest map[string]lib.Route) []string {
+	names := make([]string, 0, len(manifest))
+	for name := range manifest {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := manifest[names[i]].Priority, manifest[names[j]].Priority
+		if a != b {
+			return a > b
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// activeQueue registers the route as active, like activeInstance.
+// If its config queues duplicate runs and the route is already active, waits for the active run to terminate first.
+func (x *route) activeQueue() error {
+	queued := false
+	for {
+		err := x.activeInstance()
+		if err == nil || !x.cfg.Queue {
+			return err
+		}
+		prev, ok := activeGet(x.namespace, x.name)
+		if !ok {
+			continue
+		}
+
+		if !queued {
+			queued = true
+			x.stderr.Write([]byte(x.name + " queued until its active run terminates\n"))
+			x.markStarted()
+		}
+		select {
+		case <-prev.done:
+		case <-x.ctx.Done():
+			return errors.New("canceled while queued")
+		}
+	}
+}
+
 type route struct {
 	namespace string
-	name      string
+	name      string    // active name; instances are suffixed, see instanceName
+	base      string    // manifest name
+	id        string    // unique run identifier
+	cfg       lib.Route // route config; procs are held in tasks
 	tasks     []config
+	cleanup   []config // executed after the route stops
+
+	checkpoint bool // run all procs, so progress may be recorded; see checkpointed
+
+	concurrent bool // procs start as soon as their dependencies allow, instead of in order
+
+	stdout io.Writer
+	stderr io.Writer // op's own messages
+	errOut io.Writer // stderr output of hooks
 
-	ctx    context.Context
+	life context.Context    // route lifetime, across restarts
+	kill context.CancelFunc // terminates the route for good
+
+	ctx    context.Context // current run; replaced on restart
 	cancel context.CancelFunc
 	done   chan struct{} // blocks until route has terminated
 
-	mux    sync.Mutex // guard active
-	active string     // currently active process name
+	started     chan struct{} // closed once the route starts its hooks and procs, or waits before doing so
+	startedOnce sync.Once
+
+	slot chan struct{} // closed when a queued route may run; see acquireSlot
+
+	deps       []*route      // routes that must settle before this one starts
+	settled    chan struct{} // closed once all processes have succeeded or become ready
+	settleOnce sync.Once
+
+	mux      sync.Mutex // guard active, proc, tasks, restarts, exit code, pipes, services and servicesErr
+	active   string     // currently active process name
+	proc     *proc      // currently running process
+	restarts int        // process restarts, by trigger or retry
+	exitCode int        // exit code of the last exited process of the current run, if exited
+	exited   bool       // a process of the current run has exited
+	failed   string     // name of the first process that failed during the current run
+	up       bool       // the current run has settled; see settle
+	last     finished   // outcome of the last run
+	start    time.Time  // run start
+	usage    rusage     // accumulated usage of exited processes
+
+	truncated *int64 // truncated output lines of the current run, counted atomically by its processes
+
+	pipes map[string]*os.File // pipeline read ends, by producer name, until their consumer starts
+
+	services       []*proc        // ready processes still running in the background
+	servicesWg     sync.WaitGroup // signal all background processes terminated
+	servicesClosed bool           // no more background processes are accepted, during the current run; see reserveService
+	servicesErr    error          // first background process failure
 }
 
-func newRoute(ctx context.Context, namespace, name string, cfgs []lib.Proc, wout, werr io.Writer) *route {
+// newRoute returns a route whose processes and hooks write to win, wout and werr, while op's own messages go to wmsg.
+func newRoute(ctx context.Context, name string, cfg lib.Route, win io.Reader, wout, werr, wmsg io.Writer, color bool) *route {
 	// wrap raw configs
 	// autofill names if absent: process number in route, starting from 0
+	id := newRunId()
+	truncated := new(int64)
+	cfgs := cfg.Procs
 	tasks := make([]config, len(cfgs))
 	for i, _ := range cfgs {
 		tasks[i].Proc = cfgs[i]
 		if tasks[i].Name == "" {
 			tasks[i].Name = strconv.Itoa(i)
 		}
+		tasks[i].namespace = cfg.Namespace
+		tasks[i].runId = id
+		tasks[i].stdin = win
 		tasks[i].stdout = wout
 		tasks[i].stderr = werr
+		tasks[i].messages = wmsg
+		tasks[i].color = color
+		tasks[i].truncated = truncated
+	}
+	cleanup := make([]config, len(cfg.Cleanup))
+	for i := range cfg.Cleanup {
+		cleanup[i].Proc = cfg.Cleanup[i]
+		if cleanup[i].Name == "" {
+			cleanup[i].Name = "cleanup" + strconv.Itoa(i)
+		}
+		cleanup[i].namespace = cfg.Namespace
+		cleanup[i].runId = id
+		cleanup[i].stdout = wout
+		cleanup[i].stderr = werr
+		cleanup[i].messages = wmsg
+		cleanup[i].color = color
+		cleanup[i].truncated = truncated
+	}
+
+	concurrent := cfg.Parallel
+	for _, p := range cfgs {
+		if len(p.DependsOn) > 0 {
+			concurrent = true
+		}
 	}
 
-	rtCtx, cfn := context.WithCancel(ctx)
+	life, kill := context.WithCancel(ctx)
+	rtCtx, cfn := context.WithCancel(life)
 
 	return &route{
-		namespace: namespace,
-		name:      name,
-		tasks:     tasks,
-		ctx:       rtCtx,
-		cancel:    cfn,
-		done:      make(chan struct{}),
+		namespace:  cfg.Namespace,
+		name:       name,
+		base:       name,
+		id:         id,
+		cfg:        cfg,
+		tasks:      tasks,
+		cleanup:    cleanup,
+		truncated:  truncated,
+		concurrent: concurrent,
+		stdout:     wout,
+		stderr:     wmsg,
+		errOut:     werr,
+		life:       life,
+		kill:       kill,
+		ctx:        rtCtx,
+		cancel:     cfn,
+		done:       make(chan struct{}),
+		started:    make(chan struct{}),
+		settled:    make(chan struct{}),
+		pipes:      make(map[string]*os.File),
 	}
 }
 
+// Route restart policies.
+const (
+	restartOnFailure = "on-failure"
+	restartAlways    = "always"
+)
+
+const (
+	defaultBackoff  = time.Second // route restart and proc retry backoff, if not configured
+	backoffShiftMax = 10          // bounds the doubling of the route restart and proc retry backoffs
+)
+
+// Timing holds the server defaults and limits that shape the timeline of a route run.
+type Timing struct {
+	Backoff        time.Duration // route restart and proc retry backoff, if not configured
+	BackoffShift   int           // doublings of the route restart and proc retry backoffs
+	HealthInterval time.Duration // health check interval, if not configured
+	HealthFailures int           // failed health checks that interrupt a proc, if not configured
+	WatchDebounce  time.Duration // quiet period after a file change, before a watch restart
+}
+
+// Defaults returns the timing defaults of the server, so that simulations follow them.
+func Defaults() Timing {
+	return Timing{
+		Backoff:        defaultBackoff,
+		BackoffShift:   backoffShiftMax,
+		HealthInterval: healthInterval,
+		HealthFailures: healthFailures,
+		WatchDebounce:  watchDebounce,
+	}
+}
+
+// restartDelay returns the delay before running the route again, after a run that ended with err.
+// attempt is the number of consecutive failed runs before this one.
+// Returns false if the route must not be restarted.
+func (x *route) restartDelay(err error, attempt int) (time.Duration, bool) {
+	if x.life.Err() != nil || isDraining() {
+		return 0, false
+	}
+	switch x.cfg.Restart {
+	case restartAlways:
+	case restartOnFailure:
+		if err == nil {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+
+	backoff := time.Duration(x.cfg.RestartBackoff)
+	if backoff == 0 {
+		backoff = defaultBackoff
+	}
+	if err == nil {
+		return backoff, true
+	}
+	if x.cfg.RestartMax > 0 && attempt >= x.cfg.RestartMax {
+		return 0, false
+	}
+	if attempt > backoffShiftMax {
+		attempt = backoffShiftMax
+	}
+	return backoff << attempt, true
+}
+
+// runCtx returns the context of the current run, along with its cancelation.
+// Goroutines other than the one running the route must use it, since restarts replace them.
+func (x *route) runCtx() (context.Context, context.CancelFunc) {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	return x.ctx, x.cancel
+}
+
+// reset prepares the route for another run, under a new run identifier.
+func (x *route) reset() {
+	ctx, cancel := context.WithCancel(x.life)
+	id := newRunId()
+
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	x.ctx, x.cancel = ctx, cancel
+	x.id = id
+	for i := range x.tasks {
+		x.tasks[i].runId = id
+	}
+	for i := range x.cleanup {
+		x.cleanup[i].runId = id
+	}
+	x.proc = nil
+	x.failed = ""
+	x.up = false
+	x.servicesClosed = false
+	x.exited = false
+	x.servicesErr = nil
+	x.pipes = make(map[string]*os.File)
+	x.usage = rusage{}
+	atomic.StoreInt64(x.truncated, 0)
+	x.start = time.Now()
+}
+
+// newRunId returns a random identifier for a route run.
+func newRunId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 func (x *route) activeGet() string {
 	x.mux.Lock()
 	defer x.mux.Unlock()
@@ -424,20 +1602,514 @@ func (x *route) activeSet(name string) {
 	x.mux.Lock()
 	x.active = name
 	x.mux.Unlock()
+	stateChanged()
+}
+
+// procSet marks p as the currently running process.
+func (x *route) procSet(p *proc) {
+	x.mux.Lock()
+	x.active = p.name
+	x.proc = p
+	x.mux.Unlock()
+	stateChanged()
+}
+
+// consumed returns true if the i-th process is the input of a later one.
+// In concurrent routes, any other process counts.
+func (x *route) consumed(i int) bool {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	others := x.tasks[i+1:]
+	if x.concurrent {
+		others = x.tasks
+	}
+	for _, t := range others {
+		if t.In == lib.InProc+x.tasks[i].Name {
+			return true
+		}
+	}
+	return false
+}
+
+// pipeSet stores the read end of a pipeline, until its consumer starts.
+// A previous unconsumed read end of the same producer is closed.
+func (x *route) pipeSet(producer string, r *os.File) {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	if old, ok := x.pipes[producer]; ok {
+		old.Close()
+	}
+	x.pipes[producer] = r
+}
+
+// pipeTake removes and returns the read end of a pipeline.
+func (x *route) pipeTake(producer string) (*os.File, bool) {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	r, ok := x.pipes[producer]
+	delete(x.pipes, producer)
+	return r, ok
 }
 
-func (x *route) run() error {
-	if err := activeSet(x); err != nil {
+// pipeRelease closes the pipeline ends of a process that will not be started, including the read end kept for its consumer, if it is a producer.
+func (x *route) pipeRelease(cfg config, producer bool) {
+	if cfg.pipeOut != nil {
+		cfg.pipeOut.Close()
+	}
+	if cfg.pipeIn != nil {
+		cfg.pipeIn.Close()
+	}
+	if producer {
+		if r, ok := x.pipeTake(cfg.Name); ok {
+			r.Close()
+		}
+	}
+}
+
+// task returns the i-th process config.
+func (x *route) task(i int) config {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	return x.tasks[i]
+}
+
+// reload updates the route's process configs to cfgs, if they only differ in env values and every changed process defines a reload signal.
+// The signal is sent to the currently running process if its env changed.
+// Returns false if a full restart is required instead.
+func (x *route) reload(cfgs []lib.Proc) bool {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+
+	if len(cfgs) != len(x.tasks) {
+		return false
+	}
+
+	sigs := make([]os.Signal, len(cfgs)) // nil if env unchanged
+	for i, cfg := range cfgs {
+		if cfg.Name == "" {
+			cfg.Name = strconv.Itoa(i)
+		}
+		old := x.tasks[i].Proc
+
+		// compare everything except env and var, which have already been applied
+		a, b := cfg, old
+		a.Env, b.Env = nil, nil
+		a.Var, b.Var = nil, nil
+		if !reflect.DeepEqual(a, b) {
+			return false
+		}
+
+		if reflect.DeepEqual(cfg.Env, old.Env) {
+			continue
+		}
+		if cfg.Reload == "" {
+			return false
+		}
+		sig, err := parseSignal(cfg.Reload)
+		if err != nil {
+			stderr.Println(x.name+"|"+cfg.Name+" reload error:", err)
+			return false
+		}
+		sigs[i] = sig
+	}
+
+	for i, cfg := range cfgs {
+		if cfg.Name == "" {
+			cfg.Name = strconv.Itoa(i)
+		}
+		x.tasks[i].Proc = cfg
+		if sigs[i] == nil {
+			continue
+		}
+		// processes that have not been started yet cannot be signaled
+		if x.proc != nil && matchProc(cfg.Name, x.proc.name) {
+			if process := x.proc.process(); process != nil {
+				process.Signal(sigs[i])
+			}
+		}
+		for _, p := range x.services {
+			if p != x.proc && matchProc(cfg.Name, p.name) {
+				if process := p.process(); process != nil {
+					process.Signal(sigs[i])
+				}
+			}
+		}
+	}
+
+	return true
+}
+
+func (x *route) run() (err error) {
+	if err := x.activeQueue(); err != nil {
+		close(x.done) // release dependents
+		x.kill()
 		return err
 	}
 
+	x.start = time.Now()
+	logBufferReset(x.namespace, x.name)
 	defer func() {
+		// registered before the route stops counting as active, so that shutdown waits for the delivery
+		x.notify()
 		activeRemove(x.namespace, x.name)
 		close(x.done)
-		x.cancel()
+		x.kill()
 	}()
+
+	switch x.cfg.Restart {
+	case "", restartOnFailure, restartAlways:
+	default:
+		err = errors.New("unknown restart policy " + strconv.Quote(x.cfg.Restart))
+		x.report(err)
+		return err
+	}
+	switch x.cfg.Kind {
+	case "", kindTask, kindService:
+	default:
+		err = errors.New("unknown route kind " + strconv.Quote(x.cfg.Kind))
+		x.report(err)
+		return err
+	}
+
+	if err = x.waitDependencies(); err != nil {
+		x.report(err)
+		return err
+	}
+	// dependencies hold their slots while their dependents wait, so slots are only taken afterwards
+	if err = x.acquireSlot(); err != nil {
+		x.report(err)
+		return err
+	}
+	defer x.releaseSlot()
+
+	attempt := 0 // consecutive failed runs
+	for {
+		err = x.runOnce()
+		x.report(err)
+		if err != nil && x.life.Err() == nil {
+			x.runOnFailure(err)
+		}
+
+		// a run that came up before failing starts the backoff over
+		x.mux.Lock()
+		if x.up {
+			attempt = 0
+		}
+		x.mux.Unlock()
+
+		wait, ok := x.restartDelay(err, attempt)
+		if !ok {
+			return err
+		}
+		if err != nil {
+			attempt++
+			s := x.name + " error: " + err.Error() + "; restart " + strconv.Itoa(attempt)
+			if x.cfg.RestartMax > 0 {
+				s += "/" + strconv.Itoa(x.cfg.RestartMax)
+			}
+			x.stderr.Write([]byte(s + " in " + wait.String() + "\n"))
+		} else {
+			attempt = 0
+			x.stderr.Write([]byte(x.name + " restart in " + wait.String() + "\n"))
+		}
+
+		x.activeSet("restart wait")
+		x.markStarted()
+		t := time.NewTimer(wait)
+		select {
+		case <-x.life.Done():
+			t.Stop()
+			return err
+		case <-drainCh:
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+		x.reset()
+		x.countRestart()
+	}
+}
+
+// runOnce executes the route hooks and processes a single time.
+func (x *route) runOnce() (err error) {
+	if err := x.waitConditions(); err != nil {
+		return err
+	}
+
+	// released before the hooks, which may take long, so that they do not hold up the routes of lower priority
+	x.markStarted()
+
+	env := envList(baseEnv(x.cfg.InheritEnv, x.cfg.EnvPass, x.cfg.Env))
+	if err := runHooks(x.ctx, x.cfg.PreStart, env, "", x.name+"|prestart", x.stdout, x.errOut); err != nil {
+		x.activeSet("prestart error")
+		return fmt.Errorf("prestart error: %w", err)
+	}
+
+	err = x.runTasks()
+
+	// ready processes are stopped if the route aborts early
+	if err != nil {
+		x.cancel()
+	}
+	x.closeServices()
+	x.servicesWg.Wait()
+	if srvErr := x.servicesError(); srvErr != nil {
+		err = srvErr
+	}
+
+	// pipelines whose consumer never started
+	for _, r := range x.pipes {
+		r.Close()
+	}
+
+	// poststop hooks still run after the route is killed; only server shutdown interrupts them
+	if hookErr := runHooks(mainCtx, x.cfg.PostStop, env, "", x.name+"|poststop", x.stdout, x.errOut); hookErr != nil && err == nil {
+		x.activeSet("poststop error")
+		err = fmt.Errorf("poststop error: %w", hookErr)
+	}
+
+	if cleanErr := x.runCleanup(); cleanErr != nil && err == nil {
+		x.activeSet("cleanup error")
+		err = cleanErr
+	}
+
+	return err
+}
+
+// runCleanup executes the route's cleanup processes in order.
+// They are not interrupted by route kills, nor by server shutdown, which waits for them.
+// Failures do not stop the following processes; the first one is returned.
+func (x *route) runCleanup() error {
+	var first error
+	for i := range x.cleanup {
+		x.mux.Lock()
+		cfg := x.cleanup[i]
+		x.mux.Unlock()
+
+		x.activeSet(cfg.Name)
+		p, err := newProc(context.Background(), x.name, cfg)
+		if err == nil {
+			x.procSet(p)
+			err = checkExit(p.run(), cfg.SuccessCodes)
+			x.procExited(p)
+		}
+		if err != nil {
+			x.stderr.Write([]byte(x.name + "|" + cfg.Name + " cleanup error: " + err.Error() + "\n"))
+			if first == nil {
+				first = fmt.Errorf("%s cleanup error: %w", cfg.Name, err)
+			}
+		}
+	}
+	return first
+}
+
+// runOnFailure executes the route's on-failure hooks, after a run that failed with err.
+// The hooks receive the route env, the process that failed first as OP_PROC, and the error as OP_ERROR.
+// Their failures are only reported.
+func (x *route) runOnFailure(err error) {
+	if len(x.cfg.OnFailure) == 0 {
+		return
+	}
+
+	env := merge(metaEnv(x.namespace, x.name, x.failGet(), x.id), baseEnv(x.cfg.InheritEnv, x.cfg.EnvPass, x.cfg.Env))
+	env["OP_ERROR"] = err.Error()
+
+	x.activeSet("onfailure")
+	for i, hook := range x.cfg.OnFailure {
+		// like poststop hooks, only server shutdown interrupts them
+		if hookErr := runHook(mainCtx, hook, envList(env), "", x.name+"|onfailure", x.stdout, x.errOut); hookErr != nil {
+			x.stderr.Write([]byte(fmt.Sprintf("%s|onfailure %d warning: %v\n", x.name, i, hookErr)))
+		}
+	}
+}
+
+// runTasks executes the route processes, in order or concurrently.
+func (x *route) runTasks() error {
+	var (
+		err        error
+		background bool // the checkpoint stays at the first proc that moved to the background
+	)
+	if x.concurrent {
+		err = x.runGraph()
+	} else {
+		x.checkpointSave(0)
+		for i := range x.tasks {
+			if err = x.runTask(i); err != nil {
+				if x.ctx.Err() == nil {
+					x.failSet(x.task(i).Name)
+				}
+				break
+			}
+			// once a proc runs in the background, a resumed run must start it again, since later procs may need it
+			background = background || x.servicesCount() > 0
+			if !background {
+				x.checkpointSave(i + 1)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	x.settle()
+
+	// ready processes keep the route running until they exit
+	if x.servicesCount() > 0 {
+		if x.cfg.Kind == kindService {
+			x.activeSet("running")
+		} else {
+			x.activeSet("services")
+		}
+	}
+	x.closeServices()
+	x.servicesWg.Wait()
+	if err := x.servicesError(); err != nil {
+		x.activeSet("services error")
+		return err
+	}
+	if background {
+		x.checkpointRemove()
+	}
+
+	x.activeSet(x.outcome(nil))
+	return nil
+}
+
+// dependencies returns the indexes of the processes each route process must wait for: its DependsOn entries and its pipeline producer.
+// Returns an error if a dependency is not defined, or if they form a cycle.
+func (x *route) dependencies() ([][]int, error) {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+
+	index := make(map[string]int, len(x.tasks))
+	for i, t := range x.tasks {
+		index[t.Name] = i
+	}
+
+	deps := make([][]int, len(x.tasks))
+	for i, t := range x.tasks {
+		names := t.DependsOn
+		if src := strings.TrimPrefix(t.In, lib.InProc); src != t.In {
+			names = append(names[:len(names):len(names)], src)
+		}
+		for _, name := range names {
+			j, ok := index[name]
+			if !ok {
+				return nil, fmt.Errorf("%s dependency error: proc %s not defined", t.Name, name)
+			}
+			deps[i] = append(deps[i], j)
+		}
+	}
+
+	// depth first search; a process reached again while still on the stack closes a cycle
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(x.tasks))
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case visiting:
+			return fmt.Errorf("%s dependency error: cycle", x.tasks[i].Name)
+		case visited:
+			return nil
+		}
+		state[i] = visiting
+		for _, j := range deps[i] {
+			if err := visit(j); err != nil {
+				return err
+			}
+		}
+		state[i] = visited
+		return nil
+	}
+	for i := range x.tasks {
+		if err := visit(i); err != nil {
+			return nil, err
+		}
+	}
+
+	return deps, nil
+}
+
+// runGraph executes the route processes concurrently, each as soon as its dependencies have succeeded or become ready.
+// Pipeline consumers depend on their producer.
+// The first failure cancels the others.
+func (x *route) runGraph() error {
+	deps, err := x.dependencies()
+	if err != nil {
+		x.activeSet("dependency error")
+		return err
+	}
+
+	settled := make([]chan struct{}, len(x.tasks)) // closed once the task succeeded or moved to the background
+	for i := range settled {
+		settled[i] = make(chan struct{})
+	}
+
+	var (
+		wg     sync.WaitGroup
+		errMux sync.Mutex
+		first  error
+	)
+	for i := range x.tasks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for _, j := range deps[i] {
+				select {
+				case <-settled[j]:
+				case <-x.ctx.Done():
+					return
+				}
+			}
+
+			if err := x.runTask(i); err != nil {
+				errMux.Lock()
+				if first == nil && x.ctx.Err() == nil {
+					first = err
+					x.failSet(x.task(i).Name)
+				}
+				errMux.Unlock()
+				x.cancel()
+				return
+			}
+			close(settled[i])
+		}(i)
+	}
+	wg.Wait()
+
+	if first == nil && x.ctx.Err() != nil {
+		x.activeSet("canceled")
+		return errors.New("canceled")
+	}
+	return first
+}
+
+// failSet records the named process as the cause of the current run's failure, unless another one already failed first.
+func (x *route) failSet(name string) {
+	x.mux.Lock()
+	if x.failed == "" {
+		x.failed = name
+	}
+	x.mux.Unlock()
+}
+
+func (x *route) failGet() string {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	return x.failed
+}
+
+// runTask executes the i-th route process, including its retries and restarts.
+// Returns once the process has succeeded, failed for good, or moved to the background as a ready process.
+func (x *route) runTask(i int) error {
 	done := x.ctx.Done()
-	for _, cfg := range x.tasks {
+	attempt := 0    // failed runs of the task
+	copied := false // copies of multiple instance processes have been started
+	for {
 		// abort if context canceled
 		// needed if cancel triggers exactly between 2 processes
 		select {
@@ -447,20 +2119,155 @@ func (x *route) run() error {
 		default:
 		}
 
-		p, err := newProc(x.ctx, x.name, cfg)
-		if err != nil {
-			return fmt.Errorf("%s setup error: %w", p.name, err)
-		}
-		x.activeSet(p.name)
-		if err := p.run(); err != nil {
-			x.activeSet(x.active + " error")
-			return fmt.Errorf("%s run error: %w", p.name, err)
+		cfg := x.task(i)
+
+		// retries are already delayed by their backoff
+		if cfg.Delay > 0 && attempt == 0 {
+			x.activeSet(cfg.Name + " delay")
+			t := time.NewTimer(time.Duration(cfg.Delay))
+			select {
+			case <-done:
+				t.Stop()
+				x.activeSet("canceled")
+				return errors.New("canceled")
+			case <-t.C:
+			}
+		}
+
+		// pipeline producers run in the background, writing into their consumer's stdin
+		producer := x.consumed(i)
+		if producer {
+			r, w, err := os.Pipe()
+			if err != nil {
+				return fmt.Errorf("%s pipe error: %w", cfg.Name, err)
+			}
+			x.pipeSet(cfg.Name, r)
+			cfg.pipeOut = w
+		}
+		if src := strings.TrimPrefix(cfg.In, lib.InProc); src != cfg.In {
+			r, ok := x.pipeTake(src)
+			if !ok {
+				x.pipeRelease(cfg, producer)
+				return fmt.Errorf("%s input error: proc %s has not been started", cfg.Name, src)
+			}
+			cfg.pipeIn = r
+		}
+
+		hookPrefix := x.name + "|" + cfg.Name
+		if err := runHooks(x.ctx, cfg.PreStart, envList(baseEnv(cfg.InheritEnv, cfg.EnvPass, cfg.Env)), cfg.Dir, hookPrefix+"|prestart", cfg.stdout, cfg.stderr); err != nil {
+			x.pipeRelease(cfg, producer)
+			x.activeSet(cfg.Name + " prestart error")
+			return fmt.Errorf("%s prestart error: %w", cfg.Name, err)
+		}
+
+		// copies are started along with the first run, and supervised on their own
+		if !copied {
+			copied = true
+			for k := 2; k <= cfg.Instances; k++ {
+				if err := x.startCopy(i, cfg, k); err != nil {
+					x.pipeRelease(cfg, producer)
+					return err
+				}
+			}
+		}
+
+		p, err := newProc(x.ctx, x.name, cfg)
+		if err != nil {
+			x.pipeRelease(cfg, producer)
+			return fmt.Errorf("%s setup error: %w", cfg.Name, err)
+		}
+		x.procSet(p)
+
+		if cfg.Ready != nil || producer {
+			result := make(chan error, 1)
+			go func() {
+				result <- checkExit(p.run(), cfg.SuccessCodes)
+			}()
+
+			ready := true
+			if cfg.Ready != nil {
+				ready, err = waitReady(x.ctx, p, *cfg.Ready, result)
+			}
+			if ready {
+				if x.reserveService() {
+					x.supervise(i, p, cfg, result)
+					return nil
+				}
+				// the route is stopping, and the process along with it
+				err = <-result
+			}
+			x.procExited(p)
+		} else {
+			// listed alongside other concurrent processes while running
+			x.serviceAdd(p)
+			err = checkExit(p.run(), cfg.SuccessCodes)
+			x.serviceRemove(p)
+			x.procExited(p)
+		}
+
+		if hookErr := runHooks(mainCtx, cfg.PostStop, envList(baseEnv(cfg.InheritEnv, cfg.EnvPass, cfg.Env)), cfg.Dir, hookPrefix+"|poststop", cfg.stdout, cfg.stderr); hookErr != nil && err == nil {
+			x.activeSet(cfg.Name + " poststop error")
+			return fmt.Errorf("%s poststop error: %w", cfg.Name, hookErr)
+		}
+
+		if err == nil {
+			return nil
+		}
+		// pipeline ends cannot be opened again, so pipeline processes are neither restarted nor retried, like in supervise
+		pipeline := cfg.pipeIn != nil || cfg.pipeOut != nil
+		if p.restarting() && !pipeline {
+			x.countRestart()
+			continue
+		}
+		if attempt < p.retries && x.ctx.Err() == nil && !pipeline {
+			x.countRestart()
+			shift := attempt
+			if shift > backoffShiftMax {
+				shift = backoffShiftMax
+			}
+			wait := p.retryBackoff << shift
+			attempt++
+			x.stderr.Write([]byte(x.name + "|" + p.name + " error: " + err.Error() + "; retry " + strconv.Itoa(attempt) + "/" + strconv.Itoa(p.retries) + " in " + wait.String() + "\n"))
+			x.activeSet(p.name + " retry wait")
+
+			t := time.NewTimer(wait)
+			select {
+			case <-done:
+				t.Stop()
+			case <-t.C:
+			}
+			continue
+		}
+		x.activeSet(p.name + " error")
+		return fmt.Errorf("%s run error: %w", p.name, err)
+	}
+}
+
+// checkExit interprets the result of a process run according to the given success exit codes.
+// If no codes are given, err is returned unchanged.
+func checkExit(err error, codes []int) error {
+	if len(codes) == 0 {
+		return err
+	}
+
+	code := 0
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return err
 		}
-
+		code = exitErr.ExitCode()
 	}
 
-	x.activeSet("finished")
-	return nil
+	for _, c := range codes {
+		if c == code {
+			return nil
+		}
+	}
+	if err == nil {
+		err = errors.New("exit status 0")
+	}
+	return err
 }
 
 // String returns a formated string with the route's name and active process.
@@ -468,16 +2275,118 @@ func (x *route) String() string {
 	r := []byte(x.name)
 	r = append(r, '|')
 	r = append(r, x.activeGet()...)
+	r = append(r, x.queueString()...)
+	if x.ready() {
+		r = append(r, " (ready)"...)
+	}
+
+	x.mux.Lock()
+	for _, p := range x.services {
+		if p != x.proc {
+			r = append(r, " +"+p.name...)
+		}
+	}
+	start, restarts, code, exited := x.start, x.restarts, x.exitCode, x.exited
+	deprecated := x.cfg.Deprecated
+	x.mux.Unlock()
+
+	if pid := x.pid(); pid > 0 {
+		r = append(r, " pid="+strconv.Itoa(pid)...)
+	}
+	if !start.IsZero() {
+		r = append(r, " up="+time.Since(start).Round(time.Second).String()...)
+	}
+	if restarts > 0 {
+		r = append(r, " restarts="+strconv.Itoa(restarts)...)
+	}
+	if exited {
+		r = append(r, " exit="+strconv.Itoa(code)...)
+	}
+	if deprecated != "" {
+		r = append(r, " deprecated="+strconv.Quote(deprecated)...)
+	}
+
 	return string(r)
 }
 
+// status returns the state of the route, for JSON listings.
+func (x *route) status() lib.RouteStatus {
+	r := lib.RouteStatus{
+		Namespace: x.namespace,
+		Route:     x.name,
+		Active:    true,
+	}
+
+	x.mux.Lock()
+	r.Run = x.id
+	r.Start = x.start
+	r.State = x.active
+	r.Restarts = x.restarts
+	r.Deprecated = x.cfg.Deprecated
+	if x.exited {
+		code := x.exitCode
+		r.ExitCode = &code
+	}
+	p := x.proc
+	for _, s := range x.services {
+		if s != p {
+			r.Services = append(r.Services, s.name)
+		}
+	}
+	x.mux.Unlock()
+	r.Pid = x.pid()
+
+	// while a process runs, the route is active as its name
+	if p != nil && p.name == r.State {
+		r.Proc = p.name
+		r.State = "running"
+		if p.isReady() {
+			r.State = "ready"
+		}
+	}
+	return r
+}
+
+// ready returns true if the currently running process has been marked as ready.
+func (x *route) ready() bool {
+	x.mux.Lock()
+	p := x.proc
+	x.mux.Unlock()
+	return p != nil && p.isReady()
+}
+
 // command represents an op program command
 type command struct {
 	lib.Cmd
+	stdin  io.Reader // stdin source; may be nil
 	stdout io.Writer // stdout target
-	stderr io.Writer // stderr target
+	stderr io.Writer // stderr target, for op's own messages
+	errOut io.Writer // stderr target for process output, if op's messages go elsewhere; may be nil
+
+	ctx  context.Context
+	exit *int32 // client exit status; may be nil
+}
+
+// fail sets the client exit status, unless already set by an earlier failure.
+func (x command) fail(code int) {
+	if x.exit != nil {
+		atomic.CompareAndSwapInt32(x.exit, 0, int32(code))
+	}
+}
+
+// exitStatus returns the client exit status of the failed route; see finished.exitStatus.
+func (x *route) exitStatus() int {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	return x.last.exitStatus()
+}
 
-	ctx context.Context
+// errStream returns the target of process stderr output.
+func (x command) errStream() io.Writer {
+	if x.errOut != nil {
+		return x.errOut
+	}
+	return x.stderr
 }
 
 // executeExit kills all routes and terminates the current program even if it is a dedicated server
@@ -486,54 +2395,322 @@ func (x command) executeExit() {
 	<-routesDone
 }
 
-// executeKill cancels all active routes.
+// executeKill cancels all active routes, dependents before their dependencies.
 // If there is an argument, only that route is canceled.
 // Waits for termination.
 func (x command) executeKill() {
+	if x.Signal != "" {
+		x.executeSignal()
+		return
+	}
+
+	if members := x.group(); members != nil {
+		in := make(map[string]struct{}, len(members))
+		for _, name := range members {
+			in[name] = struct{}{}
+		}
+		var rts []*route
+		activeRange(x.Namespace, func(rt *route) {
+			if _, ok := in[rt.base]; ok {
+				rts = append(rts, rt)
+			}
+		})
+		killOrdered(rts)
+		return
+	}
+
+	if x.Instance != "" {
+		if rt, ok := activeGet(x.Namespace, instanceName(x.Route, x.Instance)); ok {
+			rt.kill()
+			<-rt.done
+		}
+		return
+	}
+	// all instances of the route
 	if x.Route != "" {
-		if rt, ok := activeGet(x.Namespace, x.Route); ok {
-			rt.cancel()
+		var rts []*route
+		activeRange(x.Namespace, func(rt *route) {
+			if rt.base == x.Route {
+				rts = append(rts, rt)
+			}
+		})
+		for _, rt := range rts {
+			rt.kill()
+		}
+		for _, rt := range rts {
 			<-rt.done
 		}
 		return
 	}
 
+	// dependents first
+	var rts []*route
 	activeRange(x.Namespace, func(rt *route) {
-		rt.cancel()
-		<-rt.done
+		rts = append(rts, rt)
 	})
+	killOrdered(rts)
 }
 
-// executeList writes a list of active routes to the command's stdout.
-// If there is an argument, only the active process of that route is written.
+// executeList writes a list of active routes to the command's stdout, followed by the last finished runs.
+// If there is an argument, only that route is written, or the group's routes.
+// With the Json flag, the list is written as a JSON array of lib.RouteStatus.
+// With the Watch flag, it is written again on every route state change; see watchList.
 func (x command) executeList() {
-	var r []byte
-	defer func() {
-		x.stdout.Write(r)
-	}()
+	if x.Watch {
+		x.watchList()
+		return
+	}
+	b, err := x.listing()
+	if err != nil {
+		x.stderr.Write([]byte("list encoding error: " + err.Error() + "\n"))
+		return
+	}
+	x.stdout.Write(b)
+}
 
-	if x.Route != "" {
-		rt, ok := activeGet(x.Namespace, x.Route)
-		if !ok {
-			return
+// listing returns the current list of the targeted routes, as text or as a JSON array.
+func (x command) listing() ([]byte, error) {
+	var (
+		rts []*route
+		fs  []finished
+	)
+	switch members := x.group(); {
+	case members != nil:
+		in := make(map[string]struct{}, len(members))
+		for _, name := range members {
+			in[name] = struct{}{}
 		}
-		r = append([]byte(rt.String()), '\n')
-		return
+		activeRange(x.Namespace, func(rt *route) {
+			if _, ok := in[rt.base]; ok {
+				rts = append(rts, rt)
+			}
+		})
+		historyRange(x.Namespace, func(f finished) {
+			base := f.name
+			if i := strings.IndexByte(base, '#'); i >= 0 {
+				base = base[:i]
+			}
+			if _, ok := in[base]; ok {
+				fs = append(fs, f)
+			}
+		})
+	case x.Route != "":
+		name := instanceName(x.Route, x.Instance)
+		if rt, ok := activeGet(x.Namespace, name); ok {
+			rts = append(rts, rt)
+		} else if f, ok := historyLast(x.Namespace, name); ok {
+			fs = append(fs, f)
+		}
+	default:
+		activeRange(x.Namespace, func(rt *route) {
+			rts = append(rts, rt)
+		})
+		historyRange(x.Namespace, func(f finished) {
+			fs = append(fs, f)
+		})
 	}
 
-	activeRange(x.Namespace, func(rt *route) {
+	if x.Json {
+		status := make([]lib.RouteStatus, 0, len(rts)+len(fs))
+		for _, rt := range rts {
+			status = append(status, rt.status())
+		}
+		for _, f := range fs {
+			status = append(status, f.status())
+		}
+		b, err := json.Marshal(status)
+		if err != nil {
+			return nil, err
+		}
+		return append(b, '\n'), nil
+	}
+
+	var r []byte
+	for _, rt := range rts {
 		r = append(r, rt.String()...)
 		r = append(r, '\n')
-	})
+	}
+	for _, f := range fs {
+		r = append(r, f.String()...)
+		r = append(r, '\n')
+	}
+	return r, nil
+}
+
+// restartProc restarts the named running process of the route in place, with its saved config, leaving the rest of the route running.
+func (x *route) restartProc(name string) error {
+	x.mux.Lock()
+	var p *proc
+	for _, s := range x.services {
+		if s.name == name {
+			p = s
+		}
+	}
+	x.mux.Unlock()
+
+	if p == nil {
+		return errors.New("process not running")
+	}
+	if p.pipeOut != nil || strings.HasPrefix(p.inCfg, lib.InProc) {
+		return errors.New("pipeline processes cannot be restarted alone")
+	}
+	x.stderr.Write([]byte(x.name + "|" + name + " restarting\n"))
+	p.requestRestart()
+	return nil
 }
 
 // executeRestart is a shorthand for kill + run.
 // Current config may differ from the initial one.
+//
+// Active routes whose config only differs in proc envs are reloaded instead, if the changed procs define a reload signal.
 func (x command) executeRestart() error {
-	x.executeKill()
+	if isDraining() {
+		return errDraining
+	}
+	// a single proc of an active route is restarted in place
+	if x.Proc != "" {
+		if rt, ok := activeGet(x.Namespace, instanceName(x.Route, x.Instance)); ok {
+			return rt.restartProc(x.Proc)
+		}
+	}
+
+	reloaded := x.reload()
+
+	if x.group() != nil {
+		var rts []*route
+		activeRange(x.Namespace, func(rt *route) {
+			if _, ok := reloaded[rt.base]; !ok && x.targets(rt.base, x.Config[rt.base]) {
+				rts = append(rts, rt)
+			}
+		})
+		killOrdered(rts)
+
+		manifest := make(map[string]lib.Route, len(x.Config))
+		for name, rt := range x.Config {
+			if _, ok := reloaded[name]; !ok {
+				manifest[name] = rt
+			}
+		}
+		x.Config = manifest
+		return x.executeRun()
+	}
+	if x.Route != "" {
+		if _, ok := reloaded[x.Route]; ok {
+			return nil
+		}
+		x.executeKill()
+		return x.executeRun()
+	}
+
+	activeRange(x.Namespace, func(rt *route) {
+		if _, ok := reloaded[rt.name]; ok {
+			return
+		}
+		rt.kill()
+		<-rt.done
+	})
+
+	manifest := make(map[string]lib.Route, len(x.Config))
+	for name, rt := range x.Config {
+		if _, ok := reloaded[name]; !ok {
+			manifest[name] = rt
+		}
+	}
+	x.Config = manifest
 	return x.executeRun()
 }
 
+// reload attempts to reload the active routes targeted by the command.
+// Returns the names of the routes that have been reloaded.
+func (x command) reload() map[string]struct{} {
+	r := make(map[string]struct{})
+	if x.Proc != "" {
+		return r
+	}
+
+	for name, cfg := range x.Config {
+		if !x.targets(name, cfg) {
+			continue
+		}
+		rt, ok := activeGet(cfg.Namespace, name)
+		if !ok {
+			continue
+		}
+		if rt.reload(cfg.Procs) {
+			r[name] = struct{}{}
+		}
+	}
+
+	return r
+}
+
+// group returns the routes of the group targeted by the command, or nil if it does not target a group.
+func (x command) group() []string {
+	if _, ok := x.Config[x.Route]; ok {
+		return nil
+	}
+	return x.Groups[x.Route]
+}
+
+// targets returns true if the command targets the named route: directly, through a group, or as a default route if there is no target.
+func (x command) targets(name string, cfg lib.Route) bool {
+	if x.Route == "" {
+		return cfg.Default
+	}
+	if members := x.group(); members != nil {
+		for _, member := range members {
+			if member == name {
+				return true
+			}
+		}
+		return false
+	}
+	return name == x.Route
+}
+
+// procsFrom returns the route processes starting with the named one.
+// Skipped processes count as succeeded for the dependencies of the remaining ones; reading the output of a skipped process is an error.
+func procsFrom(procs []lib.Proc, from string) ([]lib.Proc, error) {
+	names := make([]string, len(procs))
+	start := -1
+	for i, p := range procs {
+		names[i] = p.Name
+		if names[i] == "" {
+			names[i] = strconv.Itoa(i)
+		}
+		if names[i] == from && start < 0 {
+			start = i
+		}
+	}
+	if start < 0 {
+		return nil, errors.New("process not defined")
+	}
+
+	skipped := make(map[string]struct{}, start)
+	for _, name := range names[:start] {
+		skipped[name] = struct{}{}
+	}
+
+	r := make([]lib.Proc, 0, len(procs)-start)
+	for i, p := range procs[start:] {
+		if p.Name == "" {
+			p.Name = names[start+i] // keep the names, which default to indexes
+		}
+		if _, ok := skipped[strings.TrimPrefix(p.In, lib.InProc)]; ok && strings.HasPrefix(p.In, lib.InProc) {
+			return nil, fmt.Errorf("%s reads from skipped process %s", p.Name, strings.TrimPrefix(p.In, lib.InProc))
+		}
+		var deps []string
+		for _, dep := range p.DependsOn {
+			if _, ok := skipped[dep]; !ok {
+				deps = append(deps, dep)
+			}
+		}
+		p.DependsOn = deps
+		r = append(r, p)
+	}
+	return r, nil
+}
+
 // executeRun runs routes as defined by the config found at x.sw.
 // x.args may define selective execution within the config:
 //
@@ -543,10 +2720,29 @@ func (x command) executeRestart() error {
 //
 // Two arguments -> execute specific process in specific route
 func (x command) executeRun() error {
+	if isDraining() {
+		return errDraining
+	}
 	manifest := x.Config
+	if x.Instance != "" && (x.Route == "" || x.group() != nil) {
+		return errors.New("an instance requires a route")
+	}
+	if x.From != "" && (x.Route == "" || x.group() != nil || x.Proc != "") {
+		return errors.New("a start process requires a route, and no process")
+	}
 
 	// filter as needed
-	if x.Route != "" { // narrow to specified route
+	if members := x.group(); members != nil { // narrow to group routes
+		if x.Proc != "" {
+			return errors.New("a process cannot be selected in a group")
+		}
+		manifest = make(map[string]lib.Route, len(members))
+		for _, name := range members {
+			if rt, ok := x.Config[name]; ok {
+				manifest[name] = rt
+			}
+		}
+	} else if x.Route != "" { // narrow to specified route
 		rt, ok := manifest[x.Route]
 		if !ok {
 			return errors.New("route not defined")
@@ -563,27 +2759,125 @@ func (x command) executeRun() error {
 			if i == len(rt.Procs) {
 				return errors.New("process not defined")
 			}
-			rt.Procs = []lib.Proc{rt.Procs[i]}
+			// a lone proc runs regardless of its dependencies
+			p := rt.Procs[i]
+			p.DependsOn = nil
+			rt.Procs = []lib.Proc{p}
+			manifest[x.Route] = rt
+		} else if x.From != "" { // skip earlier processes
+			procs, err := procsFrom(rt.Procs, x.From)
+			if err != nil {
+				return err
+			}
+			rt.Procs = procs
 			manifest[x.Route] = rt
 		}
 	} else { // if no arguments, filter out non default routes
+		manifest = make(map[string]lib.Route)
+		for name, rt := range x.Config {
+			if rt.Default {
+				manifest[name] = rt
+			}
+		}
+	}
+
+	// dependencies are started along with their dependents, unless already active
+	added, err := addDependencies(manifest, x.Config)
+	if err != nil {
+		return err
+	}
+
+	// fail before anything starts if an executable is missing
+	for name, rt := range manifest {
+		for i, p := range append(rt.Procs[:len(rt.Procs):len(rt.Procs)], rt.Cleanup...) {
+			if err := checkExecutable(p); err != nil {
+				if p.Name == "" {
+					p.Name = strconv.Itoa(i)
+				}
+				return fmt.Errorf("%s|%s: %w", name, p.Name, err)
+			}
+		}
+	}
+
+	// forwarded stdin can only be consumed by one proc, which is never a dependency
+	if x.stdin != nil {
+		n := 0
 		for name, rt := range manifest {
-			if !rt.Default {
-				delete(manifest, name)
+			if _, ok := added[name]; !ok {
+				n += len(rt.Procs)
 			}
 		}
+		if n > 1 {
+			return errors.New("stdin forwarding requires a single proc")
+		}
+	}
+
+	// create all routes first, so dependents can be linked to them
+	rts := make(map[string]*route, len(manifest))
+	running := make(map[string]struct{}) // dependencies that are already active
+	for name, cfg := range manifest {
+		if _, ok := added[name]; ok {
+			if rt, ok := activeGet(cfg.Namespace, name); ok {
+				rts[name] = rt
+				running[name] = struct{}{}
+				continue
+			}
+			rts[name] = newRoute(x.ctx, name, cfg, nil, x.stdout, x.errStream(), x.stderr, x.Color)
+			continue
+		}
+		rt := newRoute(x.ctx, name, cfg, x.stdin, x.stdout, x.errStream(), x.stderr, x.Color)
+		if name == x.Route {
+			rt.name = instanceName(name, x.Instance)
+		}
+		rt.checkpoint = x.Proc == ""
+		rts[name] = rt
+	}
+	for name, rt := range rts {
+		for _, dep := range manifest[name].DependsOn {
+			rt.deps = append(rt.deps, rts[dep])
+		}
 	}
 
+	// routes of the same priority start together, each priority once the routes of the previous one have started their procs or are waiting
 	wg := sync.WaitGroup{}
-	for name, route := range manifest {
+	var (
+		group    []*route // routes of the current priority
+		priority int
+	)
+	for _, name := range startOrder(manifest) {
+		if _, ok := running[name]; ok {
+			continue
+		}
+		rt := rts[name]
+		if p := manifest[name].Priority; len(group) > 0 && p != priority {
+			for _, prev := range group {
+				select {
+				case <-prev.started:
+				case <-prev.done:
+				}
+			}
+			group = group[:0]
+		}
+		group = append(group, rt)
+		priority = manifest[name].Priority
+
+		if cfg := manifest[name]; cfg.Deprecated != "" {
+			x.stderr.Write([]byte(name + " is deprecated: " + cfg.Deprecated + "\n"))
+		}
+
 		wg.Add(1)
-		go func(namespace, name string, cfgs []lib.Proc) {
-			rt := newRoute(x.ctx, namespace, name, cfgs, x.stdout, x.stderr)
+		go func(name string, rt *route) {
 			if err := rt.run(); err != nil {
-				stderr.Println(name+" error:", err)
+				// reported by the server, unless the client redirected op's messages
+				w := io.Writer(stderr)
+				if x.errOut != nil {
+					w = x.stderr
+				}
+				w.Write([]byte(name + " error: " + err.Error() + "\n"))
+				x.fail(rt.exitStatus())
 			}
 			wg.Done()
-		}(route.Namespace, name, route.Procs)
+		}(name, rt)
 	}
 	wg.Wait()
 
@@ -591,15 +2885,47 @@ func (x command) executeRun() error {
 }
 
 func (x command) run() error {
+	// op's own messages may be discarded or written elsewhere, leaving the client streams to process output
+	if x.Quiet || x.Messages != "" {
+		x.errOut = x.stderr
+		if x.Quiet {
+			x.stderr = io.Discard
+		} else {
+			f, err := os.OpenFile(x.Messages, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+			if err != nil {
+				x.errOut.Write([]byte("messages file error: " + err.Error() + "\n"))
+				return nil
+			}
+			defer f.Close()
+			x.stderr = lib.NewFmt(f)
+		}
+	}
+
 	switch x.Sw {
+	case lib.CmdAdopt:
+		return x.executeAdopt()
+	case lib.CmdAttach:
+		return x.executeAttach()
+	case lib.CmdDrain:
+		x.executeDrain()
 	case lib.CmdExit:
 		x.executeExit()
+	case lib.CmdFeed:
+		return x.executeFeed()
 	case lib.CmdKill:
 		x.executeKill()
 	case lib.CmdList:
 		x.executeList()
+	case lib.CmdLogs:
+		return x.executeLogs()
 	case lib.CmdRestart:
 		return x.executeRestart()
+	case lib.CmdScale:
+		return x.executeScale()
+	case lib.CmdWait:
+		return x.executeWait()
+	case lib.CmdResume:
+		return x.executeResume()
 	default:
 		return x.executeRun()
 	}
@@ -629,16 +2955,20 @@ func setup(id byte) error {
 	return nil
 }
 
-// clean removes the pipes of the given client and removes the ID from active IDs
+// clean removes the pipes and the status file of the given client and removes the ID from active IDs
 func clean(id byte) {
 	paths := lib.PipePaths(id)
 	for _, path := range paths {
 		os.Remove(path)
 	}
+	os.Remove(lib.StatusPath(id))
 	ioWg.Done()
 	deleteId(id)
 }
 
+// stdinQueue is the number of client stdin chunks held for a command, before the client has to wait.
+const stdinQueue = 256
+
 // serve uses the appropriate pipes to listen for a new client's requests, and respond to them
 func serve(id byte) {
 	done := mainCtx.Done()
@@ -652,7 +2982,6 @@ func serve(id byte) {
 		clean(id)
 	}()
 	paths := lib.PipePaths(id)
-	r := make([]byte, 1) // used to read from input to see when it closes
 
 	// open pipes concurrently to avoid blocking forever in case of abortion
 	// OpenFile functions should return when the pipes get closed
@@ -694,45 +3023,124 @@ func serve(id byte) {
 	}
 
 	ctx, cfn := context.WithCancel(mainCtx)
+	defer cfn() // release the input goroutines once the command is done
+	setCancel(id, cfn)
+	var exit int32
 	cmd := command{
 		Cmd:    cmdJson,
 		stdout: outPipe,
 		stderr: errPipe,
 		ctx:    ctx,
+		exit:   &exit,
 	}
-	go func() { // keep listening for potential cancel cmd; anything else is ignored
-		if err := dec.Decode(&cmdJson); err != nil {
-			return
-		}
-		if cmdJson.Sw == lib.CmdCancel {
-			cfn()
+	// stdin is written by its own goroutine, so that a proc not reading it does not hold up later cancel commands
+	// the queue bounds the input held for a slow reader; only once it is full does the client wait
+	var input chan []byte
+	if cmdJson.Stdin {
+		stdinR, stdinW := io.Pipe()
+		cmd.stdin = stdinR
+		input = make(chan []byte, stdinQueue)
+		go func(input <-chan []byte) {
+			defer stdinW.Close()
+			for {
+				select {
+				case b, ok := <-input:
+					if !ok {
+						return // EOF
+					}
+					if _, err := stdinW.Write(b); err != nil {
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(input)
+		go func() { // unblock a pending write
+			<-ctx.Done()
+			stdinR.CloseWithError(ctx.Err())
+		}()
+	}
+	// the decoder is the only reader of the input pipe, so that no message is cut short
+	// it signals inputDone once the client has closed its side
+	inputDone := make(chan struct{})
+	go func() { // keep listening for potential cancel or stdin cmds; anything else is ignored
+		defer func() {
+			if input != nil {
+				close(input) // client gone
+			}
+			close(inputDone)
+		}()
+		for {
+			var c lib.Cmd
+			if err := dec.Decode(&c); err != nil {
+				return
+			}
+			switch c.Sw {
+			case lib.CmdCancel:
+				cfn()
+			case lib.CmdInput:
+				if input == nil {
+					continue
+				}
+				if len(c.Data) == 0 {
+					close(input)
+					input = nil
+					continue
+				}
+				select {
+				case input <- c.Data:
+				case <-ctx.Done():
+				}
+			}
 		}
 	}()
 
 	if err := cmd.run(); err != nil {
 		stderr.Println("command run error:", err)
+		cmd.fail(1)
 	}
 
+	// the client reads its exit status once the output pipes close
+	if err := os.WriteFile(lib.StatusPath(id), []byte(strconv.Itoa(int(exit))), 0600); err != nil {
+		stderr.Println("status write error:", err)
+	}
 	errPipe.Close()
 	outPipe.Close()
 
-	inPipe.Read(r) // wait for other side to close
+	cfn()       // release a decoder waiting to queue stdin
+	<-inputDone // wait for other side to close, so that the status file outlives the client read
 	inPipe.Close()
 }
 
 var (
-	idActive map[byte]struct{} = make(map[byte]struct{}) // holds active client ids
+	idActive map[byte]*client = make(map[byte]*client) // holds active clients, by id
 	idNext   byte
 	idMux    sync.Mutex
 )
 
+// A client holds the token a client must present to cancel its command, along with the cancelation of the command, once known.
+type client struct {
+	token  string
+	cancel context.CancelFunc
+}
+
+// newToken returns a random cancelation token.
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
 func deleteId(id byte) {
 	idMux.Lock()
 	defer idMux.Unlock()
 	delete(idActive, id)
 }
 
-func getId() byte {
+func getId(token string) byte {
 	idMux.Lock()
 	defer idMux.Unlock()
 
@@ -743,10 +3151,52 @@ func getId() byte {
 		idNext++
 	}
 
-	idActive[idNext] = struct{}{}
+	idActive[idNext] = &client{token: token}
 	return idNext
 }
 
+// setCancel registers the cancelation of the command of the client with given id.
+func setCancel(id byte, fn context.CancelFunc) {
+	idMux.Lock()
+	defer idMux.Unlock()
+	if c, ok := idActive[id]; ok {
+		c.cancel = fn
+	}
+}
+
+// cancelRequest answers client cancel http requests.
+// Only local clients may cancel commands, and only with the token given to them on registration, since any local user may reach the server.
+func cancelRequest(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 8)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+
+	idMux.Lock()
+	c := idActive[byte(id)]
+	ok := c != nil && subtle.ConstantTimeCompare([]byte(token), []byte(c.token)) == 1
+	var fn context.CancelFunc
+	if ok {
+		fn = c.cancel
+	}
+	idMux.Unlock()
+	if !ok {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if fn != nil {
+		fn()
+	}
+}
+
 // register answers client ID http requests
 func register(w http.ResponseWriter, r *http.Request) {
 	select {
@@ -755,56 +3205,109 @@ func register(w http.ResponseWriter, r *http.Request) {
 	default:
 	}
 
-	id := getId()
+	token, err := newToken()
+	if err != nil {
+		stderr.Println("client token error:", err)
+		return
+	}
+	id := getId(token)
 	if err := setup(id); err != nil {
 		stderr.Println("client setup error:", err)
 		return
 	}
 	go serve(id)
 
-	w.Write([]byte{id})
+	// the token follows the id, for cancelation
+	w.Write(append([]byte{id}, token...))
 }
 
-func Run() {
+// Run functions as a server until done, and returns the exit status of the executed command, if any.
+func Run() int {
 	go sigint()
+	go sampleStats()
+	startShipping()
+	if lib.RunRetention > 0 {
+		go pruneRuns()
+	}
 	defer cleanup()
 
+	// a server started by a run would otherwise outlive it, waiting for unrelated procs
+	if lib.ArgSwitch == lib.CmdServer || lib.ArgSwitch == lib.CmdAdopt {
+		recoverProcs()
+	}
+
 	http.HandleFunc("/", register)
+	http.HandleFunc("/cancel", cancelRequest)
 	go func() {
 		err := http.ListenAndServe(lib.Port, nil)
 		stderr.Println("http server error:", err)
 		os.Exit(1)
 	}()
 
-	// execute a run command before exiting
+	// execute a run or adopt command before exiting
 	// functions as a server for other op processes until done
 	// if server switch is present, runs as dedicated server without executing anything
 	// any other switch is invalid
 	switch lib.ArgSwitch {
 	case lib.CmdServer:
+		go schedule()
 		<-cleanupDone
-	case lib.CmdRun:
-		conf, err := lib.DecodeConfig()
+	case lib.CmdWait, lib.CmdAttach, lib.CmdFeed:
+		// a new server has no active routes
+		if lib.ArgMajor == "" {
+			stderr.Println("a route is required")
+		} else {
+			stderr.Println(lib.ArgMajor + " not active")
+		}
+		return 1
+	case lib.CmdRun, lib.CmdAdopt, lib.CmdResume, lib.CmdExec:
+		sw, route, proc := lib.ArgSwitch, lib.ArgMajor, lib.ArgMinor
+		var (
+			conf lib.Manifest
+			err  error
+		)
+		if sw == lib.CmdExec {
+			conf, route, err = lib.ExecManifest()
+			proc = "" // the ad-hoc route has a single proc
+			sw = lib.CmdRun
+		} else {
+			conf, err = lib.DecodeConfig()
+		}
 		if err != nil {
 			stderr.Println("manifest decode error:", err)
-			return
+			return 1
 		}
 
+		var exit int32
 		cmd := command{
 			Cmd: lib.Cmd{
-				Sw:        lib.CmdRun,
+				Sw:        sw,
 				Namespace: conf.Namespace,
-				Route:     lib.ArgMajor,
-				Proc:      lib.ArgMinor,
+				Route:     route,
+				Instance:  lib.ArgInstance,
+				Proc:      proc,
+				From:      lib.ArgFrom,
 				Config:    conf.Routes,
+				Groups:    conf.Groups,
+				Color:     lib.ColorOutput(),
+				Quiet:     lib.ArgQuiet,
+				Messages:  lib.ArgMessages,
 			},
 			stdout: stdout,
 			stderr: stderr,
 			ctx:    mainCtx,
+			exit:   &exit,
+		}
+		if lib.ArgStdin {
+			cmd.stdin = os.Stdin
 		}
 		if err := cmd.run(); err != nil {
 			stderr.Println("run error:", err)
+			cmd.fail(1)
 		}
-		ioWg.Wait() // wait for any current clients
+		ioWg.Wait()      // wait for any current clients
+		recoverWg.Wait() // only adopting servers recover procs
+		return int(exit)
 	}
+	return 0
 }
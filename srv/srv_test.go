@@ -0,0 +1,54 @@
+package srv
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPrefixer(t *testing.T) {
+	tests := []struct {
+		writes []string
+		want   string
+	}{
+		{[]string{"a\nb\n"}, "p: a\np: b\n"},
+		{[]string{"a", "b\nc", "d\n"}, "p: ab\np: cd\n"},
+		{[]string{"\n\n"}, "p: \np: \n"},
+		{[]string{"a\nb"}, "p: a\np: b\n"},
+		{nil, ""},
+	}
+	for i, test := range tests {
+		var buf bytes.Buffer
+		x := newPrefixer([]byte("p: "), &buf)
+		for _, s := range test.writes {
+			if n, err := x.Write([]byte(s)); n != len(s) || err != nil {
+				t.Fatalf("%d: write returned %d, %v", i, n, err)
+			}
+		}
+		if err := x.Flush(); err != nil {
+			t.Fatalf("%d: flush error: %v", i, err)
+		}
+		if buf.String() != test.want {
+			t.Errorf("%d: got %q, want %q", i, buf.String(), test.want)
+		}
+	}
+}
+
+func TestPrefixerIdle(t *testing.T) {
+	var buf bytes.Buffer
+	x := newPrefixer([]byte("p: "), &buf)
+	x.start, x.end = []byte("<"), []byte(">")
+
+	x.Write([]byte("prompt? "))
+	if buf.Len() != 0 {
+		t.Fatalf("unterminated line forwarded early: %q", buf.String())
+	}
+	// the rest of a line forwarded while idle is not prefixed again
+	x.idle()
+	x.Write([]byte("yes\nnext\n"))
+	x.Flush()
+
+	want := "p: <prompt? ><yes>\np: <next>\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
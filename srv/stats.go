@@ -0,0 +1,113 @@
+package srv
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+// statsInterval is the period at which active routes are sampled.
+const statsInterval = 10 * time.Second
+
+// cpuSample holds the cumulative CPU time of a process at a given moment.
+type cpuSample struct {
+	pid  int
+	cpu  time.Duration
+	time time.Time
+}
+
+// sampleStats periodically records the resource usage of active routes, until the server shuts down.
+// Anomalies are reported to the route's stderr.
+func sampleStats() {
+	last := make(map[*route]cpuSample)
+	analyzers := make(map[*route]*analyzer)
+
+	t := time.NewTicker(statsInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-mainCtx.Done():
+			return
+		case <-t.C:
+		}
+
+		seen := make(map[*route]struct{})
+		activeRangeAll(func(rt *route) {
+			seen[rt] = struct{}{}
+
+			s := lib.Sample{
+				Time:      time.Now(),
+				Restarts:  rt.restartCount(),
+				Truncated: rt.truncatedCount(),
+			}
+			if pid := rt.pid(); pid > 0 {
+				cpu, rss, err := procUsage(pid)
+				if err == nil {
+					s.RSS = rss
+					if prev, ok := last[rt]; ok && prev.pid == pid && cpu >= prev.cpu {
+						s.CPU = 100 * float64(cpu-prev.cpu) / float64(s.Time.Sub(prev.time))
+					}
+					last[rt] = cpuSample{pid, cpu, s.Time}
+				}
+			}
+
+			// seed new analyzers before persisting the current sample
+			a, ok := analyzers[rt]
+			if !ok {
+				a = newAnalyzer(rt.namespace, rt.name)
+				analyzers[rt] = a
+			}
+
+			if err := lib.AppendSample(rt.namespace, rt.name, s); err != nil {
+				stderr.Println("stats error:", err)
+			}
+
+			if msg := a.add(s); msg != "" {
+				rt.stderr.Write([]byte(rt.name + " anomaly: " + msg + "\n"))
+			}
+		})
+
+		// forget terminated routes
+		for rt := range last {
+			if _, ok := seen[rt]; !ok {
+				delete(last, rt)
+			}
+		}
+		for rt := range analyzers {
+			if _, ok := seen[rt]; !ok {
+				delete(analyzers, rt)
+			}
+		}
+	}
+}
+
+// pid returns the process ID of the currently running process, or 0 if there is none.
+func (x *route) pid() int {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	if x.proc == nil || x.proc.cmd.Process == nil || x.proc.cmd.ProcessState != nil {
+		return 0
+	}
+	return x.proc.cmd.Process.Pid
+}
+
+// restartCount returns the number of process restarts during the route run.
+func (x *route) restartCount() int {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	return x.restarts
+}
+
+// truncatedCount returns the number of output lines truncated during the route run.
+func (x *route) truncatedCount() int {
+	return int(atomic.LoadInt64(x.truncated))
+}
+
+// countRestart increments the route's restart count.
+func (x *route) countRestart() {
+	x.mux.Lock()
+	x.restarts++
+	x.mux.Unlock()
+	stateChanged()
+}
@@ -0,0 +1,508 @@
+package srv
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+// setNice sets the scheduling niceness of the given process.
+func setNice(pid, n int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, pid, n)
+}
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassBE    = 2
+	ioprioClassShift = 13
+	ioprioLevelMax   = 7
+)
+
+// setIONice sets the best-effort IO priority level of the given process.
+// Lower levels mean higher priority.
+func setIONice(pid, level int) error {
+	if level < 0 || level > ioprioLevelMax {
+		return errors.New("level out of range")
+	}
+	prio := ioprioClassBE<<ioprioClassShift | level
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(pid), uintptr(prio)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setOOMScoreAdj adjusts the likelihood of the given process being chosen by the OOM killer.
+// Valid scores are between -1000 and 1000.
+func setOOMScoreAdj(pid, score int) error {
+	if score < -1000 || score > 1000 {
+		return errors.New("score out of range")
+	}
+	path := "/proc/" + strconv.Itoa(pid) + "/oom_score_adj"
+	return os.WriteFile(path, []byte(strconv.Itoa(score)), 0)
+}
+
+// clockTicks is the kernel clock tick rate used in /proc stat files.
+const clockTicks = 100
+
+// procStat returns the fields of /proc/[pid]/stat that follow the command name, starting with the state.
+func procStat(pid int) ([]string, error) {
+	b, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return nil, err
+	}
+	// the command name may contain spaces; fields are counted after its closing parenthesis
+	i := bytes.LastIndexByte(b, ')')
+	if i < 0 {
+		return nil, errors.New("malformed stat file")
+	}
+	fields := strings.Fields(string(b[i+1:]))
+	if len(fields) < 20 {
+		return nil, errors.New("malformed stat file")
+	}
+	return fields, nil
+}
+
+// procStartTime returns the start time of a process, in clock ticks since boot.
+// Together with the pid, it identifies a process across pid reuse.
+func procStartTime(pid int) (uint64, error) {
+	fields, err := procStat(pid)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// procUsage returns the cumulative CPU time and resident memory of the given process.
+func procUsage(pid int) (cpu time.Duration, rss int64, err error) {
+	fields, err := procStat(pid)
+	if err != nil {
+		return
+	}
+	utime, err := strconv.ParseInt(fields[11], 10, 64)
+	if err != nil {
+		return
+	}
+	stime, err := strconv.ParseInt(fields[12], 10, 64)
+	if err != nil {
+		return
+	}
+	cpu = time.Duration(utime+stime) * time.Second / clockTicks
+
+	b, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/statm")
+	if err != nil {
+		return
+	}
+	fields = strings.Fields(string(b))
+	if len(fields) < 2 {
+		return 0, 0, errors.New("malformed statm file")
+	}
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return
+	}
+	rss = pages * int64(os.Getpagesize())
+
+	return
+}
+
+// openPty allocates a new pseudo-terminal pair.
+func openPty() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			master.Close()
+		}
+	}()
+
+	var n uint32
+	if err = ioctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		return
+	}
+	var unlock int32
+	if err = ioctl(master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		return
+	}
+
+	slave, err = os.OpenFile("/dev/pts/"+strconv.FormatUint(uint64(n), 10), os.O_RDWR|syscall.O_NOCTTY, 0)
+	return
+}
+
+func ioctl(fd, req, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// prCapbsetDrop is the prctl option removing a capability from the bounding set.
+const prCapbsetDrop = 24
+
+// confineEnv holds the confinement spec of a helper process.
+const confineEnv = "OP_CONFINE"
+
+// A confineSpec describes the command a confinement helper executes, and its environment.
+type confineSpec struct {
+	Root   string
+	Mounts []lib.Mount
+	NewPid bool // mount a private /proc
+	NewNet bool // bring up the loopback interface
+
+	DropCaps []uintptr // capabilities removed from the bounding set before executing
+	Dir      string
+	Path     string
+	Args     []string
+	Env      []string
+}
+
+// namespaceFlags maps namespace names to their clone flags.
+var namespaceFlags = map[string]uintptr{
+	"pid":   syscall.CLONE_NEWPID,
+	"net":   syscall.CLONE_NEWNET,
+	"mount": syscall.CLONE_NEWNS,
+	"ipc":   syscall.CLONE_NEWIPC,
+	"uts":   syscall.CLONE_NEWUTS,
+}
+
+// confine makes cmd run the given proc command inside a new mount namespace, with the proc mounts bound and its root changed.
+// Any other namespaces named by the proc are created as well.
+// The op executable is started instead, which sets up the namespaces and then executes the actual command.
+func confine(cmd *exec.Cmd, cfg config) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var flags uintptr
+	for _, name := range cfg.Unshare {
+		f, ok := namespaceFlags[name]
+		if !ok {
+			return errors.New("unknown namespace " + name)
+		}
+		flags |= f
+	}
+
+	var (
+		drop    []uintptr
+		ambient []uintptr
+	)
+	if cfg.Capabilities != nil {
+		if drop, ambient, err = capabilitySets(*cfg.Capabilities); err != nil {
+			return err
+		}
+	}
+
+	b, err := json.Marshal(confineSpec{
+		DropCaps: drop,
+		Root:     cfg.Chroot,
+		Mounts:   cfg.Mounts,
+		NewPid:   flags&syscall.CLONE_NEWPID != 0,
+		NewNet:   flags&syscall.CLONE_NEWNET != 0,
+		Dir:      cfg.Dir,
+		Path:     cfg.Path,
+		Args:     cfg.Args,
+		Env:      cmd.Env,
+	})
+	if err != nil {
+		return err
+	}
+
+	cmd.Path = self
+	cmd.Args = []string{self}
+	cmd.Dir = ""
+	cmd.Env = []string{confineEnv + "=" + string(b), "OP_WORKDIR=" + lib.BasePath}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Unshareflags |= syscall.CLONE_NEWNS
+	cmd.SysProcAttr.Cloneflags |= flags &^ syscall.CLONE_NEWNS
+	cmd.SysProcAttr.AmbientCaps = ambient
+	return nil
+}
+
+// capabilities maps capability names, without the "CAP_" prefix, to their numbers.
+var capabilities = map[string]uintptr{
+	"CHOWN":              0,
+	"DAC_OVERRIDE":       1,
+	"DAC_READ_SEARCH":    2,
+	"FOWNER":             3,
+	"FSETID":             4,
+	"KILL":               5,
+	"SETGID":             6,
+	"SETUID":             7,
+	"SETPCAP":            8,
+	"LINUX_IMMUTABLE":    9,
+	"NET_BIND_SERVICE":   10,
+	"NET_BROADCAST":      11,
+	"NET_ADMIN":          12,
+	"NET_RAW":            13,
+	"IPC_LOCK":           14,
+	"IPC_OWNER":          15,
+	"SYS_MODULE":         16,
+	"SYS_RAWIO":          17,
+	"SYS_CHROOT":         18,
+	"SYS_PTRACE":         19,
+	"SYS_PACCT":          20,
+	"SYS_ADMIN":          21,
+	"SYS_BOOT":           22,
+	"SYS_NICE":           23,
+	"SYS_RESOURCE":       24,
+	"SYS_TIME":           25,
+	"SYS_TTY_CONFIG":     26,
+	"MKNOD":              27,
+	"LEASE":              28,
+	"AUDIT_WRITE":        29,
+	"AUDIT_CONTROL":      30,
+	"SETFCAP":            31,
+	"MAC_OVERRIDE":       32,
+	"MAC_ADMIN":          33,
+	"SYSLOG":             34,
+	"WAKE_ALARM":         35,
+	"BLOCK_SUSPEND":      36,
+	"AUDIT_READ":         37,
+	"PERFMON":            38,
+	"BPF":                39,
+	"CHECKPOINT_RESTORE": 40,
+}
+
+// parseCapability returns the number of a capability name, such as "CAP_NET_RAW" or "net_raw".
+func parseCapability(s string) (uintptr, error) {
+	name := strings.TrimPrefix(strings.ToUpper(s), "CAP_")
+	c, ok := capabilities[name]
+	if !ok {
+		return 0, errors.New("unknown capability " + s)
+	}
+	return c, nil
+}
+
+// capabilitySets returns the capabilities to remove from the bounding set, and those to raise as ambient.
+// If a keep list is given, every other capability is dropped.
+func capabilitySets(c lib.Capabilities) (drop, ambient []uintptr, err error) {
+	keep := make(map[uintptr]bool)
+	for _, s := range c.Keep {
+		n, err := parseCapability(s)
+		if err != nil {
+			return nil, nil, err
+		}
+		keep[n] = true
+	}
+	for _, s := range c.Drop {
+		n, err := parseCapability(s)
+		if err != nil {
+			return nil, nil, err
+		}
+		keep[n] = false
+		drop = append(drop, n)
+	}
+
+	if len(c.Keep) > 0 {
+		drop = drop[:0]
+		for _, n := range capabilities {
+			if !keep[n] {
+				drop = append(drop, n)
+			}
+		}
+		for n, ok := range keep {
+			if ok {
+				ambient = append(ambient, n)
+			}
+		}
+	}
+	return drop, ambient, nil
+}
+
+// Confine executes the command described by the confinement spec env, or the command of a umask helper, if present.
+// Does nothing for regular op processes; otherwise never returns.
+func Confine() {
+	umaskExec()
+
+	s := os.Getenv(confineEnv)
+	if s == "" {
+		return
+	}
+
+	if err := confineExec(s); err != nil {
+		fmt.Fprintln(os.Stderr, "confine error:", err)
+		os.Exit(1)
+	}
+}
+
+func confineExec(s string) error {
+	var spec confineSpec
+	if err := json.Unmarshal([]byte(s), &spec); err != nil {
+		return err
+	}
+
+	root := spec.Root
+	if root == "" {
+		root = "/"
+	}
+	for _, m := range spec.Mounts {
+		target := filepath.Join(root, m.Target)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		if err := syscall.Mount(m.Source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("mount %s: %w", m.Target, err)
+		}
+		if m.ReadOnly {
+			if err := syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+				return fmt.Errorf("mount %s: %w", m.Target, err)
+			}
+		}
+	}
+
+	if spec.NewPid {
+		if err := syscall.Mount("proc", filepath.Join(root, "proc"), "proc", 0, ""); err != nil {
+			return fmt.Errorf("mount /proc: %w", err)
+		}
+	}
+	if spec.NewNet {
+		if err := loopbackUp(); err != nil {
+			return fmt.Errorf("loopback: %w", err)
+		}
+	}
+
+	if spec.Root != "" {
+		if err := syscall.Chroot(spec.Root); err != nil {
+			return err
+		}
+		if err := os.Chdir("/"); err != nil {
+			return err
+		}
+	}
+	if spec.Dir != "" {
+		if err := os.Chdir(spec.Dir); err != nil {
+			return err
+		}
+	}
+
+	// capabilities are dropped last, since the setup above requires them
+	for _, c := range spec.DropCaps {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapbsetDrop, c, 0); errno != 0 && errno != syscall.EINVAL {
+			return fmt.Errorf("capability %d: %w", c, errno)
+		}
+	}
+
+	// resolve the command inside the new root, using its own PATH
+	os.Clearenv()
+	for _, kv := range spec.Env {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			os.Setenv(kv[:i], kv[i+1:])
+		}
+	}
+	path, err := exec.LookPath(spec.Path)
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(path, append([]string{spec.Path}, spec.Args...), spec.Env)
+}
+
+// loopbackUp brings up the loopback interface of the current network namespace.
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	var req struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(req.name[:], "lo")
+	if err := ioctl(uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&req))); err != nil {
+		return err
+	}
+	req.flags |= syscall.IFF_UP | syscall.IFF_RUNNING
+	return ioctl(uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&req)))
+}
+
+// watchMask selects the inotify events that count as changes.
+const watchMask = syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB | syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// watchChanges calls fn whenever a file under the given paths changes, until done is closed.
+// Directories are watched recursively, including ones created later.
+func watchChanges(paths []string, done <-chan struct{}, fn func()) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	// a non-blocking file uses the runtime poller, so closing it unblocks reads
+	f := os.NewFile(uintptr(fd), "inotify")
+
+	dirs := make(map[int32]string) // watched directories, by watch descriptor
+	add := func(root string) error {
+		return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if path != root && !info.IsDir() {
+				return nil
+			}
+			wd, err := syscall.InotifyAddWatch(fd, path, watchMask)
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				dirs[int32(wd)] = path
+			}
+			return nil
+		})
+	}
+	for _, path := range paths {
+		if err := add(path); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	go func() {
+		<-done
+		f.Close()
+	}()
+
+	go func() {
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				return
+			}
+
+			for i := 0; i+syscall.SizeofInotifyEvent <= n; {
+				ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[i]))
+				name := string(bytes.TrimRight(buf[i+syscall.SizeofInotifyEvent:i+syscall.SizeofInotifyEvent+int(ev.Len)], "\x00"))
+				i += syscall.SizeofInotifyEvent + int(ev.Len)
+
+				if ev.Mask&syscall.IN_CREATE != 0 && ev.Mask&syscall.IN_ISDIR != 0 {
+					if dir, ok := dirs[ev.Wd]; ok {
+						add(filepath.Join(dir, name))
+					}
+				}
+			}
+			fn()
+		}
+	}()
+
+	return nil
+}
+
+// maxRSSBytes returns the maximum resident set size of a rusage, which Linux reports in kilobytes.
+func maxRSSBytes(ru *syscall.Rusage) int64 {
+	return ru.Maxrss * 1024
+}
@@ -0,0 +1,102 @@
+//go:build !linux
+// +build !linux
+
+package srv
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"time"
+)
+
+var errUnsupported = errors.New("not supported on this platform")
+
+func setNice(pid, n int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, pid, n)
+}
+
+func setIONice(pid, level int) error {
+	return errUnsupported
+}
+
+func setOOMScoreAdj(pid, score int) error {
+	return errUnsupported
+}
+
+func openPty() (master, slave *os.File, err error) {
+	return nil, nil, errUnsupported
+}
+
+func procUsage(pid int) (time.Duration, int64, error) {
+	return 0, 0, errUnsupported
+}
+
+func procStartTime(pid int) (uint64, error) {
+	return 0, errUnsupported
+}
+
+func confine(cmd *exec.Cmd, cfg config) error {
+	return errUnsupported
+}
+
+func Confine() {
+	umaskExec()
+}
+
+// watchPoll is the interval at which watched paths are scanned.
+const watchPoll = time.Second
+
+func watchChanges(paths []string, done <-chan struct{}, fn func()) error {
+	last, err := scanPaths(paths)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		t := time.NewTicker(watchPoll)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+
+			cur, err := scanPaths(paths)
+			if err != nil {
+				continue
+			}
+			if !reflect.DeepEqual(cur, last) {
+				last = cur
+				fn()
+			}
+		}
+	}()
+	return nil
+}
+
+// scanPaths returns the modification times of all files under the given paths.
+func scanPaths(paths []string) (map[string]time.Time, error) {
+	r := make(map[string]time.Time)
+	for _, root := range paths {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			r[path] = info.ModTime()
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func maxRSSBytes(ru *syscall.Rusage) int64 {
+	return int64(ru.Maxrss)
+}
@@ -0,0 +1,109 @@
+package srv
+
+import (
+	"bytes"
+	"errors"
+	"log/syslog"
+	"strings"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+// syslogFacilities maps facility names to their values.
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// A syslogSink forwards output lines to the local syslog daemon, one message per line.
+// Lines that fail to be sent are dropped, without holding back the following ones; log/syslog reconnects and retries once on failure.
+type syslogSink struct {
+	w    *syslog.Writer
+	err  bool // log with error severity instead of info
+	part []byte
+}
+
+// newSyslogSink connects to the local syslog daemon.
+// The tag defaults to "route.proc".
+func newSyslogSink(cfg lib.Syslog, route, proc string, err bool) (*syslogSink, error) {
+	facility := syslog.LOG_USER
+	if cfg.Facility != "" {
+		var ok bool
+		if facility, ok = syslogFacilities[strings.ToLower(cfg.Facility)]; !ok {
+			return nil, errors.New("unknown syslog facility " + cfg.Facility)
+		}
+	}
+	tag := cfg.Tag
+	if tag == "" {
+		tag = route + "." + proc
+	}
+
+	severity := syslog.LOG_INFO
+	if err {
+		severity = syslog.LOG_ERR
+	}
+	w, e := syslog.New(facility|severity, tag)
+	if e != nil {
+		return nil, e
+	}
+	return &syslogSink{w: w, err: err}, nil
+}
+
+func (x *syslogSink) Write(b []byte) (int, error) {
+	var err error
+	x.part = append(x.part, b...)
+	for {
+		i := bytes.IndexByte(x.part, '\n')
+		if i < 0 {
+			break
+		}
+		line := x.part[:i]
+		x.part = x.part[i+1:]
+		// a failed line must not hold back the following ones
+		if e := x.send(line); e != nil && err == nil {
+			err = e
+		}
+	}
+	x.part = append([]byte(nil), x.part...)
+	return len(b), err
+}
+
+func (x *syslogSink) send(line []byte) error {
+	s := string(bytes.TrimRight(line, "\r"))
+	if x.err {
+		return x.w.Err(s)
+	}
+	return x.w.Info(s)
+}
+
+// Flush sends the incomplete line, if any.
+func (x *syslogSink) Flush() error {
+	if len(x.part) == 0 {
+		return nil
+	}
+	err := x.send(x.part)
+	x.part = nil
+	return err
+}
+
+func (x *syslogSink) Close() error {
+	return x.w.Close()
+}
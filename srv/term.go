@@ -0,0 +1,29 @@
+package srv
+
+import (
+	"os"
+	"os/exec"
+)
+
+// prepareTermination configures cmd, before it is started, so that a terminator can stop it.
+func prepareTermination(cmd *exec.Cmd) {}
+
+// A signalTerminator stops a process through signals.
+type signalTerminator struct {
+	p *os.Process
+}
+
+// newTerminator returns a terminator for the started cmd.
+func newTerminator(cmd *exec.Cmd) terminator {
+	return signalTerminator{cmd.Process}
+}
+
+func (x signalTerminator) interrupt() error {
+	return x.p.Signal(os.Interrupt)
+}
+
+func (x signalTerminator) kill() error {
+	return x.p.Kill()
+}
+
+func (x signalTerminator) release() {}
@@ -0,0 +1,151 @@
+package srv
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os/exec"
+	"regexp"
+	"sync/atomic"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+// triggerLineMax bounds the line buffered for trigger matching; longer lines are matched in pieces.
+const triggerLineMax = 64 << 10
+
+// A trigger is a compiled lib.Trigger.
+type trigger struct {
+	lib.Trigger
+	re      *regexp.Regexp
+	running *int32 // set while the command of an exec action runs
+}
+
+// compileTriggers validates and compiles the given trigger definitions, splitting them by watched stream.
+func compileTriggers(defs []lib.Trigger) (out, err []trigger, e error) {
+	for _, def := range defs {
+		switch def.Action {
+		case "ready", "restart", "notify":
+		case "exec":
+			if len(def.Cmd) == 0 {
+				return nil, nil, errors.New("exec action without command")
+			}
+		default:
+			return nil, nil, errors.New("unknown action " + def.Action)
+		}
+
+		re, e := regexp.Compile(def.Match)
+		if e != nil {
+			return nil, nil, e
+		}
+		t := trigger{def, re, new(int32)}
+
+		switch def.Stream {
+		case "out":
+			out = append(out, t)
+		case "err":
+			err = append(err, t)
+		case "":
+			out = append(out, t)
+			err = append(err, t)
+		default:
+			return nil, nil, errors.New("unknown stream " + def.Stream)
+		}
+	}
+	return
+}
+
+// A triggerWriter forwards writes unchanged, while matching complete lines against triggers.
+type triggerWriter struct {
+	dst      io.Writer
+	partial  []byte // current unterminated line
+	triggers []trigger
+	fire     func(trigger, string)
+}
+
+func (x *triggerWriter) Write(b []byte) (int, error) {
+	for rest := b; len(rest) > 0; {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			x.partial = append(x.partial, rest...)
+			// overlong lines are matched in pieces, to bound memory
+			if len(x.partial) >= triggerLineMax {
+				x.match(x.partial)
+				x.partial = x.partial[:0]
+			}
+			break
+		}
+		if len(x.partial) > 0 {
+			x.partial = append(x.partial, rest[:i]...)
+			x.match(x.partial)
+			x.partial = x.partial[:0]
+		} else {
+			x.match(rest[:i])
+		}
+		rest = rest[i+1:]
+	}
+
+	return x.dst.Write(b)
+}
+
+// match fires the triggers matched by the given line.
+func (x *triggerWriter) match(b []byte) {
+	line := string(bytes.TrimSuffix(b, []byte{'\r'}))
+	for _, t := range x.triggers {
+		if t.re.MatchString(line) {
+			x.fire(t, line)
+		}
+	}
+}
+
+// fire executes the action of a trigger matched by the given line.
+func (x *proc) fire(t trigger, line string) {
+	switch t.Action {
+	case "ready":
+		x.mux.Lock()
+		x.ready = true
+		x.mux.Unlock()
+		stateChanged()
+	case "restart":
+		x.requestRestart()
+	case "notify":
+		x.notify.Write([]byte(x.route + "|" + x.name + " trigger: " + line + "\n"))
+	case "exec":
+		// one run at a time, so that a burst of matching lines does not start a process each
+		if !atomic.CompareAndSwapInt32(t.running, 0, 1) {
+			return
+		}
+		cmd := exec.Command(t.Cmd[0], t.Cmd[1:]...)
+		cmd.Dir = x.cmd.Dir
+		cmd.Env = append(append([]string{}, x.cmd.Env...), "OP_TRIGGER_LINE="+line)
+		auxWg.Add(1)
+		go func() {
+			if err := runCancelable(x.routeCtx, cmd, killGrace, x.route+"|"+x.name+" trigger exec"); err != nil {
+				stderr.Println(x.name+" trigger exec error:", err)
+			}
+			atomic.StoreInt32(t.running, 0)
+			auxWg.Done()
+		}()
+	}
+}
+
+func (x *proc) isReady() bool {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	return x.ready
+}
+
+// requestRestart cancels the process so that it is started again in place, with the same config.
+func (x *proc) requestRestart() {
+	x.mux.Lock()
+	x.restart = true
+	x.mux.Unlock()
+	x.cancel()
+}
+
+// restarting returns true if the process has been canceled in order to be restarted.
+func (x *proc) restarting() bool {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	return x.restart
+}
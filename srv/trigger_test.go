@@ -0,0 +1,59 @@
+package srv
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+func TestTriggerWriter(t *testing.T) {
+	long := strings.Repeat("x", triggerLineMax)
+	tests := []struct {
+		writes []string
+		want   []string
+	}{
+		{[]string{"ok\nfail 1\nok\n"}, []string{"fail 1"}},
+		{[]string{"fa", "il 2\r\n", "fail 3"}, []string{"fail 2"}},
+		{[]string{"fail " + long, "fail 4\n"}, []string{"fail " + long, "fail 4"}},
+	}
+	for i, test := range tests {
+		out, _, err := compileTriggers([]lib.Trigger{{Match: "^fail", Action: "notify"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var (
+			buf   bytes.Buffer
+			fired []string
+		)
+		x := &triggerWriter{dst: &buf, triggers: out, fire: func(_ trigger, line string) {
+			fired = append(fired, line)
+		}}
+		var written string
+		for _, s := range test.writes {
+			x.Write([]byte(s))
+			written += s
+		}
+		if !reflect.DeepEqual(fired, test.want) {
+			t.Errorf("%d: fired %.100q, want %.100q", i, fired, test.want)
+		}
+		if buf.String() != written {
+			t.Errorf("%d: output was changed", i)
+		}
+	}
+}
+
+func TestCompileTriggersErrors(t *testing.T) {
+	for _, def := range []lib.Trigger{
+		{Match: "(", Action: "notify"},
+		{Match: "x", Action: "explode"},
+		{Match: "x", Action: "exec"},
+		{Match: "x", Action: "notify", Stream: "both"},
+	} {
+		if _, _, err := compileTriggers([]lib.Trigger{def}); err == nil {
+			t.Errorf("%+v: no error", def)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package srv
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+// Markers of overlong lines that have been split.
+const (
+	lineSplit     = " …" // ends the first pieces
+	lineContinued = "… " // starts the following pieces
+)
+
+// A truncator bounds the length of output lines, so that no further stage buffers more than a line piece.
+// Lines longer than max are cut, marking each cut, and the remaining pieces longer than split are split into several lines, marking the continuation.
+// Lines are streamed, so memory usage is bounded regardless of line length.
+type truncator struct {
+	dst   io.Writer
+	max   int // 0 means unlimited
+	split int // 0 means unlimited
+	n     int // bytes forwarded from current line
+	col   int // bytes forwarded from current piece, including the continuation marker
+	cut   int // bytes dropped from current line
+	count int // number of truncated lines
+
+	total *int64 // run-wide count of truncated lines, incremented along with count; may be nil
+}
+
+func newTruncator(w io.Writer, max, split int) *truncator {
+	return &truncator{
+		dst:   w,
+		max:   max,
+		split: split,
+	}
+}
+
+// capLines returns w behind the line length bounds of a proc: lines are truncated past max, if positive, and split past lib.MaxClientLine.
+// If neither applies, w is returned as is.
+func capLines(w io.Writer, max int) io.Writer {
+	if max <= 0 && lib.MaxClientLine == 0 {
+		return w
+	}
+	return newTruncator(w, max, int(lib.MaxClientLine))
+}
+
+func (x *truncator) Write(b []byte) (int, error) {
+	r := make([]byte, 0, len(b))
+	for rest := b; len(rest) > 0; {
+		i := bytes.IndexByte(rest, '\n')
+		seg := rest
+		if i >= 0 {
+			seg = rest[:i]
+		}
+
+		keep := seg
+		if x.max > 0 {
+			room := x.max - x.n
+			if room < 0 {
+				room = 0
+			}
+			if room < len(keep) {
+				keep = keep[:room]
+			}
+			x.cut += len(seg) - len(keep)
+		}
+		x.n += len(keep)
+		r = x.appendPieces(r, keep)
+
+		if i < 0 {
+			break
+		}
+		r = x.endLine(r)
+		r = append(r, '\n')
+		rest = rest[i+1:]
+	}
+
+	_, err := x.dst.Write(r)
+	return len(b), err
+}
+
+// appendPieces appends b, the next kept bytes of the current line, to r, starting a new piece every split bytes.
+// Pieces end at character boundaries, unless a single character does not fit.
+func (x *truncator) appendPieces(r, b []byte) []byte {
+	for x.split > 0 && x.col+len(b) > x.split {
+		n := x.split - x.col
+		for n > 0 && !utf8.RuneStart(b[n]) {
+			n--
+		}
+		if n == 0 && x.col <= len(lineContinued) {
+			n = x.split - x.col
+		}
+		r = append(r, b[:n]...)
+		r = append(r, lineSplit+"\n"+lineContinued...)
+		x.col = len(lineContinued)
+		b = b[n:]
+	}
+	x.col += len(b)
+	return append(r, b...)
+}
+
+// endLine appends the truncation marker to r, if the current line has been cut, and resets the line state.
+func (x *truncator) endLine(r []byte) []byte {
+	if x.cut > 0 {
+		r = append(r, " ...[truncated "+strconv.Itoa(x.cut)+" bytes]"...)
+		x.count++
+		if x.total != nil {
+			atomic.AddInt64(x.total, 1)
+		}
+	}
+	x.n, x.col, x.cut = 0, 0, 0
+	return r
+}
+
+// Flush marks the pending line, if it has been cut.
+func (x *truncator) Flush() error {
+	if x.cut == 0 {
+		return nil
+	}
+	_, err := x.dst.Write(x.endLine(nil))
+	return err
+}
+
+// truncated returns the number of output lines that have been truncated.
+// Must not be called while output is being collected.
+func (x *proc) truncated() int {
+	n := 0
+	if x.outTrunc != nil {
+		n += x.outTrunc.count
+	}
+	if x.errTrunc != nil {
+		n += x.errTrunc.count
+	}
+	return n
+}
@@ -0,0 +1,87 @@
+package srv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+// umaskEnv holds the spec of a umask helper process.
+const umaskEnv = "OP_UMASK"
+
+// A umaskSpec describes the command a umask helper executes, once its umask is set.
+type umaskSpec struct {
+	Mask int
+	Path string // resolved, or relative to the working directory
+	Args []string
+	Env  []string
+}
+
+// setUmask makes cmd run with the given umask, without changing the umask of the server, which is shared by all its threads.
+// The op executable is started instead, which sets the umask and then executes the actual command, inheriting the rest of its setup.
+func setUmask(cmd *exec.Cmd, mask int) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	b, err := json.Marshal(umaskSpec{
+		Mask: mask,
+		Path: cmd.Path,
+		Args: cmd.Args,
+		Env:  env,
+	})
+	if err != nil {
+		return err
+	}
+
+	cmd.Path = self
+	cmd.Args = []string{self}
+	cmd.Env = []string{umaskEnv + "=" + string(b), "OP_WORKDIR=" + lib.BasePath}
+	return nil
+}
+
+// umaskExec executes the command described by the umask spec env, if present.
+// Does nothing for other op processes; otherwise never returns.
+func umaskExec() {
+	s := os.Getenv(umaskEnv)
+	if s == "" {
+		return
+	}
+
+	var spec umaskSpec
+	err := json.Unmarshal([]byte(s), &spec)
+	if err == nil {
+		syscall.Umask(spec.Mask)
+		err = syscall.Exec(spec.Path, spec.Args, spec.Env)
+	}
+	fmt.Fprintln(os.Stderr, "umask error:", err)
+	os.Exit(1)
+}
+
+// mkdirMode creates dir, along with missing parents, setting the mode of those it creates.
+func mkdirMode(dir string, mode os.FileMode) error {
+	if _, err := os.Stat(dir); err == nil || !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := mkdirMode(filepath.Dir(dir), mode); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0700); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return nil
+		}
+		return err
+	}
+	return os.Chmod(dir, mode)
+}
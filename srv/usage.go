@@ -0,0 +1,229 @@
+package srv
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+// historySize is the number of finished routes kept for listings.
+const historySize = 20
+
+// A rusage summarizes the resources consumed by one or more processes.
+type rusage struct {
+	maxRSS int64 // bytes
+	user   time.Duration
+	sys    time.Duration
+	wall   time.Duration
+}
+
+// newRusage returns the resource usage of an exited command, which ran for the given wall time.
+func newRusage(state *os.ProcessState, wall time.Duration) rusage {
+	r := rusage{wall: wall}
+	if state == nil {
+		return r
+	}
+	if ru, ok := state.SysUsage().(*syscall.Rusage); ok {
+		r.maxRSS = maxRSSBytes(ru)
+		r.user = time.Duration(ru.Utime.Nano())
+		r.sys = time.Duration(ru.Stime.Nano())
+	}
+	return r
+}
+
+// add accumulates another usage, as if run sequentially; memory is the maximum of both.
+func (x *rusage) add(o rusage) {
+	if o.maxRSS > x.maxRSS {
+		x.maxRSS = o.maxRSS
+	}
+	x.user += o.user
+	x.sys += o.sys
+}
+
+func (x rusage) String() string {
+	return "wall=" + x.wall.Round(time.Millisecond).String() +
+		" user=" + x.user.Round(time.Millisecond).String() +
+		" sys=" + x.sys.Round(time.Millisecond).String() +
+		" maxrss=" + fmt.Sprintf("%.1fMB", float64(x.maxRSS)/(1<<20))
+}
+
+// procExited accumulates the usage of a finished route process, and records its exit code.
+func (x *route) procExited(p *proc) {
+	x.mux.Lock()
+	x.usage.add(p.usage)
+	if p.exited {
+		x.exitCode, x.exited = p.exitCode, true
+	}
+	x.mux.Unlock()
+	stateChanged()
+}
+
+// A finished holds the outcome of a finished route run.
+type finished struct {
+	namespace string
+	name      string
+	id        string
+	outcome   string // see route.outcome
+	end       time.Time
+	err       error
+	usage     rusage
+	exitCode  int  // exit code of the last exited process, if exited
+	exited    bool // a process has exited
+
+	deprecated string // deprecation notice of the route, if any
+}
+
+func (x finished) String() string {
+	result := "ok"
+	if x.err != nil {
+		result = "error: " + x.err.Error()
+	}
+	s := x.name + "|" + x.outcome + " " + x.end.Format(time.Stamp) + " " + strconv.Quote(result)
+	if x.exited {
+		s += " exit=" + strconv.Itoa(x.exitCode)
+	}
+	s += " " + x.usage.String()
+	if lib.RunRetention > 0 {
+		s += " run=" + x.id
+	}
+	if x.deprecated != "" {
+		s += " deprecated=" + strconv.Quote(x.deprecated)
+	}
+	return s
+}
+
+// exitStatus returns the client exit status of the failed run: the exit code of its last exited process,
+// or 1 if there is none, or if it was terminated by a signal.
+func (x finished) exitStatus() int {
+	if x.exited && x.exitCode > 0 {
+		return x.exitCode
+	}
+	return 1
+}
+
+// status returns the outcome of the run, for JSON listings.
+func (x finished) status() lib.RouteStatus {
+	r := lib.RouteStatus{
+		Namespace: x.namespace,
+		Route:     x.name,
+		State:     x.outcome,
+		Run:       x.id,
+		Start:     x.end.Add(-x.usage.wall),
+		End:       x.end,
+
+		Deprecated: x.deprecated,
+	}
+	if x.err != nil {
+		r.Error = x.err.Error()
+	}
+	if x.exited {
+		code := x.exitCode
+		r.ExitCode = &code
+	}
+	return r
+}
+
+var (
+	history    []finished // most recent last
+	historyMux sync.Mutex
+)
+
+// historyAdd records a finished route run, discarding the oldest if needed, along with the output buffers of routes that are gone.
+func historyAdd(f finished) {
+	defer stateChanged()
+	defer logBuffersPrune()
+	historyMux.Lock()
+	defer historyMux.Unlock()
+	history = append(history, f)
+	if len(history) > historySize {
+		history = append([]finished{}, history[len(history)-historySize:]...)
+	}
+}
+
+// historyRange applies fn to the finished runs of the given namespace, oldest first.
+func historyRange(namespace string, fn func(finished)) {
+	historyMux.Lock()
+	defer historyMux.Unlock()
+	for _, f := range history {
+		if f.namespace == namespace {
+			fn(f)
+		}
+	}
+}
+
+// historyLast returns the last finished run of the given route.
+func historyLast(namespace, name string) (finished, bool) {
+	historyMux.Lock()
+	defer historyMux.Unlock()
+	for i := len(history) - 1; i >= 0; i-- {
+		if f := history[i]; f.namespace == namespace && f.name == name {
+			return f, true
+		}
+	}
+	return finished{}, false
+}
+
+// report writes the completion message of a finished route to the command's stderr, and records it in the history.
+func (x *route) report(err error) {
+	x.mux.Lock()
+	u := x.usage
+	code, exited := x.exitCode, x.exited
+	deprecated := x.cfg.Deprecated
+	x.mux.Unlock()
+	u.wall = time.Since(x.start)
+
+	f := finished{
+		namespace: x.namespace,
+		name:      x.name,
+		id:        x.id,
+		outcome:   x.outcome(err),
+		end:       time.Now(),
+		err:       err,
+		usage:     u,
+		exitCode:  code,
+		exited:    exited,
+
+		deprecated: deprecated,
+	}
+	historyAdd(f)
+	x.mux.Lock()
+	x.last = f
+	x.mux.Unlock()
+
+	msg := x.name + " " + f.outcome + ": " + u.String()
+	if lib.RunRetention > 0 {
+		msg += " run=" + x.id
+		go pruneRuns()
+	}
+	x.stderr.Write([]byte(msg + "\n"))
+}
+
+// Route kinds.
+const (
+	kindTask    = "task"
+	kindService = "service"
+)
+
+// outcome describes how a route run has ended, given its error, according to the route kind.
+// Tasks are expected to finish, so they have either "finished" or "failed".
+// Services are expected to run until stopped, so they have "stopped" when killed, and otherwise "exited" or "failed".
+func (x *route) outcome(err error) string {
+	if x.cfg.Kind == kindService {
+		switch {
+		case x.life.Err() != nil:
+			return "stopped"
+		case err == nil:
+			return "exited"
+		}
+		return "failed"
+	}
+	if err != nil {
+		return "failed"
+	}
+	return "finished"
+}
@@ -0,0 +1,50 @@
+package srv
+
+import (
+	"errors"
+	"time"
+)
+
+// waitTimeoutStatus is the client exit status of a timed out wait, as used by the timeout utility.
+const waitTimeoutStatus = 124
+
+// executeWait blocks until the target route instance terminates, then writes its last run to the command's stdout,
+// and sets the client exit status according to its result.
+// A route that is not active, but has finished, is reported at once.
+func (x command) executeWait() error {
+	if x.Route == "" || x.group() != nil {
+		return errors.New("a wait requires a route")
+	}
+	name := instanceName(x.Route, x.Instance)
+
+	if rt, ok := activeGet(x.Namespace, name); ok {
+		var timeout <-chan time.Time
+		if x.Timeout > 0 {
+			t := time.NewTimer(x.Timeout)
+			defer t.Stop()
+			timeout = t.C
+		}
+		select {
+		case <-rt.done:
+		case <-timeout:
+			x.stderr.Write([]byte(name + " wait timed out after " + x.Timeout.String() + "\n"))
+			x.fail(waitTimeoutStatus)
+			return nil
+		case <-x.ctx.Done():
+			x.fail(1)
+			return nil
+		}
+	}
+
+	f, ok := historyLast(x.Namespace, name)
+	if !ok {
+		x.stderr.Write([]byte(name + " not active\n"))
+		x.fail(1)
+		return nil
+	}
+	x.stdout.Write([]byte(f.String() + "\n"))
+	if f.err != nil {
+		x.fail(f.exitStatus())
+	}
+	return nil
+}
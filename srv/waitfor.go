@@ -0,0 +1,99 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+// waitConditions blocks until all the route's external conditions hold, in order.
+// Returns an error if one of them times out, or if x is canceled.
+func (x *route) waitConditions() error {
+	for _, w := range x.cfg.WaitFor {
+		desc := conditionString(w)
+		if desc == "" {
+			return errors.New("wait condition has no check")
+		}
+		x.activeSet("waiting for " + desc)
+		x.markStarted()
+		if err := waitCondition(x.ctx, w); err != nil {
+			if x.ctx.Err() != nil {
+				x.activeSet("canceled")
+				return errors.New("canceled")
+			}
+			x.activeSet("wait error")
+			return errors.New("wait for " + desc + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// waitCondition checks w until it holds, its timeout expires or ctx is done.
+func waitCondition(ctx context.Context, w lib.WaitFor) error {
+	interval := time.Duration(w.Interval)
+	if interval <= 0 {
+		interval = probeInterval
+	}
+	if w.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(w.Timeout))
+		defer cancel()
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if checkCondition(w, interval) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return errors.New("timeout")
+		case <-t.C:
+		}
+	}
+}
+
+// checkCondition returns true if w holds.
+// Network checks are bounded by the given timeout.
+func checkCondition(w lib.WaitFor, timeout time.Duration) bool {
+	switch {
+	case w.Tcp != "":
+		conn, err := net.DialTimeout("tcp", w.Tcp, timeout)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	case w.Http != "":
+		client := http.Client{Timeout: timeout}
+		resp, err := client.Get(w.Http)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode >= 200 && resp.StatusCode < 300
+	case w.Path != "":
+		_, err := os.Stat(w.Path)
+		return err == nil
+	}
+	return false
+}
+
+// conditionString describes w for listings and errors; empty if it has no check.
+func conditionString(w lib.WaitFor) string {
+	switch {
+	case w.Tcp != "":
+		return "tcp " + w.Tcp
+	case w.Http != "":
+		return "http " + w.Http
+	case w.Path != "":
+		return "path " + w.Path
+	}
+	return ""
+}
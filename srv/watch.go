@@ -0,0 +1,43 @@
+package srv
+
+import (
+	"sync"
+	"time"
+)
+
+// watchDebounce is the quiet period after a file change, before the process is restarted.
+// Changes usually come in bursts, such as a build writing several files.
+const watchDebounce = 500 * time.Millisecond
+
+// watchFiles restarts the process when files under its watch paths change, until it exits.
+func (x *proc) watchFiles() {
+	var (
+		mux sync.Mutex
+		t   *time.Timer
+	)
+	restart := func() {
+		x.notify.Write([]byte(x.route + "|" + x.name + ": change detected, restarting\n"))
+		x.requestRestart()
+	}
+
+	err := watchChanges(x.watch, x.done, func() {
+		mux.Lock()
+		defer mux.Unlock()
+		if t == nil {
+			t = time.AfterFunc(watchDebounce, restart)
+		} else {
+			t.Reset(watchDebounce)
+		}
+	})
+	if err != nil {
+		stderr.Println(x.name+" watch error:", err)
+		return
+	}
+
+	<-x.done
+	mux.Lock()
+	if t != nil {
+		t.Stop()
+	}
+	mux.Unlock()
+}
@@ -0,0 +1,93 @@
+package op
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/blitz-frost/op/lib"
+)
+
+// sparkWidth is the maximum number of sparkline characters.
+const sparkWidth = 60
+
+var sparkLevels = []rune("▁▂▃▄▅▆▇█")
+
+// printStats prints a resource usage summary of the route named by the major argument, over the last ArgLast.
+func printStats() error {
+	if lib.ArgMajor == "" {
+		return errors.New("route not specified")
+	}
+
+	// resolve the route namespace through the manifest, if possible
+	namespace := "default"
+	if manifest, err := lib.DecodeConfig(); err == nil {
+		if rt, ok := manifest.Routes[lib.ArgMajor]; ok {
+			namespace = rt.Namespace
+		}
+	}
+
+	samples, err := lib.ReadSamples(namespace, lib.ArgMajor, time.Now().Add(-lib.ArgLast))
+	if err != nil {
+		return fmt.Errorf("stats read error: %w", err)
+	}
+	if len(samples) == 0 {
+		return errors.New("no samples in the last " + lib.ArgLast.String())
+	}
+
+	cpu := make([]float64, len(samples))
+	rss := make([]float64, len(samples))
+	for i, s := range samples {
+		cpu[i] = s.CPU
+		rss[i] = float64(s.RSS) / (1 << 20)
+	}
+
+	fmt.Printf("%s: %s, %d samples over the last %s\n", namespace, lib.ArgMajor, len(samples), lib.ArgLast)
+	fmt.Println("cpu %   " + summary(cpu))
+	fmt.Println("rss MB  " + summary(rss))
+	fmt.Println("restarts", lib.Restarts(samples))
+	fmt.Println("truncated lines", lib.Truncated(samples))
+	return nil
+}
+
+// summary returns a sparkline of the given values, followed by their minimum, average and maximum.
+func summary(v []float64) string {
+	min, max, sum := v[0], v[0], 0.0
+	for _, x := range v {
+		if x < min {
+			min = x
+		}
+		if x > max {
+			max = x
+		}
+		sum += x
+	}
+	return fmt.Sprintf("%s min %.1f avg %.1f max %.1f", sparkline(v, max), min, sum/float64(len(v)), max)
+}
+
+// sparkline renders the given values relative to max, averaging them into at most sparkWidth buckets.
+func sparkline(v []float64, max float64) string {
+	n := len(v)
+	if n > sparkWidth {
+		n = sparkWidth
+	}
+
+	b := strings.Builder{}
+	for i := 0; i < n; i++ {
+		// bucket i covers values [i*len/n, (i+1)*len/n)
+		lo, hi := i*len(v)/n, (i+1)*len(v)/n
+		sum := 0.0
+		for _, x := range v[lo:hi] {
+			sum += x
+		}
+		avg := sum / float64(hi-lo)
+
+		level := 0
+		if max > 0 {
+			level = int(avg / max * float64(len(sparkLevels)-1))
+		}
+		b.WriteRune(sparkLevels[level])
+	}
+	return b.String()
+}